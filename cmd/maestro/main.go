@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/crisidev/maestro"
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -21,13 +23,28 @@ var (
 
 	// global
 	flagDebug          = app.Flag("debug", "enable debug mode").Short('d').Bool()
-	flagConfigFile     = app.Flag("config", "configuration file").Short('c').Default("maestro.json").String()
+	flagConfigFile     = app.Flag("config", "configuration file (json, yaml or toml), repeatable").Short('c').Default("maestro.json").Strings()
 	flagVolumesDir     = app.Flag("volumesdir", "directory on the coreos host for shared volumes").Short('V').Default("/share/maestro").String()
 	flagMaestroDir     = app.Flag("maestrodir", "directory on the local host for configs and temporary files (default to $USER/.maestro)").Short('m').String()
 	flagDomain         = app.Flag("domain", "domain used to deal with etcd, skydns, spartito and violino").Default("maestro.io").String()
-	flagFleetEndpoints = app.Flag("etcd", "etcd / fleet endpoints to connect").Short('e').String()
+	flagFleetEndpoints = app.Flag("etcd", "etcd / fleet endpoints to connect, comma separated (default to <fleetaddr>:2379)").Short('e').String()
+	flagEtcdAPI        = app.Flag("etcdapi", "etcd api version (v2 or v3)").Default("v2").Enum(maestro.EtcdAPIs...)
+	flagEtcdCert       = app.Flag("etcdcert", "etcd tls client certificate").String()
+	flagEtcdKeyFile    = app.Flag("etcdkey", "etcd tls client key").String()
+	flagEtcdCA         = app.Flag("etcdca", "etcd tls certificate authority").String()
 	flagFleetOptions   = app.Flag("fleetopts", "fleetctl options").Short('F').Strings()
 	flagFleetAddress   = app.Flag("fleetaddr", "fleetctl tunnel address and port").Default("172.17.8.101").Short('A').String()
+	flagFleetAPI       = app.Flag("fleetapi", "fleet http api endpoint (default to http://<fleetaddr>:49153)").String()
+	flagLax            = app.Flag("lax", "warn instead of failing on unknown configuration fields").Bool()
+	flagVars           = app.Flag("var", "variable interpolated in the configuration as ${KEY} (KEY=value)").StringMap()
+	flagEnvFile        = app.Flag("envfile", "dotenv file with variables interpolated in the configuration").String()
+	flagSecretKey      = app.Flag("secretkey", "file with the passphrase used to encrypt secrets (default to $maestrodir/secrets.key)").String()
+	flagSecretsFile    = app.Flag("secretsfile", "local encrypted file storing secrets, instead of etcd").String()
+	flagHistoryLimit   = app.Flag("history", "number of revisions kept in the deployment history of every stage, 0 to disable it").Default(strconv.Itoa(maestro.HistoryDefaultLimit)).Int()
+	flagDigests        = app.Flag("digests", "record image digests in the deployment history, asking the registries, to pin images on rollback").Default("true").Bool()
+	flagDNSRecords     = app.Flag("dnsrecords", "write the skydns records of the app instances in etcd, instead of relying on spartito and violino").Bool()
+	flagLockTTL        = app.Flag("lockttl", "time to live of the deploy lock taken by commands changing the app, 0 to disable it").Default(maestro.LockDefaultTTL.String()).Duration()
+	flagBackend        = app.Flag("backend", fmt.Sprintf("backend used to run app units (%s)", strings.Join(maestro.SchedulerNames(), ", "))).Short('b').Default("fleet").Enum(maestro.SchedulerNames()...)
 
 	// cluster
 	flagCoreStatus = app.Command("corestatus", "report coreos cluster status")
@@ -37,10 +54,16 @@ var (
 	flagEtcdKey    = flagEtcd.Arg("name", "get one key").String()
 	flagEtcdSkydns = flagEtcd.Flag("skydns", "include skydns in the list of etcd keys").Short('D').Bool()
 	flagEtcdAll    = flagEtcd.Flag("all", "get the list of all etcd keys").Short('a').Bool()
+	flagEtcdApp    = flagEtcd.Flag("app", "restrict to the keys of current app").Bool()
+	flagEtcdTree   = flagEtcd.Flag("tree", "print keys as an indented hierarchy").Short('t').Bool()
+	flagEtcdJSON   = flagEtcd.Flag("json", "print keys with values and ttls as json").Bool()
+	flagEtcdWatch  = flagEtcd.Flag("watch", "stream changes of the keys").Short('w').Bool()
 
 	// app
 	flagRun           = app.Command("run", "run current app on coreos (this will build unit files, submit and run them)")
 	flagRunUnit       = flagRun.Arg("name", "restrict to one component").String()
+	flagRunWait       = flagRun.Flag("wait", "wait until all components, or the unit run, are active and healthy").Bool()
+	flagRunTimeout    = flagRun.Flag("timeout", "maximum time to wait with --wait").Default("5m").Duration()
 	flagStop          = app.Command("stop", "stop current app without cleaning unit files on coreos")
 	flagStopUnit      = flagStop.Arg("name", "restrict to one component").String()
 	flagNuke          = app.Command("nuke", "stop current app and clean unit files on coreos")
@@ -52,10 +75,49 @@ var (
 	flagJournalUnit   = flagJournal.Arg("name", "restrict to one component").String()
 	flagJournalFollow = flagJournal.Flag("follow", "follow component journal").Short('f').Bool()
 	flagJournalAll    = flagJournal.Flag("all", "get all component journal").Bool()
+	flagDeploy        = app.Command("deploy", "rolling update of current app on coreos, replacing instances in batches")
+	flagDeployUnit    = flagDeploy.Arg("component", "restrict to one component").String()
+	flagDeployBatch   = flagDeploy.Flag("batch", "number of instances replaced at a time").Default("1").Int()
+	flagDeployTimeout = flagDeploy.Flag("timeout", "time to wait for every batch to become active").Default("5m").Duration()
+	flagScale         = app.Command("scale", "change the number of running instances of a component on coreos")
+	flagScaleUnit     = flagScale.Arg("component", "component to scale").Required().String()
+	flagScaleCount    = flagScale.Arg("count", "number of instances").Required().Int()
+	flagPlan          = app.Command("plan", "show what a run would change on coreos (unit diffs and summary)").Alias("diff")
+	flagPlanJSON      = flagPlan.Flag("json", "print the plan as json").Bool()
+	flagPlanDetailed  = flagPlan.Flag("detailed-exitcode", "exit with code 2 when there are changes").Bool()
+	flagHistory       = app.Command("history", "list the recorded revisions of current app")
+	flagHistoryStage  = flagHistory.Flag("stage", "stage of the revisions (default to the only stage)").String()
+	flagHistoryJSON   = flagHistory.Flag("json", "print the revisions as json, with unit files and configuration").Bool()
+	flagRollback      = app.Command("rollback", "submit again the unit files of a recorded revision of current app")
+	flagRollbackRev   = flagRollback.Arg("revision", "revision to roll back to (default to the previous one)").Int()
+	flagRollbackStage = flagRollback.Flag("stage", "stage to roll back (default to the only stage)").String()
+	flagDNS           = app.Command("dns", "list and verify the skydns records of current app")
+	flagDNSStage      = flagDNS.Flag("stage", "restrict to one stage").String()
+	flagDNSFix        = flagDNS.Flag("fix", "write missing or outdated records and remove stale ones").Bool()
+	flagLock          = app.Command("lock", "show who holds the deploy lock of current app")
+	flagUnlock        = app.Command("unlock", "remove the deploy lock of current app")
+	flagUnlockStage   = flagUnlock.Flag("stage", "restrict to one stage").String()
+	flagUnlockForce   = flagUnlock.Flag("force", "remove locks held by other users").Bool()
+
+	// secrets
+	flagSecret         = app.Command("secret", "manage encrypted secrets of current app")
+	flagSecretStage    = flagSecret.Flag("stage", "stage of the secret (default to the only stage)").String()
+	flagSecretSet      = flagSecret.Command("set", "encrypt and store a secret")
+	flagSecretSetName  = flagSecretSet.Arg("name", "secret name, exported as environment variable").Required().String()
+	flagSecretSetValue = flagSecretSet.Arg("value", "secret value (default to standard input)").String()
+	flagSecretGet      = flagSecret.Command("get", "print a decrypted secret")
+	flagSecretGetName  = flagSecretGet.Arg("name", "secret name").Required().String()
+	flagSecretList     = flagSecret.Command("ls", "list secrets")
+	flagSecretRm       = flagSecret.Command("rm", "remove a secret")
+	flagSecretRmName   = flagSecretRm.Arg("name", "secret name").Required().String()
 
 	// info
-	flagUser   = app.Command("user", "get current user name")
-	flagConfig = app.Command("config", "print json configuration for current app")
+	flagUser         = app.Command("user", "get current user name")
+	flagConfig       = app.Command("config", "print configuration for current app")
+	flagConfigFormat = flagConfig.Flag("format", fmt.Sprintf("output format (%s)", strings.Join(maestro.ConfigFormats, ", "))).Default("json").Enum(maestro.ConfigFormats...)
+	flagConfigStage  = flagConfig.Flag("stage", "print only one stage, with components defaults merged").String()
+	flagValidate     = app.Command("validate", "validate configuration for current app")
+	flagSchema       = app.Command("schema", "print the json schema of the configuration file")
 
 	// build
 	flagBuildUnits      = app.Command("build", "locally build app units")
@@ -67,12 +129,33 @@ var (
 	flagBuildNukeUnit   = flagBuildNuke.Arg("name", "restrict to one component").String()
 )
 
+// Commands changing the app, run holding the deploy lock. Units stopped or nuked without a
+// configuration are not locked, as the app they belong to is unknown.
+var lockedCommands = map[string]bool{
+	flagRun.FullCommand():      true,
+	flagStop.FullCommand():     true,
+	flagNuke.FullCommand():     true,
+	flagDeploy.FullCommand():   true,
+	flagScale.FullCommand():    true,
+	flagRollback.FullCommand(): true,
+}
+
 // Command switch for commands requiring a config to be loaded
 func ConfigCommandSwitch(args string, err error) (exitCode int) {
-	config = maestro.BuildMaestroConfig(*flagConfigFile)
-	switch kingpin.MustParse(args, err) {
+	config = maestro.BuildMaestroConfig(*flagConfigFile...)
+	command := kingpin.MustParse(args, err)
+	if lockedCommands[command] {
+		lock, exitCode := maestro.LockApp(command)
+		if exitCode != 0 {
+			return exitCode
+		}
+		defer lock.Unlock()
+	}
+	switch command {
 	case flagConfig.FullCommand():
-		config.Print()
+		config.Print(*flagConfigFormat, *flagConfigStage)
+	case flagValidate.FullCommand():
+		exitCode = maestro.MaestroValidate()
 	case flagUser.FullCommand():
 		config.GetUsername()
 	case flagBuildUnits.FullCommand():
@@ -87,35 +170,86 @@ func ConfigCommandSwitch(args string, err error) (exitCode int) {
 		exitCode = maestro.MaestroStatus("")
 	case flagJournal.FullCommand():
 		exitCode = maestro.MaestroJournal("", *flagJournalFollow, *flagJournalAll)
+	case flagDeploy.FullCommand():
+		exitCode = maestro.MaestroDeploy(*flagDeployUnit, *flagDeployBatch, *flagDeployTimeout)
+	case flagScale.FullCommand():
+		exitCode = maestro.MaestroScale(*flagScaleUnit, *flagScaleCount)
+	case flagPlan.FullCommand():
+		exitCode = maestro.MaestroPlan(*flagPlanJSON, *flagPlanDetailed)
+	case flagHistory.FullCommand():
+		exitCode = maestro.MaestroHistory(*flagHistoryStage, *flagHistoryJSON)
+	case flagRollback.FullCommand():
+		exitCode = maestro.MaestroRollback(*flagRollbackStage, *flagRollbackRev)
+	case flagDNS.FullCommand():
+		exitCode = maestro.MaestroDNS(*flagDNSStage, *flagDNSFix)
+	case flagLock.FullCommand():
+		exitCode = maestro.MaestroLockStatus()
+	case flagUnlock.FullCommand():
+		exitCode = maestro.MaestroUnlock(*flagUnlockStage, *flagUnlockForce)
+	case flagSecretSet.FullCommand():
+		exitCode = maestro.MaestroSecretSet(*flagSecretStage, *flagSecretSetName, *flagSecretSetValue)
+	case flagSecretGet.FullCommand():
+		exitCode = maestro.MaestroSecretGet(*flagSecretStage, *flagSecretGetName)
+	case flagSecretList.FullCommand():
+		exitCode = maestro.MaestroSecretList(*flagSecretStage)
+	case flagSecretRm.FullCommand():
+		exitCode = maestro.MaestroSecretDelete(*flagSecretStage, *flagSecretRmName)
 	case flagRun.FullCommand():
 		exitCode = maestro.MaestroRun(*flagRunUnit)
+		if exitCode == 0 && *flagRunWait {
+			exitCode = maestro.MaestroWait(*flagRunUnit, *flagRunTimeout)
+		}
 	case flagStop.FullCommand():
-		exitCode = maestro.MaestroStop("")
+		exitCode = maestro.MaestroStop(*flagStopUnit)
 	case flagNuke.FullCommand():
-		exitCode = maestro.MaestroNuke("")
+		exitCode = maestro.MaestroNuke(*flagNukeUnit)
+	case flagEtcd.FullCommand():
+		exitCode = EtcdCommand(config.GetEtcdPrefixes(*flagEtcdSkydns))
 	}
 	return
 }
 
+// Lists or watches the etcd keys under prefixes
+func EtcdCommand(prefixes []string) int {
+	if *flagEtcdWatch {
+		return maestro.EtcdWatchKeys(prefixes, *flagEtcdKey, *flagEtcdTree, *flagEtcdJSON)
+	}
+	return maestro.EtcdPullKeys(prefixes, *flagEtcdKey, *flagEtcdTree, *flagEtcdJSON)
+}
+
+// Returns true if the configuration files can be read
+func configLoadable() bool {
+	_, err := maestro.MergeConfigFiles(*flagConfigFile)
+	return err == nil
+}
+
 // Initial switch for commands not requiring a configuration
 func NoConfigCommandSwitch(args string, err error) (exitCode int) {
 	exitCode = -1
 	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
 	case flagCoreStatus.FullCommand():
 		exitCode = maestro.MaestroCoreStatus()
+	case flagSchema.FullCommand():
+		exitCode = maestro.MaestroPrintSchema()
 	case flagExec.FullCommand():
 		output := make(chan string)
 		exit := make(chan int)
 		go maestro.FleetExec(*flagExecArgs, output, exit)
 		exitCode = maestro.FleetProcessOutput(output, exit)
 	case flagEtcd.FullCommand():
-		exitCode = maestro.EtcdPullKeys(*flagEtcdSkydns, *flagEtcdAll, *flagEtcdKey)
+		if !*flagEtcdApp {
+			exitCode = EtcdCommand(maestro.EtcdPrefixes(*flagEtcdSkydns, *flagEtcdAll))
+		}
 	case flagNuke.FullCommand():
 		if *flagNukeAll {
 			exitCode = maestro.MaestroNukeAll()
-		} else if *flagNukeUnit != "" {
+		} else if *flagNukeUnit != "" && !configLoadable() {
 			exitCode = maestro.MaestroNuke(*flagNukeUnit)
 		}
+	case flagStop.FullCommand():
+		if *flagStopUnit != "" && !configLoadable() {
+			exitCode = maestro.MaestroStop(*flagStopUnit)
+		}
 	case flagStatus.FullCommand():
 		if *flagStatusUnit != "" {
 			exitCode = maestro.MaestroStatus(*flagStatusUnit)
@@ -124,10 +258,6 @@ func NoConfigCommandSwitch(args string, err error) (exitCode int) {
 		if *flagJournalUnit != "" {
 			exitCode = maestro.MaestroJournal(*flagJournalUnit, *flagJournalFollow, *flagJournalAll)
 		}
-	case flagStop.FullCommand():
-		if *flagStopUnit != "" {
-			exitCode = maestro.MaestroStop(*flagStopUnit)
-		}
 	}
 	return
 }
@@ -141,6 +271,15 @@ func main() {
 	// initialize maestro
 	maestro.Init(*flagMaestroDir, *flagDomain, *flagFleetAddress,
 		*flagVolumesDir, *flagFleetEndpoints, *flagFleetOptions, *flagDebug)
+	maestro.SetupFleetClient(*flagFleetAPI)
+	maestro.SetupEtcdClient(*flagFleetEndpoints, *flagEtcdAPI, *flagEtcdCert, *flagEtcdKeyFile, *flagEtcdCA)
+	maestro.SetupScheduler(*flagBackend)
+	maestro.SetupConfigCheck(*flagLax)
+	maestro.SetupConfigVars(*flagVars, *flagEnvFile)
+	maestro.SetupSecrets(*flagSecretKey, *flagSecretsFile)
+	maestro.SetupHistory(*flagHistoryLimit, *flagDigests)
+	maestro.SetupLock(*flagLockTTL)
+	maestro.SetupDNS(*flagDNSRecords)
 
 	exitCode := NoConfigCommandSwitch(args, err)
 	if exitCode != -1 {
@@ -14,6 +14,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -70,7 +71,8 @@ func MaestroExecRun(fn MaestroCommand, cmd, unit string) (exitCode int) {
 		return
 	} else {
 		for _, stage := range config.Stages {
-			for _, component := range stage.Components {
+			// dependencies are started first
+			for _, component := range SortComponents(stage.Components) {
 				for i := 1; i < component.Scale+1; i++ {
 					if cmd == "status" {
 						lg.Out(lg.b("maestro ") + "unit: " + component.UnitName + strconv.Itoa(i))
@@ -84,7 +86,7 @@ func MaestroExecRun(fn MaestroCommand, cmd, unit string) (exitCode int) {
 }
 
 // Build local unit files to build new docker images. After the unit is build, it will
-// destroy, submit, load and start using fleetctl. The image will be pushed to the local
+// destroy, submit, load and start using fleet. The image will be pushed to the local
 // registry.
 func MaestroBuildContainers(unit string) (exitCode int) {
 	MaestroBuildLocalUnits()
@@ -105,27 +107,37 @@ func MaestroBuildNuke(unit string) (exitCode int) {
 
 // Function used to submit, load and start all the units inside the current app.
 // It can start also a single unit, using `unit` argument. If the unit is already running,
-// it will print a message and do nothing.
+// it will print a message and do nothing, unless its unit file changed: changed units
+// are destroyed, submitted and started again. Successful runs of the whole app are recorded
+// in the deployment history.
 func MaestroRun(unit string) (exitCode int) {
 	MaestroBuildLocalUnits()
-	exitCode = MaestroExecRun(FleetRunUnit, "", unit)
+	exitCode = MaestroExecRun(SchedulerRunUnit, "", unit)
+	if exitCode == 0 && unit == "" {
+		HistoryRecord("run")
+	}
+	DNSSync()
 	lg.Out("check results with " + lg.b("maestro status") + "|" + lg.b("journal <unit name>"))
 	return
 }
 
 // Stops all units in the current app. It can stop also a single unit, using `unit` argument.
 func MaestroStop(unit string) (exitCode int) {
-	return MaestroExecRun(FleetExecCommand, "stop", unit)
+	exitCode = MaestroExecRun(SchedulerCommand, "stop", unit)
+	DNSSync()
+	return
 }
 
 // Destroys all units in the current app. It can stop also a single unit, using `unit` argument.
 func MaestroNuke(unit string) (exitCode int) {
-	return MaestroExecRun(FleetExecCommand, "destroy", unit)
+	exitCode = MaestroExecRun(SchedulerCommand, "destroy", unit)
+	DNSSync()
+	return
 }
 
 // Prints status for all units in the current app It can also get the status of a single unit, using `unit` argument.
 func MaestroStatus(unit string) (exitCode int) {
-	return MaestroExecRun(FleetExecCommand, "status", unit)
+	return MaestroExecRun(SchedulerCommand, "status", unit)
 }
 
 // Prints the journal for all units in the current app It can also get the journal of a single unit, using `unit` argument.
@@ -136,57 +148,63 @@ func MaestroJournal(unit string, follow, all bool) (exitCode int) {
 	} else if all {
 		cmd = "journala"
 	}
-	return MaestroExecRun(FleetExecCommand, cmd, unit)
+	return MaestroExecRun(SchedulerCommand, cmd, unit)
 }
 
-// Executes a global coreos status, running `list-machines`, `list-units`, `list-unit-files`.
+// Executes a global coreos status, listing machines, units and unit states.
 func MaestroCoreStatus() (exitCode int) {
 	lg.Out("executing global status for coreos cluster")
-	argsList := [][]string{[]string{"list-machines"}, []string{"list-units"}, []string{"list-unit-files"}}
-	for i, args := range argsList {
-		output := make(chan string)
-		exit := make(chan int)
-		lg.Out(lg.b("maestro ") + "running fleetctl " + strings.Join(args, " "))
-		go FleetExec(args, output, exit)
-		exitCode += FleetProcessOutput(output, exit)
-		if i < 3 {
-			lg.Out("")
+	machines, err := fleetClient.Machines()
+	if err != nil {
+		lg.Error(err)
+		return 1
+	}
+	lg.Out(lg.b("maestro ") + "machines")
+	for _, machine := range machines {
+		metadata := []string{}
+		for key, value := range machine.Metadata {
+			metadata = append(metadata, key+"="+value)
 		}
+		sort.Strings(metadata)
+		lg.Out(machine.ID + "\t" + machine.PrimaryIP + "\t" + strings.Join(metadata, ","))
+	}
+	lg.Out("")
+	states, err := fleetClient.UnitStates("")
+	if err != nil {
+		lg.Error(err)
+		return 1
+	}
+	lg.Out(lg.b("maestro ") + "units")
+	for _, state := range states {
+		lg.Out(state.Name + "\t" + state.MachineID + "\t" + state.SystemdActiveState + "\t" + state.SystemdSubState)
+	}
+	lg.Out("")
+	units, err := fleetClient.Units()
+	if err != nil {
+		lg.Error(err)
+		return 1
+	}
+	lg.Out(lg.b("maestro ") + "unit files")
+	for _, unit := range units {
+		lg.Out(unit.Name + "\t" + unit.DesiredState + "\t" + unit.CurrentState)
 	}
 	return
 }
 
+// Destroys every unit on the cluster, after asking for confirmation.
 func MaestroNukeAll() (exitCode int) {
 	reader := bufio.NewReader(os.Stdin)
 	lg.OutRaw(lg.r("are you sure you want to nuke ALL units on this cluster? [y/N] "))
 	text, _ := reader.ReadString('\n')
 	if text == "y\n" || text == "Y\n" {
-		output := make(chan string)
-		exit := make(chan int)
-		go FleetExec([]string{"list-units"}, output, exit)
-		for line := range output {
-			if strings.Contains(line, "service") {
-				split := strings.Fields(line)
-				localOutput := make(chan string)
-				localExit := make(chan int)
-				go FleetExec([]string{"destroy", split[0]}, localOutput, localExit)
-				exitCode += FleetProcessOutput(localOutput, localExit)
-			}
+		units, err := fleetClient.Units()
+		if err != nil {
+			lg.Error(err)
+			return 1
 		}
-		_ = <-exit
-		output = make(chan string)
-		exit = make(chan int)
-		go FleetExec([]string{"list-unit-files"}, output, exit)
-		for line := range output {
-			if strings.Contains(line, "service") {
-				split := strings.Fields(line)
-				localOutput := make(chan string)
-				localExit := make(chan int)
-				go FleetExec([]string{"destroy", split[0]}, localOutput, localExit)
-				exitCode += FleetProcessOutput(localOutput, localExit)
-			}
+		for _, unit := range units {
+			exitCode += FleetExecCommand("destroy", unit.Name)
 		}
-		_ = <-exit
 	}
 	return
 }
@@ -202,6 +220,7 @@ func MaestroCommandExec(cmd *exec.Cmd, output chan string) (exitCode int) {
 	}
 	scannerOut := bufio.NewScanner(cmdOut)
 	scannerErr := bufio.NewScanner(cmdErr)
+	done := make(chan bool)
 	go func() {
 		for scannerOut.Scan() {
 			output <- scannerOut.Text()
@@ -210,10 +229,15 @@ func MaestroCommandExec(cmd *exec.Cmd, output chan string) (exitCode int) {
 			output <- scannerErr.Text()
 		}
 		close(output)
+		close(done)
 	}()
 	if err := cmd.Start(); err != nil {
 		lg.DebugError(err)
+		<-done
+		return 127
 	}
+	// pipes must be fully read before waiting, as Wait closes them
+	<-done
 	if err := cmd.Wait(); err != nil {
 		if err != nil {
 			lg.DebugError(err)
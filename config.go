@@ -3,6 +3,7 @@ package maestro
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -44,7 +45,6 @@ func SetupMaestroDir(dir string) {
 
 func Init(maestroDir, domainName, address, volumes, endpoints string, options []string, debug bool) {
 	FleetCheckExec()
-	EtcdCheckExec()
 	fleetAddress = address
 	flagDebug = debug
 	if debug {
@@ -55,13 +55,18 @@ func Init(maestroDir, domainName, address, volumes, endpoints string, options []
 	domain = domainName
 	volumesDir = volumes
 	SetupMaestroDir(maestroDir)
+	SetupScheduler(defaultScheduler)
+	SetupEtcdClient(endpoints, "v2", "", "", "")
+	SetupSecrets("", "")
 }
 
 // Public function used in the main to load the configuration.
-func BuildMaestroConfig(cfg string) MaestroConfig {
-	configFile = cfg
-	config = config.LoadMaestroConfig(configFile)
+// More than one configuration file can be used, merging their stages.
+func BuildMaestroConfig(cfgs ...string) MaestroConfig {
+	configFile = strings.Join(cfgs, ", ")
+	config = config.LoadMaestroConfig(cfgs...)
 	lg.SetupBase()
+	config.CheckMaestroConfig()
 	config.SetupUsername()
 	config.SetupMaestroAppDirs()
 	config.SetMaestroComponentConfig()
@@ -74,60 +79,99 @@ type MaestroUser struct {
 
 // MaestroComponent structure
 type MaestroComponent struct {
-	After         string   `json:"after"`
-	App           string   `json:"app"`
-	BuildUnitPath string   `json:"build_unitpath"`
-	Cmd           string   `json:"cmd"`
-	ContainerName string   `json:"container_name"`
-	DNS           string   `json:"dns"`
-	DockerArgs    string   `json:"docker_args"`
-	Env           []string `json:"env"`
-	Frontend      bool     `json:"frontend"`
-	GitSrc        string   `json:"gitsrc"`
-	Global        bool     `json:"global"`
-	InternalDNS   string   `json:"internal_dns"`
-	KeepOnExit    bool     `json:"keep_on_exit"`
-	Name          string   `json:"name"`
-	Ports         []int    `json:"ports"`
-	Scale         int      `json:"scale"`
-	Single        bool     `json:"single"`
-	Src           string   `json:"src"`
-	Stage         string   `json:"stage"`
-	UnitName      string   `json:"unitname"`
-	UnitPath      string   `json:"unitpath"`
-	Username      string   `json:"username"`
-	Volumes       []string `json:"volumes"`
-	VolumesDir    string   `json:"volumes_dir"`
-}
-
-// MaestroConfig structure
+	Affinity        string              `json:"affinity"`
+	AffinityUnit    string              `json:"affinity_unit" maestro:"computed"`
+	After           MaestroDeps         `json:"after"`
+	AfterUnits      []string            `json:"after_units" maestro:"computed"`
+	AntiAffinity    []string            `json:"anti_affinity"`
+	App             string              `json:"app" maestro:"computed"`
+	BindsToUnits    []string            `json:"binds_to_units" maestro:"computed"`
+	BuildUnitPath   string              `json:"build_unitpath" maestro:"computed"`
+	Cmd             string              `json:"cmd"`
+	Conflicts       []string            `json:"conflicts" maestro:"computed"`
+	ContainerName   string              `json:"container_name" maestro:"computed"`
+	CPUs            float64             `json:"cpus"`
+	DNS             string              `json:"dns"`
+	DockerArgs      string              `json:"docker_args"`
+	Env             []string            `json:"env"`
+	Frontend        bool                `json:"frontend"`
+	GitSrc          string              `json:"gitsrc"`
+	Global          bool                `json:"global"`
+	Healthcheck     *MaestroHealthcheck `json:"healthcheck"`
+	InternalDNS     string              `json:"internal_dns" maestro:"computed"`
+	KeepOnExit      bool                `json:"keep_on_exit"`
+	MachineID       string              `json:"machine_id"`
+	MachineMetadata []string            `json:"machine_metadata"`
+	Memory          string              `json:"memory"`
+	Name            string              `json:"name" maestro:"required"`
+	Ports           []MaestroPort       `json:"ports"`
+	Requires        MaestroDeps         `json:"requires"`
+	RequiresUnits   []string            `json:"requires_units" maestro:"computed"`
+	Restart         string              `json:"restart"`
+	RestartSec      int                 `json:"restart_sec"`
+	Scale           int                 `json:"scale"`
+	Secrets         []string            `json:"secrets"`
+	SecretsKey      string              `json:"secrets_key" maestro:"computed"`
+	Single          bool                `json:"single"`
+	Src             string              `json:"src" maestro:"required"`
+	Stage           string              `json:"stage" maestro:"computed"`
+	StartTimeout    int                 `json:"start_timeout"`
+	UnitName        string              `json:"unitname" maestro:"computed"`
+	UnitPath        string              `json:"unitpath" maestro:"computed"`
+	Username        string              `json:"username" maestro:"computed"`
+	Volumes         []string            `json:"volumes"`
+	VolumesDir      string              `json:"volumes_dir" maestro:"computed"`
+	Wants           MaestroDeps         `json:"wants"`
+	WantsUnits      []string            `json:"wants_units" maestro:"computed"`
+}
+
+// MaestroStage structure
+type MaestroStage struct {
+	Components []MaestroComponent `json:"components"`
+	Name       string             `json:"name" maestro:"required"`
+}
+
+// MaestroConfig structure. Components are defaults merged into every stage and included
+// files are merged while loading.
 type MaestroConfig struct {
-	App    string `json:"app"`
-	Stages []struct {
-		Components []MaestroComponent `json:"components"`
-		Name       string             `json:"name"`
-	} `json:"stages"`
-	Username string `json:"username"`
+	App        string             `json:"app" maestro:"required"`
+	Components []MaestroComponent `json:"components,omitempty"`
+	Include    []string           `json:"include,omitempty"`
+	Stages     []MaestroStage     `json:"stages" maestro:"required"`
+	Username   string             `json:"username"`
 }
 
-// Simple repr for MaestroConfig struct.
-func (c *MaestroConfig) Print() {
-	configJson, _ := json.MarshalIndent(c, "", "    ")
-	userJson, _ := json.MarshalIndent(username, "", "    ")
+// Simple repr for MaestroConfig struct, in one of the supported formats.
+// It can be restricted to a single stage, using `stage` argument.
+func (c *MaestroConfig) Print(format, stage string) {
+	printed := c
+	if stage != "" {
+		var err error
+		printed, err = c.Stage(stage)
+		lg.Fatal(err)
+	}
+	configData, err := EncodeConfig(printed, format)
+	lg.Fatal(err)
+	userData, err := EncodeConfig(username, format)
+	lg.Fatal(err)
 
 	lg.Out(lg.b("config and build dir: ") + maestroDir)
 	lg.Out(lg.b("user config path: ") + maestroDir + "/user.json")
-	lg.Out(string(userJson))
+	lg.Out(strings.TrimRight(string(userData), "\n"))
 	lg.Out(lg.b("app config path: ") + configFile)
-	lg.Out(string(configJson))
+	lg.Out(strings.TrimRight(string(configData), "\n"))
 }
 
-// Parses JSON config file into MaestroConfig struct.
-func (c *MaestroConfig) LoadMaestroConfig(path string) MaestroConfig {
-	lg.Debug2("maestro json config file is ", path)
-	file, err := ioutil.ReadFile(path)
+// Parses JSON, YAML or TOML config files into MaestroConfig struct. The format is
+// chosen from the file extension, ${VAR} variables are interpolated, included files are
+// merged and top level components are merged into every stage.
+func (c *MaestroConfig) LoadMaestroConfig(paths ...string) MaestroConfig {
+	file, err := MergeConfigFiles(paths)
 	lg.Fatal(err)
-	lg.Debug("maestro json config file found, loading json")
+	lg.Debug("maestro config files loaded, merging components")
+	file, err = MergeComponentDefaults(file)
+	lg.Fatal(err)
+	*c = MaestroConfig{}
 	err = json.Unmarshal(file, c)
 	lg.Fatal(err)
 	return *c
@@ -241,6 +285,12 @@ func (c *MaestroConfig) SetMaestroComponentConfig() {
 				lg.Debug2("gitsrc is set, build unit local path", component.BuildUnitPath, stage.Name, component.Name)
 			}
 
+			// secrets
+			if len(component.Secrets) > 0 {
+				component.SecretsKey = c.GetSecretsKey(stage.Name)
+				lg.Debug2("secrets etcd key", component.SecretsKey, stage.Name, component.Name)
+			}
+
 			// dns
 			component.InternalDNS = c.GetUnitInternalDNS(component, domain)
 			lg.Debug2("internal dns", component.InternalDNS, stage.Name, component.Name)
@@ -251,14 +301,109 @@ func (c *MaestroConfig) SetMaestroComponentConfig() {
 				component.Volumes[j] = c.GetVolumePath(stage.Name, volume, volumesDir)
 				lg.Debug2("volume", component.Volumes[j], stage.Name, component.Name)
 			}
+		}
+	}
+	// dependencies, resolved once all unit names are known
+	for i, _ := range c.Stages {
+		stage := &c.Stages[i]
+		for k, _ := range stage.Components {
+			component := &stage.Components[k]
+			c.SetComponentDependencies(stage, component)
+			if len(component.AfterUnits) > 0 {
+				lg.Debug2("component will run after, "+strings.Join(component.AfterUnits, " "), stage.Name, component.Name)
+			}
+			if component.Affinity != "" {
+				component.AffinityUnit = c.GetAffinityUnit(stage, component)
+				lg.Debug2("component will run on the machine of "+component.AffinityUnit, stage.Name, component.Name)
+			}
+			component.Conflicts = c.GetConflicts(component)
+			if len(component.Conflicts) > 0 {
+				lg.Debug2("published ports conflict with", strings.Join(component.Conflicts, " "), stage.Name, component.Name)
+			}
+		}
+	}
+}
+
+// Changes the scale of a component, updating the names depending on it.
+func (c *MaestroConfig) SetComponentScale(component *MaestroComponent, scale int) {
+	component.Scale = scale
+	component.ContainerName = c.GetContainerName(component)
+	component.InternalDNS = c.GetUnitInternalDNS(component, domain)
+	component.Conflicts = c.GetConflicts(component)
+	// the instances depended on, or run next to, change with the scale
+	for i, _ := range c.Stages {
+		stage := &c.Stages[i]
+		if stage.Name != component.Stage {
+			continue
+		}
+		for k, _ := range stage.Components {
+			c.SetComponentDependencies(stage, &stage.Components[k])
+			if stage.Components[k].Affinity != "" {
+				stage.Components[k].AffinityUnit = c.GetAffinityUnit(stage, &stage.Components[k])
+			}
+		}
+	}
+}
+
+// Returns the globs of the units which can not run on the same machine of `component`,
+// because they publish the same host ports or they are in its anti_affinity. Instances of
+// a single component, or of a scaled component publishing host ports, conflict with each
+// other. Global units run on every machine and can not have conflicts.
+func (c *MaestroConfig) GetConflicts(component *MaestroComponent) (conflicts []string) {
+	if component.Global {
+		return
+	}
+	for _, stage := range c.Stages {
+		for _, other := range stage.Components {
+			self := other.UnitName == component.UnitName
+			if self && component.Single {
+				conflicts = append(conflicts, other.UnitName+"*")
+				continue
+			}
+			if self && component.Scale < 2 {
+				continue
+			}
+			if stage.Name == component.Stage && stringIn(other.Name, component.AntiAffinity) {
+				conflicts = append(conflicts, other.UnitName+"*")
+				continue
+			}
+			for _, port := range component.Ports {
+				conflict := false
+				for _, otherPort := range other.Ports {
+					conflict = conflict || port.Conflicts(otherPort)
+				}
+				if conflict {
+					conflicts = append(conflicts, other.UnitName+"*")
+					break
+				}
+			}
+		}
+	}
+	return
+}
 
-			// after info
-			if component.After != "" {
-				component.After = c.GetAfterUnit(component.After)
-				lg.Debug2("component will run after, "+component.After, stage.Name, component.Name)
+// Returns the unit `component` has to run next to, for its affinity. Instances of a scaled
+// component follow the same instance of a scaled affinity, unless the affinity has fewer
+// instances: they all follow its first instance then.
+func (c *MaestroConfig) GetAffinityUnit(stage *MaestroStage, component *MaestroComponent) (affinity string) {
+	for _, target := range stage.Components {
+		if target.Name == component.Affinity {
+			affinity = c.GetUnitName(&target, "1") + ".service"
+			if component.Scale > 1 && component.Scale <= target.Scale {
+				affinity = target.UnitName + "%i.service"
 			}
 		}
 	}
+	return
+}
+
+func stringIn(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
 }
 
 // Returns a name for a unit, starting from a `stage`, a `component` and a `suffix`.
@@ -280,6 +425,11 @@ func (c *MaestroConfig) GetUnitName(component *MaestroComponent, suffix string)
 	}
 }
 
+// Returns the prefix shared by all unit names of the app in a stage.
+func (c *MaestroConfig) GetAppPrefix(stage string) string {
+	return fmt.Sprintf("%s_%s_%s_", c.Username, stage, c.App)
+}
+
 // Returns an inernal DNS name for a unit (mainly for debugging purposes).
 func (c *MaestroConfig) GetUnitInternalDNS(component *MaestroComponent, domain string) string {
 	prefix := "1"
@@ -314,18 +464,63 @@ func (c *MaestroConfig) GetContainerName(component *MaestroComponent) string {
 	return fmt.Sprintf("%s", c.GetUnitName(component, ""))
 }
 
-// Return a path for a numbered unit, used to start scalable components.
-func (c *MaestroConfig) GetNumberedUnitPath(path, number string) string {
-	return strings.Replace(path, "@", fmt.Sprintf("@%s", number), 1)
+// Returns the etcd namespace of an app stage. Schema: /$domain/$username/$stage/$app
+func (c *MaestroConfig) GetEtcdNamespace(stage string) string {
+	return fmt.Sprintf("/%s/%s/%s/%s", domain, c.Username, stage, c.App)
+}
+
+// Returns the etcd directory storing the secrets of an app stage.
+func (c *MaestroConfig) GetSecretsKey(stage string) string {
+	return c.GetEtcdNamespace(stage) + "/secrets"
+}
+
+// Returns the etcd directory storing the deployment history of an app stage.
+func (c *MaestroConfig) GetHistoryKey(stage string) string {
+	return c.GetEtcdNamespace(stage) + "/history"
+}
+
+// Returns the etcd key of the deploy lock of an app stage.
+func (c *MaestroConfig) GetLockKey(stage string) string {
+	return c.GetEtcdNamespace(stage) + "/lock"
 }
 
-func (c *MaestroConfig) GetAfterUnit(name string) (after string) {
+// Returns the DNS name of the app in a stage, parent of the internal DNS names of its units.
+func (c *MaestroConfig) GetAppDNS(stage string) string {
+	return fmt.Sprintf("%s.%s.%s.%s", c.App, stage, c.Username, domain)
+}
+
+// Returns the etcd prefixes of the app keys in all stages and, with `skydns`, of its skydns
+// records.
+func (c *MaestroConfig) GetEtcdPrefixes(skydns bool) (prefixes []string) {
 	for _, stage := range c.Stages {
-		for _, component := range stage.Components {
-			if component.Name == name {
-				after = fmt.Sprintf("%s%%i.service", component.UnitName)
-			}
+		prefixes = append(prefixes, c.GetEtcdNamespace(stage.Name)+"/")
+		if skydns {
+			prefixes = append(prefixes, SkydnsPath(c.GetAppDNS(stage.Name))+"/")
 		}
 	}
 	return
 }
+
+// Finds the component and the instance number of a unit path or unit name.
+func (c *MaestroConfig) GetUnitComponent(unitPath string) (*MaestroComponent, string, error) {
+	unitName := strings.TrimSuffix(path.Base(unitPath), ".service")
+	split := strings.SplitN(unitName, "@", 2)
+	instance := "1"
+	if len(split) == 2 && split[1] != "" {
+		instance = split[1]
+	}
+	for i := range c.Stages {
+		for k := range c.Stages[i].Components {
+			component := &c.Stages[i].Components[k]
+			if strings.TrimSuffix(component.UnitName, "@") == split[0] {
+				return component, instance, nil
+			}
+		}
+	}
+	return nil, "", errors.New("unit " + unitName + " does not belong to the current app")
+}
+
+// Return a path for a numbered unit, used to start scalable components.
+func (c *MaestroConfig) GetNumberedUnitPath(path, number string) string {
+	return strings.Replace(path, "@", fmt.Sprintf("@%s", number), 1)
+}
@@ -0,0 +1,134 @@
+package maestro
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Merges the top level `components` block into every stage. Components are matched by
+// name: fields set in a stage override the defaults, `env` variables are merged by name
+// and components defined only in a stage are appended after the default ones.
+// It works on the JSON configuration, so that a field explicitly set to its zero value
+// (e.g. "frontend": false) still overrides the default.
+func MergeComponentDefaults(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var root map[string]interface{}
+	if err := decoder.Decode(&root); err != nil {
+		return nil, err
+	}
+	defaults, ok := root["components"].([]interface{})
+	if !ok {
+		return data, nil
+	}
+	delete(root, "components")
+	names := map[string]bool{}
+	for i, item := range defaults {
+		name := componentName(item)
+		if name == "" {
+			return nil, fmt.Errorf("components[%d]: component name is empty", i)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("components[%d]: duplicate component name %q", i, name)
+		}
+		names[name] = true
+	}
+	stages, _ := root["stages"].([]interface{})
+	for _, item := range stages {
+		stage, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		overrides, _ := stage["components"].([]interface{})
+		merged := []interface{}{}
+		used := map[int]bool{}
+		for _, base := range defaults {
+			component := copyObject(base.(map[string]interface{}))
+			for k, override := range overrides {
+				if componentName(override) == componentName(base) {
+					mergeComponent(component, override.(map[string]interface{}))
+					used[k] = true
+				}
+			}
+			merged = append(merged, component)
+		}
+		for k, override := range overrides {
+			if !used[k] {
+				merged = append(merged, override)
+			}
+		}
+		stage["components"] = merged
+	}
+	return json.Marshal(root)
+}
+
+// Returns the name of a component in a JSON configuration.
+func componentName(item interface{}) string {
+	if component, ok := item.(map[string]interface{}); ok {
+		name, _ := component["name"].(string)
+		return name
+	}
+	return ""
+}
+
+// Copies a JSON object, so that defaults are not shared between stages.
+func copyObject(object map[string]interface{}) map[string]interface{} {
+	copied := map[string]interface{}{}
+	for key, value := range object {
+		if items, ok := value.([]interface{}); ok {
+			value = append([]interface{}{}, items...)
+		}
+		copied[key] = value
+	}
+	return copied
+}
+
+// Applies the fields of a stage component over a default one.
+func mergeComponent(component, override map[string]interface{}) {
+	for key, value := range override {
+		base, isList := component[key].([]interface{})
+		values, isOverrideList := value.([]interface{})
+		if key == "env" && isList && isOverrideList {
+			component[key] = mergeEnv(base, values)
+			continue
+		}
+		component[key] = value
+	}
+}
+
+// Merges two lists of VAR=value environment variables, the latter taking precedence.
+func mergeEnv(base, override []interface{}) []interface{} {
+	merged := append([]interface{}{}, base...)
+	index := map[string]int{}
+	for i, item := range merged {
+		index[envName(item)] = i
+	}
+	for _, item := range override {
+		if i, ok := index[envName(item)]; ok {
+			merged[i] = item
+			continue
+		}
+		index[envName(item)] = len(merged)
+		merged = append(merged, item)
+	}
+	return merged
+}
+
+func envName(item interface{}) string {
+	env, _ := item.(string)
+	return strings.SplitN(env, "=", 2)[0]
+}
+
+// Returns a copy of the configuration restricted to a single stage.
+func (c *MaestroConfig) Stage(name string) (*MaestroConfig, error) {
+	for _, stage := range c.Stages {
+		if stage.Name == name {
+			restricted := *c
+			restricted.Stages = []MaestroStage{stage}
+			return &restricted, nil
+		}
+	}
+	return nil, fmt.Errorf("stage %q not found in %s", name, configFile)
+}
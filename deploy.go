@@ -0,0 +1,74 @@
+package maestro
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Rolling update of the current app. Instances of every component are replaced `batch`
+// at a time, waiting for every replaced instance to become active before moving to the
+// next batch. Instances which are running and unchanged are left alone. The deploy is
+// aborted as soon as an instance fails or does not become active within `timeout`.
+// It can be restricted to a single component, using `name` argument.
+func MaestroDeploy(name string, batch int, timeout time.Duration) (exitCode int) {
+	if batch < 1 {
+		lg.Error(errors.New("batch size must be at least 1"))
+		return 1
+	}
+	found := false
+	MaestroBuildLocalUnits()
+	defer DNSSync()
+	for _, stage := range config.Stages {
+		for _, component := range SortComponents(stage.Components) {
+			if name != "" && component.Name != name {
+				continue
+			}
+			found = true
+			lg.Out(lg.b("maestro ") + "deploying " + lg.y(stage.Name) + "/" + lg.b(component.Name) +
+				" (" + strconv.Itoa(component.Scale) + " instances, batch " + strconv.Itoa(batch) + ")")
+			for start := 1; start <= component.Scale; start += batch {
+				units := []string{}
+				for i := start; i < start+batch && i <= component.Scale; i++ {
+					unitPath := config.GetNumberedUnitPath(component.UnitPath, strconv.Itoa(i))
+					if !scheduler.Changed(unitPath) && scheduler.IsRunning(unitPath) {
+						continue
+					}
+					if code := SchedulerRunUnit("", unitPath); code != 0 {
+						lg.Error(errors.New("unable to replace " + unitPath + ", aborting deploy"))
+						return code
+					}
+					units = append(units, unitPath)
+				}
+				if len(units) == 0 {
+					continue
+				}
+				lg.Out(lg.b("maestro ") + "waiting for " + strconv.Itoa(len(units)) + " instances to become active")
+				if failed := SchedulerWaitActive(units, timeout); len(failed) > 0 {
+					DeployReport(failed)
+					return 1
+				}
+			}
+		}
+	}
+	if name != "" && !found {
+		lg.Error(errors.New("component " + name + " not found in current app"))
+		return 1
+	}
+	lg.Out(lg.b("maestro ") + "deploy " + lg.g("completed"))
+	if name == "" {
+		HistoryRecord("deploy")
+	}
+	return
+}
+
+// Prints the state of the instances which did not become active.
+func DeployReport(failed map[string]string) {
+	lg.Out(lg.b("maestro ") + "deploy " + lg.r("aborted"))
+	for unit, state := range failed {
+		if state == "" {
+			state = "unknown"
+		}
+		lg.Out("unit " + lg.b(unit) + " is " + lg.r(state))
+	}
+}
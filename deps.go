@@ -0,0 +1,192 @@
+package maestro
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaestroDeps structure. A list of components of the same stage, written in the
+// configuration either as a list or, for a single component, as a string.
+type MaestroDeps []string
+
+// Reads dependencies written either as a string or as a list of strings.
+func (d *MaestroDeps) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*d = nil
+		if name != "" {
+			*d = MaestroDeps{name}
+		}
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return fmt.Errorf("invalid dependencies %s, expected a component name or a list of names", data)
+	}
+	*d = names
+	return nil
+}
+
+// Dependencies are either a component name or a list of names.
+func (d MaestroDeps) JSONSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"oneOf": []interface{}{
+			map[string]interface{}{"type": "string"},
+			map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+		},
+	}
+}
+
+// Returns the names of all the components `component` depends on, which have to be
+// started before it.
+func (m *MaestroComponent) Dependencies() (names []string) {
+	seen := map[string]bool{}
+	for _, deps := range []MaestroDeps{m.After, m.Requires, m.Wants} {
+		for _, name := range deps {
+			if !seen[name] {
+				names = append(names, name)
+				seen[name] = true
+			}
+		}
+	}
+	return
+}
+
+// Sets the units `component` has to be ordered after, requires, is bound to and wants, once
+// all unit names in its stage are known. Components are still bound to their `after`
+// dependencies, as before `requires` and `wants` existed.
+func (c *MaestroConfig) SetComponentDependencies(stage *MaestroStage, component *MaestroComponent) {
+	component.AfterUnits, component.RequiresUnits, component.BindsToUnits, component.WantsUnits = nil, nil, nil, nil
+	for _, name := range component.Dependencies() {
+		component.AfterUnits = append(component.AfterUnits, c.GetDependencyUnits(stage, component, name)...)
+	}
+	required := []string{}
+	for _, name := range append(append([]string{}, component.After...), component.Requires...) {
+		if !stringIn(name, required) {
+			required = append(required, name)
+			component.RequiresUnits = append(component.RequiresUnits, c.GetDependencyUnits(stage, component, name)...)
+		}
+	}
+	for _, name := range component.After {
+		component.BindsToUnits = append(component.BindsToUnits, c.GetDependencyUnits(stage, component, name)...)
+	}
+	for _, name := range component.Wants {
+		component.WantsUnits = append(component.WantsUnits, c.GetDependencyUnits(stage, component, name)...)
+	}
+}
+
+// Returns the units of the component `name` which `component` depends on. Instances of a
+// scaled component depend on the same instance of a scaled dependency with at least as many
+// instances, otherwise on all of its instances.
+func (c *MaestroConfig) GetDependencyUnits(stage *MaestroStage, component *MaestroComponent, name string) (units []string) {
+	for _, dependency := range stage.Components {
+		if dependency.Name != name {
+			continue
+		}
+		if dependency.Scale > 1 && component.Scale > 1 && component.Scale <= dependency.Scale {
+			return []string{dependency.UnitName + "%i.service"}
+		}
+		for i := 1; i < dependency.Scale+1; i++ {
+			units = append(units, c.GetUnitName(&dependency, strconv.Itoa(i))+".service")
+		}
+	}
+	return
+}
+
+// Returns the first dependency cycle found between the components of a stage, as a list
+// of component names starting and ending with the same component.
+func DependencyCycle(components []MaestroComponent) []string {
+	deps := map[string][]string{}
+	for _, component := range components {
+		deps[component.Name] = component.Dependencies()
+	}
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+	path := []string{}
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		switch state[name] {
+		case visiting:
+			for i, previous := range path {
+				if previous == name {
+					return append(append([]string{}, path[i:]...), name)
+				}
+			}
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		path = append(path, name)
+		for _, dependency := range deps[name] {
+			if _, ok := deps[dependency]; !ok || dependency == name {
+				continue
+			}
+			if cycle := visit(dependency); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		return nil
+	}
+	for _, component := range components {
+		if cycle := visit(component.Name); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// Returns the components of a stage sorted so that every component comes after its
+// dependencies, keeping the configuration order otherwise. Components in a dependency
+// cycle, rejected by the validation, are left in configuration order.
+func SortComponents(components []MaestroComponent) []MaestroComponent {
+	sorted := []MaestroComponent{}
+	done := map[string]bool{}
+	for len(sorted) < len(components) {
+		progress := false
+		for _, component := range components {
+			if done[component.Name] {
+				continue
+			}
+			ready := true
+			for _, dependency := range component.Dependencies() {
+				ready = ready && (done[dependency] || dependency == component.Name || !hasComponent(components, dependency))
+			}
+			if ready {
+				sorted = append(sorted, component)
+				done[component.Name] = true
+				progress = true
+				break
+			}
+		}
+		if !progress {
+			for _, component := range components {
+				if !done[component.Name] {
+					sorted = append(sorted, component)
+					done[component.Name] = true
+				}
+			}
+		}
+	}
+	return sorted
+}
+
+func hasComponent(components []MaestroComponent, name string) bool {
+	for _, component := range components {
+		if component.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Formats a dependency cycle, e.g. "a -> b -> a".
+func formatCycle(cycle []string) string {
+	return strings.Join(cycle, " -> ")
+}
@@ -0,0 +1,226 @@
+package maestro
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Write the skydns records of the app instances after every command changing them.
+var dnsRecords = false
+
+// SkydnsRecord structure. Service record read by skydns from etcd.
+type SkydnsRecord struct {
+	Host string `json:"host"`
+}
+
+// DNSRecord structure. Skydns record of an app instance, with the unit running it.
+type DNSRecord struct {
+	Key  string
+	Name string
+	Host string
+	Unit string
+}
+
+// Setup the skydns records management, writing them after run, deploy, scale, rollback,
+// stop and nuke with `records`.
+func SetupDNS(records bool) {
+	if records {
+		lg.Fatal(dnsCheckAPI())
+	}
+	dnsRecords = records
+}
+
+// Skydns only reads the etcd v2 API, records written through v3 are never served.
+func dnsCheckAPI() error {
+	if etcdAPI != "v2" {
+		return errors.New("skydns only reads the etcd v2 api, dns records can not be managed with --etcdapi " + etcdAPI)
+	}
+	return nil
+}
+
+// Returns the skydns records of the running instances of a stage, sorted by key. Every
+// instance is published with its internal DNS name and, if the component has one, with its
+// public DNS name, pointing to the IP of the machine running it.
+func DNSRecords(stage string) ([]*DNSRecord, error) {
+	machines, err := fleetClient.Machines()
+	if err != nil {
+		return nil, err
+	}
+	ips := map[string]string{}
+	for _, machine := range machines {
+		ips[machine.ID] = machine.PrimaryIP
+	}
+	states, err := fleetClient.UnitStates("")
+	if err != nil {
+		return nil, err
+	}
+	records := []*DNSRecord{}
+	for _, state := range states {
+		if !strings.HasPrefix(state.Name, config.GetAppPrefix(stage)) || ips[state.MachineID] == "" ||
+			state.SystemdActiveState == "inactive" || state.SystemdActiveState == "failed" {
+			continue
+		}
+		component, instance, err := config.GetUnitComponent(state.Name)
+		if err != nil || component.Stage != stage {
+			continue
+		}
+		if component.Global {
+			// global units run on every machine, their instance is the machine
+			instance = state.MachineID
+		}
+		name := instance + component.InternalDNS[strings.Index(component.InternalDNS, "."):]
+		records = append(records, &DNSRecord{Key: SkydnsPath(name), Name: name, Host: ips[state.MachineID], Unit: state.Name})
+		if component.DNS != "" {
+			name = strings.TrimSuffix(strings.Replace(component.DNS, "%H", state.MachineID, 1), "."+domain) + "." + domain
+			label := strings.Replace(strings.TrimSuffix(state.Name, ".service"), "@", "-", 1)
+			records = append(records, &DNSRecord{Key: SkydnsPath(name) + "/" + label, Name: name, Host: ips[state.MachineID], Unit: state.Name})
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+	return records, nil
+}
+
+// Returns the skydns records of a stage stored in etcd: the records under the internal DNS
+// name of the app and the public records named after its units.
+func dnsStoredRecords(stage string) (map[string]string, error) {
+	kvs, err := etcdClient.List(SkydnsPath(domain) + "/")
+	if err != nil {
+		return nil, err
+	}
+	internal := SkydnsPath(config.GetAppDNS(stage)) + "/"
+	stored := map[string]string{}
+	for _, kv := range kvs {
+		if strings.HasPrefix(kv.Key, internal) || dnsIsStageLabel(kv.Key[strings.LastIndex(kv.Key, "/")+1:], stage) {
+			record := SkydnsRecord{}
+			json.Unmarshal([]byte(kv.Value), &record)
+			stored[kv.Key] = record.Host
+		}
+	}
+	return stored, nil
+}
+
+// Returns true if `label` names an instance of a component of the stage, as public records
+// do. Labels of other apps sharing the prefix of the stage do not match any component.
+func dnsIsStageLabel(label, stage string) bool {
+	i := strings.LastIndex(label, "-")
+	if i < 0 || !strings.HasPrefix(label, config.GetAppPrefix(stage)) {
+		return false
+	}
+	component, _, err := config.GetUnitComponent(label[:i] + "@" + label[i+1:] + ".service")
+	return err == nil && component.Stage == stage
+}
+
+// Writes the missing or outdated skydns records of a stage and removes the records of
+// instances which are not running anymore.
+func DNSSyncStage(stage string) error {
+	records, err := DNSRecords(stage)
+	if err != nil {
+		return err
+	}
+	stored, err := dnsStoredRecords(stage)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if host, ok := stored[record.Key]; !ok || host != record.Host {
+			data, _ := json.Marshal(&SkydnsRecord{Host: record.Host})
+			if err = etcdClient.Set(record.Key, string(data)); err != nil {
+				return err
+			}
+			lg.Debug("published "+record.Name+" to "+record.Host, "dns", stage)
+		}
+		delete(stored, record.Key)
+	}
+	for key := range stored {
+		if err = etcdClient.Delete(key); err != nil && err != ErrEtcdKeyNotFound {
+			return err
+		}
+		lg.Debug("removed "+key, "dns", stage)
+	}
+	return nil
+}
+
+// Updates the skydns records of every stage of the current app, if enabled. Failures are
+// only reported, as the command changing the instances already ran.
+func DNSSync() {
+	if _, ok := scheduler.(*FleetScheduler); !ok || !dnsRecords {
+		return
+	}
+	for _, stage := range config.Stages {
+		if err := DNSSyncStage(stage.Name); err != nil {
+			lg.Warn("unable to update the dns records of " + stage.Name + ": " + err.Error())
+		}
+	}
+}
+
+// Lists the skydns records of a stage, or of every stage if `stage` is empty, checking
+// them against the running instances. Missing, outdated and stale records are fixed with
+// `fix`.
+func MaestroDNS(stage string, fix bool) (exitCode int) {
+	if _, ok := scheduler.(*FleetScheduler); !ok {
+		lg.Error(errors.New("dns records are only managed with the fleet backend"))
+		return 1
+	}
+	if err := dnsCheckAPI(); err != nil {
+		lg.Error(err)
+		return 1
+	}
+	stages := []string{}
+	if stage != "" {
+		if _, err := config.Stage(stage); err != nil {
+			lg.Error(err)
+			return 1
+		}
+		stages = append(stages, stage)
+	}
+	for _, s := range config.Stages {
+		if stage == "" {
+			stages = append(stages, s.Name)
+		}
+	}
+	for _, stage := range stages {
+		records, err := DNSRecords(stage)
+		if err != nil {
+			lg.Error(err)
+			return 1
+		}
+		stored, err := dnsStoredRecords(stage)
+		if err != nil {
+			lg.Error(err)
+			return 1
+		}
+		lg.Out(lg.b("maestro ") + "dns records of " + lg.y(stage))
+		for _, record := range records {
+			status := lg.g("ok")
+			if host, ok := stored[record.Key]; !ok {
+				status = lg.r("missing")
+				exitCode = 1
+			} else if host != record.Host {
+				status = lg.r("pointing to " + host)
+				exitCode = 1
+			}
+			lg.Out(record.Name + "\t" + record.Host + "\t" + record.Unit + "\t" + status)
+			delete(stored, record.Key)
+		}
+		keys := []string{}
+		for key := range stored {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			lg.Out(key + "\t" + stored[key] + "\t" + lg.r("stale"))
+			exitCode = 1
+		}
+		if fix && exitCode != 0 {
+			if err := DNSSyncStage(stage); err != nil {
+				lg.Error(err)
+				return 1
+			}
+			lg.Out(lg.b("maestro ") + "dns records of " + lg.y(stage) + " " + lg.g("fixed"))
+			exitCode = 0
+		}
+	}
+	return
+}
@@ -1,79 +1,201 @@
 package maestro
 
 import (
+	"encoding/json"
 	"errors"
-	"os/exec"
-	"strconv"
+	"sort"
 	"strings"
 )
 
-const (
-	etcdctl       = "etcdctl"
-	etcdEndpoints = "172.17.8.103:2379,172.17.8.103:2379,172.17.8.103:2379"
-)
+// Returns the etcd prefixes listed by default: the maestro domain, the skydns records
+// with `skydns` or every key with `all`.
+func EtcdPrefixes(skydns, all bool) []string {
+	if all {
+		return []string{"/"}
+	}
+	prefixes := []string{"/" + domain + "/"}
+	if skydns {
+		prefixes = append(prefixes, "/skydns/")
+	}
+	return prefixes
+}
 
-// Checks if etcdctl is available on the system.
-func EtcdCheckExec() {
-	lg.Debug("checking if etcdctl is in your $PATH", etcdctl)
-	_, err := exec.LookPath(etcdctl)
-	if err != nil {
-		lg.Error(errors.New(err.Error() + ". this is not fatal, you can still use fleetctl via ssh"))
+// Returns the etcd path of the skydns records of a DNS name, e.g. /skydns/io/maestro/crisidev
+// for crisidev.maestro.io.
+func SkydnsPath(name string) string {
+	labels := strings.Split(strings.Trim(name, "."), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return "/skydns/" + strings.Join(labels, "/")
+}
+
+// Returns the etcdctl command printing the value of a key on cluster nodes, for the etcd
+// API in use.
+func EtcdctlGet(key string) string {
+	if etcdAPI == "v3" {
+		return "ETCDCTL_API=3 /usr/bin/etcdctl get --print-value-only " + key
 	}
+	return "/usr/bin/etcdctl get " + key
 }
 
-// Prepares etcdctl arguments with info based from command line
-func EtcdPrepareArgs(key string) (etcdArgs []string) {
-	if key == "" {
-		etcdArgs = []string{"ls", "--recursive", "--sort"}
-	} else {
-		etcdArgs = []string{"get", key}
-	}
-	etcdArgs = append([]string{"-C", etcdEndpoints}, etcdArgs...)
+// Returns the keys of `kvs` under one of `prefixes`.
+func EtcdFilterKeys(kvs []*EtcdKV, prefixes []string) (filtered []*EtcdKV) {
+	for _, kv := range kvs {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(kv.Key, prefix) {
+				filtered = append(filtered, kv)
+				break
+			}
+		}
+	}
 	return
 }
 
-// Wrapper around etcdctl, able to run every command. It uses two channels to communicate
-// output and return code of every command issued.
-func EtcdExec(args []string, output chan string, exit chan int, key string) {
-	var exitCode int
-	etcdArgs := EtcdPrepareArgs(key)
-	cmd := exec.Command(etcdctl, etcdArgs...)
-	lg.Debug("etcdctl args "+strings.Join(cmd.Args, " "), etcdctl)
-	exitCode = MaestroCommandExec(cmd, output)
-	lg.Debug("exit code: "+strconv.Itoa(exitCode), etcdctl)
-	exit <- exitCode
-	close(exit)
+// Returns the lines of the indented hierarchy of sorted `keys`, directories ending with a
+// slash.
+func EtcdTree(keys []string) (lines []string) {
+	previous := []string{}
+	for _, key := range keys {
+		parts := strings.Split(strings.Trim(key, "/"), "/")
+		common := 0
+		for common < len(parts)-1 && common < len(previous)-1 && parts[common] == previous[common] {
+			common++
+		}
+		for i := common; i < len(parts); i++ {
+			line := strings.Repeat("  ", i) + parts[i]
+			if i < len(parts)-1 {
+				line += "/"
+			}
+			lines = append(lines, line)
+		}
+		previous = parts
+	}
 	return
 }
 
-// Pulls maestro related keys
-func EtcdPullKeys(skydns, all bool, key string) (exitCode int) {
-	output := make(chan string)
-	exit := make(chan int)
-	args := EtcdPrepareArgs(key)
-	lg.Out(lg.b("maestro ") + "running fleetctl" + strings.Join(args, " "))
-	go EtcdExec(args, output, exit, key)
-	for line := range output {
-		line = string(line)
-		if key != "" {
-			lg.Out(strings.Trim(line, "\n"))
+// Returns an etcd event as a line of text, or of json with `asJSON`.
+func FormatEtcdEvent(event *EtcdEvent, asJSON bool) string {
+	if asJSON {
+		data, _ := json.Marshal(event)
+		return string(data)
+	}
+	return event.Type + " " + event.Key
+}
+
+// Pulls the keys under `prefixes`, or a single key if `key` is set, printing them as an
+// indented hierarchy with `tree` or as json, with values and TTLs, with `asJSON`.
+func EtcdPullKeys(prefixes []string, key string, tree, asJSON bool) (exitCode int) {
+	if tree && asJSON {
+		lg.Error(errors.New("--tree and --json can not be used together"))
+		return 1
+	}
+	if key != "" {
+		kv, err := etcdClient.Get(key)
+		if err != nil {
+			lg.Error(err)
+			return 1
+		}
+		if kv == nil {
+			lg.Error(errors.New("key " + key + " not found"))
+			return 1
+		}
+		if asJSON {
+			data, _ := json.MarshalIndent(kv, "", "    ")
+			lg.Out(string(data))
 		} else {
-			if !all {
-				if strings.HasPrefix(line, "/maestro.io") {
-					lg.Out(line)
-				}
-				if skydns {
-					if strings.HasPrefix(line, "/skydns") {
-						lg.Out(line)
-					}
-				}
-			} else {
-				if line != "" {
-					lg.Out(line)
-				}
-			}
+			lg.Out(kv.Value)
+		}
+		return
+	}
+	kvs, err := etcdListPrefixes(prefixes)
+	if err != nil {
+		lg.Error(err)
+		return 1
+	}
+	switch {
+	case asJSON:
+		data, _ := json.MarshalIndent(kvs, "", "    ")
+		lg.Out(string(data))
+	case tree:
+		keys := []string{}
+		for _, kv := range kvs {
+			keys = append(keys, kv.Key)
+		}
+		for _, line := range EtcdTree(keys) {
+			lg.Out(line)
+		}
+	default:
+		for _, kv := range kvs {
+			lg.Out(kv.Key)
 		}
 	}
-	exitCode = <-exit
 	return
 }
+
+// Returns the keys under `prefixes`, sorted by key.
+func etcdListPrefixes(prefixes []string) ([]*EtcdKV, error) {
+	kvs := []*EtcdKV{}
+	seen := map[string]bool{}
+	for _, prefix := range prefixes {
+		dir := prefix
+		if !strings.HasSuffix(dir, "/") {
+			dir = dir[:strings.LastIndex(dir, "/")+1]
+		}
+		listed, err := etcdClient.List(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range EtcdFilterKeys(listed, []string{prefix}) {
+			if !seen[kv.Key] {
+				kvs = append(kvs, kv)
+				seen[kv.Key] = true
+			}
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs, nil
+}
+
+// Streams the changes of the keys under `prefixes`, as text or as json lines with
+// `asJSON`, until an error occurs. Single keys and trees can not be watched.
+func EtcdWatchKeys(prefixes []string, key string, tree, asJSON bool) (exitCode int) {
+	if key != "" || tree {
+		lg.Error(errors.New("--watch can not be used with a key or --tree"))
+		return 1
+	}
+	events := make(chan *EtcdEvent)
+	errs := make(chan error)
+	for _, prefix := range prefixes {
+		go etcdWatch(prefix, events, errs)
+	}
+	for {
+		select {
+		case event := <-events:
+			lg.Out(FormatEtcdEvent(event, asJSON))
+		case err := <-errs:
+			lg.Error(err)
+			return 1
+		}
+	}
+}
+
+// Sends the changes of the keys under `prefix` to `events`, the error ending the watch
+// to `errs`.
+func etcdWatch(prefix string, events chan<- *EtcdEvent, errs chan<- error) {
+	dir := prefix[:strings.LastIndex(prefix, "/")+1]
+	revision := int64(0)
+	for {
+		batch, err := etcdClient.Watch(dir, revision)
+		if err != nil {
+			errs <- err
+			return
+		}
+		for _, event := range batch {
+			if strings.HasPrefix(event.Key, prefix) {
+				events <- event
+			}
+			revision = event.Revision
+		}
+	}
+}
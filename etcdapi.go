@@ -0,0 +1,692 @@
+package maestro
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	etcdDefaultPort = "2379"
+	etcdTimeout     = 30 * time.Second
+	etcdV2Prefix    = "/v2/keys"
+	etcdV3Prefix    = "/v3"
+)
+
+// Versions of the etcd API maestro can talk to.
+var EtcdAPIs = []string{"v2", "v3"}
+
+// Returned when a key to delete or refresh does not exist.
+var ErrEtcdKeyNotFound = errors.New("etcd: key not found")
+
+// Returned when a key to create already exists.
+var ErrEtcdKeyExists = errors.New("etcd: key already exists")
+
+// Returned when a key to delete or refresh has not the expected value.
+var ErrEtcdCompareFailed = errors.New("etcd: key value changed")
+
+// Etcd client used by all etcd operations.
+var etcdClient EtcdClient
+
+// Version of the etcd API used by the etcd client, and by etcdctl on cluster nodes.
+var etcdAPI = "v2"
+
+// Key stored in etcd, with the revision (v2 modified index) of its last change and the
+// seconds left before it expires, 0 if it never does.
+type EtcdKV struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Revision int64  `json:"revision"`
+	TTL      int64  `json:"ttl,omitempty"`
+}
+
+// Types of etcd events.
+const (
+	EtcdPut    = "put"
+	EtcdDelete = "delete"
+)
+
+// Change of a key, either a put or a delete. Deleted keys have no value.
+type EtcdEvent struct {
+	Type string `json:"type"`
+	EtcdKV
+}
+
+// Client for the etcd API. Keys are absolute paths, e.g. /maestro.io/crisidev.
+type EtcdClient interface {
+	// Returns a key or nil if it does not exist.
+	Get(key string) (*EtcdKV, error)
+	// Sets the value of a key.
+	Set(key, value string) error
+	// Deletes a key, returning ErrEtcdKeyNotFound if it does not exist.
+	Delete(key string) error
+	// Creates a key expiring after `ttl` seconds, returning ErrEtcdKeyExists if it exists.
+	Create(key, value string, ttl int64) error
+	// Sets again a key with `value`, expiring after `ttl` seconds, only if it still has
+	// that value. It returns ErrEtcdKeyNotFound or ErrEtcdCompareFailed otherwise.
+	Refresh(key, value string, ttl int64) error
+	// Deletes a key only if it has `value`, returning ErrEtcdKeyNotFound or
+	// ErrEtcdCompareFailed otherwise.
+	CompareAndDelete(key, value string) error
+	// Returns all keys under the `dir` directory, recursively, sorted by key.
+	List(dir string) ([]*EtcdKV, error)
+	// Waits for changes of the keys under the `dir` directory made after `revision`, or
+	// after the call if `revision` is 0, and returns them.
+	Watch(dir string, revision int64) ([]*EtcdEvent, error)
+}
+
+// Setup the global etcd client. `endpoints` is a comma separated list of etcd endpoints,
+// the etcd port of the tunnel address if empty. TLS is used when any of `certFile`,
+// `keyFile` and `caFile` is set.
+func SetupEtcdClient(endpoints, api, certFile, keyFile, caFile string) {
+	if endpoints == "" {
+		endpoints = fleetAddress + ":" + etcdDefaultPort
+	}
+	var tlsConfig *tls.Config
+	if certFile != "" || keyFile != "" || caFile != "" {
+		var err error
+		tlsConfig, err = EtcdTLSConfig(certFile, keyFile, caFile)
+		lg.Fatal(err)
+	}
+	client, err := NewEtcdClient(strings.Split(endpoints, ","), api, tlsConfig)
+	lg.Fatal(err)
+	lg.Debug("etcd "+api+" api endpoints "+endpoints, "etcd")
+	etcdClient = client
+	etcdAPI = api
+}
+
+// Returns a TLS configuration using an optional client certificate and CA.
+func EtcdTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("etcd: unable to load client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("etcd: unable to load ca: %s", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("etcd: no certificate found in %s", caFile)
+		}
+	}
+	return config, nil
+}
+
+// Returns a new client for the etcd `api` (v2 or v3) available at `endpoints`. Endpoints
+// without scheme use https if `tlsConfig` is set.
+func NewEtcdClient(endpoints []string, api string, tlsConfig *tls.Config) (EtcdClient, error) {
+	scheme := "http://"
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if tlsConfig != nil {
+		scheme = "https://"
+		transport.TLSClientConfig = tlsConfig
+	}
+	h := etcdHTTP{
+		HTTP:   &http.Client{Timeout: etcdTimeout, Transport: transport},
+		Stream: &http.Client{Transport: transport},
+	}
+	for _, endpoint := range endpoints {
+		endpoint = strings.TrimRight(strings.TrimSpace(endpoint), "/")
+		if endpoint == "" {
+			continue
+		}
+		if !strings.Contains(endpoint, "://") {
+			endpoint = scheme + endpoint
+		}
+		h.Endpoints = append(h.Endpoints, endpoint)
+	}
+	if len(h.Endpoints) == 0 {
+		return nil, errors.New("etcd: no endpoints")
+	}
+	switch api {
+	case "v2":
+		return &EtcdV2Client{h}, nil
+	case "v3":
+		return &EtcdV3Client{h}, nil
+	}
+	return nil, fmt.Errorf("etcd: unknown api %q, expected one of %s", api, strings.Join(EtcdAPIs, ", "))
+}
+
+// HTTP transport shared by the etcd clients. Requests are sent to the first endpoint
+// answering, in order. Watches use the Stream client, without timeout.
+type etcdHTTP struct {
+	Endpoints []string
+	HTTP      *http.Client
+	Stream    *http.Client
+}
+
+// Performs a request, returning the HTTP status code and the response body.
+func (e *etcdHTTP) do(method, path string, query url.Values, contentType string, body []byte) (code int, data []byte, err error) {
+	resp, err := e.send(e.HTTP, method, path, query, contentType, body)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	data, err = ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, data, err
+}
+
+// Sends a request with `client`, returning the response with its body still to be read.
+func (e *etcdHTTP) send(client *http.Client, method, path string, query url.Values, contentType string, body []byte) (resp *http.Response, err error) {
+	for _, endpoint := range e.Endpoints {
+		u := endpoint + path
+		if len(query) > 0 {
+			u += "?" + query.Encode()
+		}
+		var req *http.Request
+		if req, err = http.NewRequest(method, u, bytes.NewReader(body)); err != nil {
+			return
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		lg.Debug(method+" "+u, "etcd")
+		if resp, err = client.Do(req); err != nil {
+			lg.DebugError(err)
+			continue
+		}
+		return
+	}
+	return nil, fmt.Errorf("etcd: no endpoint available: %s", err)
+}
+
+// Client for the etcd v2 keys API.
+type EtcdV2Client struct {
+	etcdHTTP
+}
+
+// Node of the etcd v2 keys API.
+type etcdV2Node struct {
+	Key           string        `json:"key"`
+	Value         string        `json:"value,omitempty"`
+	Dir           bool          `json:"dir,omitempty"`
+	Nodes         []*etcdV2Node `json:"nodes,omitempty"`
+	ModifiedIndex int64         `json:"modifiedIndex,omitempty"`
+	CreatedIndex  int64         `json:"createdIndex,omitempty"`
+	TTL           int64         `json:"ttl,omitempty"`
+	Expiration    *time.Time    `json:"expiration,omitempty"`
+}
+
+// Returns the key value of a v2 node.
+func (n *etcdV2Node) kv() *EtcdKV {
+	return &EtcdKV{Key: n.Key, Value: n.Value, Revision: n.ModifiedIndex, TTL: n.TTL}
+}
+
+// Response of the etcd v2 keys API.
+type etcdV2Response struct {
+	Action   string      `json:"action"`
+	Node     *etcdV2Node `json:"node,omitempty"`
+	PrevNode *etcdV2Node `json:"prevNode,omitempty"`
+}
+
+// Error returned by the etcd v2 keys API.
+type etcdV2Error struct {
+	ErrorCode int    `json:"errorCode"`
+	Message   string `json:"message"`
+	Cause     string `json:"cause,omitempty"`
+	Index     int64  `json:"index"`
+}
+
+// Error codes of the etcd v2 keys API.
+const (
+	etcdV2KeyNotFound   = 100
+	etcdV2CompareFailed = 101
+	etcdV2KeyExists     = 105
+)
+
+func (e *EtcdV2Client) keys(method, key string, query url.Values, form url.Values) (*etcdV2Response, error) {
+	contentType, body := "", []byte(nil)
+	if form != nil {
+		contentType, body = "application/x-www-form-urlencoded", []byte(form.Encode())
+	}
+	client := e.HTTP
+	if query.Get("wait") == "true" {
+		client = e.Stream
+	}
+	r, err := e.send(client, method, etcdV2Prefix+key, query, contentType, body)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	code := r.StatusCode
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if code >= 400 {
+		var eErr etcdV2Error
+		if json.Unmarshal(data, &eErr) == nil && eErr.Message != "" {
+			switch eErr.ErrorCode {
+			case etcdV2KeyNotFound:
+				return nil, ErrEtcdKeyNotFound
+			case etcdV2CompareFailed:
+				return nil, ErrEtcdCompareFailed
+			case etcdV2KeyExists:
+				return nil, ErrEtcdKeyExists
+			}
+			return nil, fmt.Errorf("etcd: %s (%s)", eErr.Message, eErr.Cause)
+		}
+		return nil, fmt.Errorf("etcd: %s %s returned %d", method, key, code)
+	}
+	var resp etcdV2Response
+	err = json.Unmarshal(data, &resp)
+	return &resp, err
+}
+
+func (e *EtcdV2Client) Get(key string) (*EtcdKV, error) {
+	resp, err := e.keys("GET", key, nil, nil)
+	if err == ErrEtcdKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.Node.kv(), nil
+}
+
+func (e *EtcdV2Client) Set(key, value string) error {
+	_, err := e.keys("PUT", key, nil, url.Values{"value": {value}})
+	return err
+}
+
+func (e *EtcdV2Client) Delete(key string) error {
+	_, err := e.keys("DELETE", key, nil, nil)
+	return err
+}
+
+func (e *EtcdV2Client) Create(key, value string, ttl int64) error {
+	_, err := e.keys("PUT", key, nil, url.Values{"value": {value}, "ttl": {strconv.FormatInt(ttl, 10)}, "prevExist": {"false"}})
+	return err
+}
+
+func (e *EtcdV2Client) Refresh(key, value string, ttl int64) error {
+	_, err := e.keys("PUT", key, nil, url.Values{"value": {value}, "ttl": {strconv.FormatInt(ttl, 10)}, "prevValue": {value}})
+	return err
+}
+
+func (e *EtcdV2Client) CompareAndDelete(key, value string) error {
+	_, err := e.keys("DELETE", key, url.Values{"prevValue": {value}}, nil)
+	return err
+}
+
+func (e *EtcdV2Client) List(dir string) (kvs []*EtcdKV, err error) {
+	resp, err := e.keys("GET", strings.TrimRight(dir, "/")+"/", url.Values{"recursive": {"true"}, "sorted": {"true"}}, nil)
+	if err == ErrEtcdKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var walk func(node *etcdV2Node)
+	walk = func(node *etcdV2Node) {
+		if !node.Dir {
+			kvs = append(kvs, node.kv())
+		}
+		for _, child := range node.Nodes {
+			walk(child)
+		}
+	}
+	walk(resp.Node)
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return
+}
+
+func (e *EtcdV2Client) Watch(dir string, revision int64) ([]*EtcdEvent, error) {
+	query := url.Values{"wait": {"true"}, "recursive": {"true"}}
+	if revision > 0 {
+		query.Set("waitIndex", strconv.FormatInt(revision+1, 10))
+	}
+	resp, err := e.keys("GET", strings.TrimRight(dir, "/")+"/", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	event := &EtcdEvent{Type: EtcdPut, EtcdKV: *resp.Node.kv()}
+	switch resp.Action {
+	case "delete", "expire", "compareAndDelete":
+		event.Type, event.Value, event.TTL = EtcdDelete, "", 0
+	}
+	return []*EtcdEvent{event}, nil
+}
+
+// Client for the etcd v3 API, through its JSON gateway.
+type EtcdV3Client struct {
+	etcdHTTP
+}
+
+// Key value of the etcd v3 API, with base64 encoded key and value.
+type etcdV3KV struct {
+	Key         string `json:"key"`
+	Value       string `json:"value,omitempty"`
+	ModRevision string `json:"mod_revision,omitempty"`
+	Lease       string `json:"lease,omitempty"`
+}
+
+// Request of the etcd v3 kv API.
+type etcdV3Request struct {
+	Key      string `json:"key"`
+	RangeEnd string `json:"range_end,omitempty"`
+	Value    string `json:"value,omitempty"`
+	Lease    string `json:"lease,omitempty"`
+}
+
+// Transaction of the etcd v3 kv API, running the success operations if all comparisons
+// hold.
+type etcdV3Txn struct {
+	Compare []*etcdV3Compare `json:"compare"`
+	Success []*etcdV3Op      `json:"success"`
+}
+
+// Comparison of a key in a transaction, on either its creation revision or its value.
+type etcdV3Compare struct {
+	Key            string `json:"key"`
+	Result         string `json:"result"`
+	Target         string `json:"target"`
+	CreateRevision string `json:"create_revision,omitempty"`
+	Value          string `json:"value,omitempty"`
+}
+
+// Operation of a transaction.
+type etcdV3Op struct {
+	RequestPut         *etcdV3Request `json:"request_put,omitempty"`
+	RequestDeleteRange *etcdV3Request `json:"request_delete_range,omitempty"`
+}
+
+// Response of a transaction.
+type etcdV3TxnResponse struct {
+	Succeeded bool `json:"succeeded,omitempty"`
+}
+
+// Response of the etcd v3 kv API.
+type etcdV3Response struct {
+	KVs     []*etcdV3KV `json:"kvs,omitempty"`
+	Deleted string      `json:"deleted,omitempty"`
+}
+
+// Lease of the etcd v3 API. Numbers are strings in the JSON gateway.
+type etcdV3Lease struct {
+	ID  string `json:"ID,omitempty"`
+	TTL string `json:"TTL,omitempty"`
+}
+
+// Request of the etcd v3 watch API.
+type etcdV3WatchRequest struct {
+	CreateRequest *etcdV3WatchCreate `json:"create_request"`
+}
+
+// Watch creation of the etcd v3 watch API.
+type etcdV3WatchCreate struct {
+	Key           string `json:"key"`
+	RangeEnd      string `json:"range_end,omitempty"`
+	StartRevision string `json:"start_revision,omitempty"`
+}
+
+// Message streamed by the etcd v3 watch API.
+type etcdV3WatchResponse struct {
+	Result *struct {
+		Created  bool           `json:"created,omitempty"`
+		Canceled bool           `json:"canceled,omitempty"`
+		Events   []*etcdV3Event `json:"events,omitempty"`
+	} `json:"result,omitempty"`
+	Error *etcdV3Error `json:"error,omitempty"`
+}
+
+// Event of the etcd v3 watch API. The type is omitted for puts.
+type etcdV3Event struct {
+	Type string    `json:"type,omitempty"`
+	KV   *etcdV3KV `json:"kv"`
+}
+
+// Error returned by the etcd v3 JSON gateway.
+type etcdV3Error struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+func (e *EtcdV3Client) kv(method string, in *etcdV3Request) (*etcdV3Response, error) {
+	var resp etcdV3Response
+	err := e.post("/kv/"+method, in, &resp)
+	return &resp, err
+}
+
+// Posts `in` to a method of the JSON gateway, decoding the response in `out`.
+func (e *EtcdV3Client) post(method string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	code, data, err := e.do("POST", etcdV3Prefix+method, nil, "application/json", body)
+	if err != nil {
+		return err
+	}
+	if code >= 400 {
+		return etcdV3ResponseError(method, code, data)
+	}
+	return json.Unmarshal(data, out)
+}
+
+// Returns the error of a failed request to the JSON gateway.
+func etcdV3ResponseError(method string, code int, data []byte) error {
+	var eErr etcdV3Error
+	if json.Unmarshal(data, &eErr) == nil && (eErr.Message != "" || eErr.Error != "") {
+		return fmt.Errorf("etcd: %s%s", eErr.Message, eErr.Error)
+	}
+	return fmt.Errorf("etcd: %s returned %d", method, code)
+}
+
+// Decodes a v3 key value, looking up the time to live of its lease if any.
+func (e *EtcdV3Client) decode(item *etcdV3KV) (*EtcdKV, error) {
+	kv, err := item.decode()
+	if err != nil || item.Lease == "" || item.Lease == "0" {
+		return kv, err
+	}
+	var lease etcdV3Lease
+	if err = e.post("/lease/timetolive", &etcdV3Lease{ID: item.Lease}, &lease); err != nil {
+		return nil, err
+	}
+	kv.TTL, _ = strconv.ParseInt(lease.TTL, 10, 64)
+	if kv.TTL < 0 {
+		kv.TTL = 0
+	}
+	return kv, nil
+}
+
+// Decodes a v3 key value.
+func (kv *etcdV3KV) decode() (*EtcdKV, error) {
+	key, err := base64.StdEncoding.DecodeString(kv.Key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := base64.StdEncoding.DecodeString(kv.Value)
+	if err != nil {
+		return nil, err
+	}
+	revision, _ := strconv.ParseInt(kv.ModRevision, 10, 64)
+	return &EtcdKV{Key: string(key), Value: string(value), Revision: revision}, nil
+}
+
+// Returns the end of the range of keys starting with `prefix`.
+func etcdV3RangeEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	// every key
+	return "\x00"
+}
+
+func etcdV3Encode(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func (e *EtcdV3Client) Get(key string) (*EtcdKV, error) {
+	resp, err := e.kv("range", &etcdV3Request{Key: etcdV3Encode(key)})
+	if err != nil || len(resp.KVs) == 0 {
+		return nil, err
+	}
+	return e.decode(resp.KVs[0])
+}
+
+func (e *EtcdV3Client) Set(key, value string) error {
+	_, err := e.kv("put", &etcdV3Request{Key: etcdV3Encode(key), Value: etcdV3Encode(value)})
+	return err
+}
+
+func (e *EtcdV3Client) Delete(key string) error {
+	resp, err := e.kv("deleterange", &etcdV3Request{Key: etcdV3Encode(key)})
+	if err == nil && (resp.Deleted == "" || resp.Deleted == "0") {
+		return ErrEtcdKeyNotFound
+	}
+	return err
+}
+
+// Grants a lease of `ttl` seconds, returning its id.
+func (e *EtcdV3Client) grant(ttl int64) (string, error) {
+	var lease etcdV3Lease
+	if err := e.post("/lease/grant", &etcdV3Lease{TTL: strconv.FormatInt(ttl, 10)}, &lease); err != nil {
+		return "", err
+	}
+	return lease.ID, nil
+}
+
+// Runs a transaction, returning true if its comparisons held.
+func (e *EtcdV3Client) txn(compare *etcdV3Compare, success *etcdV3Op) (bool, error) {
+	var resp etcdV3TxnResponse
+	err := e.post("/kv/txn", &etcdV3Txn{Compare: []*etcdV3Compare{compare}, Success: []*etcdV3Op{success}}, &resp)
+	return resp.Succeeded, err
+}
+
+// Runs a transaction on a key having `value`, telling apart missing keys and keys with
+// another value when it fails.
+func (e *EtcdV3Client) txnValue(key, value string, success *etcdV3Op) error {
+	compare := &etcdV3Compare{Key: etcdV3Encode(key), Result: "EQUAL", Target: "VALUE", Value: etcdV3Encode(value)}
+	succeeded, err := e.txn(compare, success)
+	if err != nil || succeeded {
+		return err
+	}
+	kv, err := e.Get(key)
+	if err != nil {
+		return err
+	}
+	if kv == nil {
+		return ErrEtcdKeyNotFound
+	}
+	return ErrEtcdCompareFailed
+}
+
+func (e *EtcdV3Client) Create(key, value string, ttl int64) error {
+	lease, err := e.grant(ttl)
+	if err != nil {
+		return err
+	}
+	compare := &etcdV3Compare{Key: etcdV3Encode(key), Result: "EQUAL", Target: "CREATE", CreateRevision: "0"}
+	put := &etcdV3Op{RequestPut: &etcdV3Request{Key: etcdV3Encode(key), Value: etcdV3Encode(value), Lease: lease}}
+	succeeded, err := e.txn(compare, put)
+	if err == nil && !succeeded {
+		err = ErrEtcdKeyExists
+	}
+	return err
+}
+
+// The key is put again with a new lease, the previous one expires on its own.
+func (e *EtcdV3Client) Refresh(key, value string, ttl int64) error {
+	lease, err := e.grant(ttl)
+	if err != nil {
+		return err
+	}
+	return e.txnValue(key, value, &etcdV3Op{RequestPut: &etcdV3Request{Key: etcdV3Encode(key), Value: etcdV3Encode(value), Lease: lease}})
+}
+
+func (e *EtcdV3Client) CompareAndDelete(key, value string) error {
+	return e.txnValue(key, value, &etcdV3Op{RequestDeleteRange: &etcdV3Request{Key: etcdV3Encode(key)}})
+}
+
+func (e *EtcdV3Client) List(dir string) (kvs []*EtcdKV, err error) {
+	prefix := strings.TrimRight(dir, "/") + "/"
+	resp, err := e.kv("range", &etcdV3Request{Key: etcdV3Encode(prefix), RangeEnd: etcdV3Encode(etcdV3RangeEnd(prefix))})
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range resp.KVs {
+		kv, err := e.decode(item)
+		if err != nil {
+			return nil, err
+		}
+		kvs = append(kvs, kv)
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return
+}
+
+func (e *EtcdV3Client) Watch(dir string, revision int64) ([]*EtcdEvent, error) {
+	prefix := strings.TrimRight(dir, "/") + "/"
+	create := &etcdV3WatchCreate{Key: etcdV3Encode(prefix), RangeEnd: etcdV3Encode(etcdV3RangeEnd(prefix))}
+	if revision > 0 {
+		create.StartRevision = strconv.FormatInt(revision+1, 10)
+	}
+	body, err := json.Marshal(&etcdV3WatchRequest{CreateRequest: create})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := e.send(e.Stream, "POST", etcdV3Prefix+"/watch", nil, "application/json", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return nil, etcdV3ResponseError("/watch", resp.StatusCode, data)
+	}
+	// the gateway streams a message when the watch is created, then one for every batch of events
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg etcdV3WatchResponse
+		if err := decoder.Decode(&msg); err != nil {
+			return nil, err
+		}
+		if msg.Error != nil {
+			return nil, fmt.Errorf("etcd: %s%s", msg.Error.Message, msg.Error.Error)
+		}
+		if msg.Result == nil {
+			continue
+		}
+		if msg.Result.Canceled {
+			return nil, errors.New("etcd: watch canceled")
+		}
+		events := []*EtcdEvent{}
+		for _, item := range msg.Result.Events {
+			kv, err := item.KV.decode()
+			if err != nil {
+				return nil, err
+			}
+			event := &EtcdEvent{Type: EtcdPut, EtcdKV: *kv}
+			if item.Type == "DELETE" {
+				event.Type = EtcdDelete
+			}
+			events = append(events, event)
+		}
+		if len(events) > 0 {
+			return events, nil
+		}
+	}
+}
@@ -0,0 +1,521 @@
+package maestro
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In-process fake of the etcd v2 keys API and of the v3 JSON gateway, sharing the same
+// keys, used to exercise maestro without a cluster.
+type EtcdFakeServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	keys     map[string]*EtcdKV
+	expires  map[string]time.Time
+	leases   map[string]int64
+	grants   map[int64]int64
+	leaseID  int64
+	revision int64
+	events   []*etcdFakeEvent
+	changed  chan struct{}
+	done     chan struct{}
+}
+
+// Change recorded by the fake server, with the v2 action which made it.
+type etcdFakeEvent struct {
+	Action string
+	KV     EtcdKV
+}
+
+// Starts a new fake etcd server.
+func NewEtcdFakeServer() *EtcdFakeServer {
+	e := newEtcdFakeServer()
+	e.Server = httptest.NewServer(http.HandlerFunc(e.handle))
+	return e
+}
+
+// Starts a new fake etcd server using TLS, with the self signed certificate of httptest.
+func NewEtcdFakeTLSServer() *EtcdFakeServer {
+	e := newEtcdFakeServer()
+	e.Server = httptest.NewTLSServer(http.HandlerFunc(e.handle))
+	return e
+}
+
+func newEtcdFakeServer() *EtcdFakeServer {
+	return &EtcdFakeServer{
+		keys:    map[string]*EtcdKV{},
+		expires: map[string]time.Time{},
+		leases:  map[string]int64{},
+		grants:  map[int64]int64{},
+		changed: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Stops the server, ending pending watches.
+func (e *EtcdFakeServer) Close() {
+	e.mu.Lock()
+	select {
+	case <-e.done:
+	default:
+		close(e.done)
+	}
+	e.mu.Unlock()
+	e.Server.Close()
+}
+
+// Sets a key expiring after `ttl` seconds, as if it was set by another etcd client.
+func (e *EtcdFakeServer) SetTTL(key, value string, ttl int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.set(key, value, ttl)
+}
+
+// Expires a key now, as if its time to live was over.
+func (e *EtcdFakeServer) Expire(key string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.keys[key]; ok {
+		e.expires[key] = time.Now()
+		e.expire()
+	}
+}
+
+// Returns the value of a key known to the fake server.
+func (e *EtcdFakeServer) Value(key string) (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if kv, ok := e.keys[key]; ok {
+		return kv.Value, true
+	}
+	return "", false
+}
+
+// Returns the sorted keys known to the fake server.
+func (e *EtcdFakeServer) Keys() (keys []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for key := range e.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+func (e *EtcdFakeServer) handle(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.expire()
+	switch {
+	case strings.HasPrefix(r.URL.Path, etcdV2Prefix) && r.URL.Query().Get("wait") == "true":
+		e.watchV2(w, r, strings.TrimPrefix(r.URL.Path, etcdV2Prefix))
+	case strings.HasPrefix(r.URL.Path, etcdV2Prefix):
+		e.handleV2(w, r, strings.TrimPrefix(r.URL.Path, etcdV2Prefix))
+	case r.URL.Path == etcdV3Prefix+"/watch" && r.Method == "POST":
+		e.watchV3(w, r)
+	case r.URL.Path == etcdV3Prefix+"/lease/timetolive" && r.Method == "POST":
+		e.timeToLiveV3(w, r)
+	case r.URL.Path == etcdV3Prefix+"/lease/grant" && r.Method == "POST":
+		e.grantV3(w, r)
+	case r.URL.Path == etcdV3Prefix+"/kv/txn" && r.Method == "POST":
+		e.txnV3(w, r)
+	case strings.HasPrefix(r.URL.Path, etcdV3Prefix+"/kv/") && r.Method == "POST":
+		e.handleV3(w, r, strings.TrimPrefix(r.URL.Path, etcdV3Prefix+"/kv/"))
+	default:
+		e.reply(w, http.StatusNotFound, &etcdV3Error{Error: "not found", Message: "not found", Code: 5})
+	}
+}
+
+// Sets a key, expiring after `ttl` seconds if not 0.
+func (e *EtcdFakeServer) set(key, value string, ttl int64) *EtcdKV {
+	lease := int64(0)
+	if ttl > 0 {
+		lease = e.grant(ttl)
+	}
+	return e.setLease(key, value, lease)
+}
+
+// Grants a lease of `ttl` seconds, returning its id.
+func (e *EtcdFakeServer) grant(ttl int64) int64 {
+	e.leaseID++
+	e.grants[e.leaseID] = ttl
+	return e.leaseID
+}
+
+// Sets a key attached to a lease, expiring with it, if not 0.
+func (e *EtcdFakeServer) setLease(key, value string, lease int64) *EtcdKV {
+	e.revision++
+	kv := &EtcdKV{Key: key, Value: value, Revision: e.revision}
+	e.keys[key] = kv
+	delete(e.expires, key)
+	delete(e.leases, key)
+	if ttl, ok := e.grants[lease]; ok {
+		e.expires[key] = time.Now().Add(time.Duration(ttl) * time.Second)
+		e.leases[key] = lease
+	}
+	e.record("set", *kv)
+	return kv
+}
+
+// Deletes a key with the v2 `action` (delete or expire).
+func (e *EtcdFakeServer) remove(key, action string) {
+	delete(e.keys, key)
+	delete(e.expires, key)
+	delete(e.leases, key)
+	e.revision++
+	e.record(action, EtcdKV{Key: key, Revision: e.revision})
+}
+
+// Deletes the expired keys.
+func (e *EtcdFakeServer) expire() {
+	now := time.Now()
+	keys := []string{}
+	for key, expires := range e.expires {
+		if !expires.After(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		e.remove(key, "expire")
+	}
+}
+
+// Returns a copy of a key with the seconds left before it expires.
+func (e *EtcdFakeServer) kv(key string) *EtcdKV {
+	kv := *e.keys[key]
+	if expires, ok := e.expires[key]; ok {
+		kv.TTL = int64(time.Until(expires).Seconds() + 0.999)
+	}
+	return &kv
+}
+
+// Records an event and wakes up the pending watches.
+func (e *EtcdFakeServer) record(action string, kv EtcdKV) {
+	e.events = append(e.events, &etcdFakeEvent{Action: action, KV: kv})
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+// Returns the events under the `prefix` (or of the `prefix` key itself) from `revision`
+// on, waiting for one if there is none yet. It returns nil when the request is over.
+// Has to be called with the lock held, which is released while waiting.
+func (e *EtcdFakeServer) wait(r *http.Request, prefix string, revision int64) []*etcdFakeEvent {
+	for {
+		events := []*etcdFakeEvent{}
+		for _, event := range e.events {
+			if event.KV.Revision >= revision && (event.KV.Key == prefix || strings.HasPrefix(event.KV.Key, strings.TrimRight(prefix, "/")+"/")) {
+				events = append(events, event)
+			}
+		}
+		if len(events) > 0 {
+			return events
+		}
+		changed := e.changed
+		e.mu.Unlock()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+		case <-e.done:
+		}
+		e.mu.Lock()
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-e.done:
+			return nil
+		default:
+		}
+	}
+}
+
+// Returns the revision watches without start revision begin from.
+func (e *EtcdFakeServer) next(param string) int64 {
+	if revision, err := strconv.ParseInt(param, 10, 64); err == nil && revision > 0 {
+		return revision
+	}
+	return e.revision + 1
+}
+
+// Returns the v2 node of a key.
+func (e *EtcdFakeServer) nodeV2(key string) *etcdV2Node {
+	kv := e.kv(key)
+	return &etcdV2Node{Key: key, Value: kv.Value, ModifiedIndex: kv.Revision, TTL: kv.TTL}
+}
+
+func (e *EtcdFakeServer) handleV2(w http.ResponseWriter, r *http.Request, key string) {
+	if key == "" {
+		key = "/"
+	}
+	notFound := func() {
+		e.reply(w, http.StatusNotFound, &etcdV2Error{ErrorCode: etcdV2KeyNotFound, Message: "Key not found", Cause: key, Index: e.revision})
+	}
+	switch r.Method {
+	case "GET":
+		if _, ok := e.keys[key]; ok {
+			e.reply(w, http.StatusOK, &etcdV2Response{Action: "get", Node: e.nodeV2(key)})
+			return
+		}
+		node := e.dirV2(key, r.URL.Query().Get("recursive") == "true")
+		if node == nil {
+			notFound()
+			return
+		}
+		e.reply(w, http.StatusOK, &etcdV2Response{Action: "get", Node: node})
+	case "PUT":
+		if err := r.ParseForm(); err != nil {
+			e.reply(w, http.StatusBadRequest, &etcdV2Error{ErrorCode: 209, Message: err.Error()})
+			return
+		}
+		kv, exists := e.keys[key]
+		if r.Form.Get("prevExist") == "false" && exists {
+			e.reply(w, http.StatusPreconditionFailed, &etcdV2Error{ErrorCode: etcdV2KeyExists, Message: "Key already exists", Cause: key, Index: e.revision})
+			return
+		}
+		if prev, ok := r.Form["prevValue"]; ok {
+			if !exists {
+				notFound()
+				return
+			}
+			if kv.Value != prev[0] {
+				e.reply(w, http.StatusPreconditionFailed, &etcdV2Error{ErrorCode: etcdV2CompareFailed, Message: "Compare failed", Cause: "[" + prev[0] + " != " + kv.Value + "]", Index: e.revision})
+				return
+			}
+		}
+		ttl, _ := strconv.ParseInt(r.Form.Get("ttl"), 10, 64)
+		e.set(key, r.Form.Get("value"), ttl)
+		e.reply(w, http.StatusOK, &etcdV2Response{Action: "set", Node: e.nodeV2(key)})
+	case "DELETE":
+		kv, ok := e.keys[key]
+		if !ok {
+			notFound()
+			return
+		}
+		if prev, ok := r.URL.Query()["prevValue"]; ok && kv.Value != prev[0] {
+			e.reply(w, http.StatusPreconditionFailed, &etcdV2Error{ErrorCode: etcdV2CompareFailed, Message: "Compare failed", Cause: "[" + prev[0] + " != " + kv.Value + "]", Index: e.revision})
+			return
+		}
+		e.remove(key, "delete")
+		e.reply(w, http.StatusOK, &etcdV2Response{Action: "delete", Node: &etcdV2Node{Key: key, ModifiedIndex: e.revision}})
+	default:
+		e.reply(w, http.StatusMethodNotAllowed, &etcdV2Error{ErrorCode: 405, Message: "method not allowed"})
+	}
+}
+
+// Builds the directory node of `dir` from the keys below it, nil if there is none.
+func (e *EtcdFakeServer) dirV2(dir string, recursive bool) *etcdV2Node {
+	prefix := strings.TrimRight(dir, "/") + "/"
+	root := &etcdV2Node{Key: strings.TrimRight(dir, "/"), Dir: true}
+	dirs := map[string]*etcdV2Node{prefix: root}
+	keys := []string{}
+	for key := range e.keys {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		parent := root
+		rest := strings.Split(strings.TrimPrefix(key, prefix), "/")
+		for i := range rest[:len(rest)-1] {
+			path := prefix + strings.Join(rest[:i+1], "/") + "/"
+			child, ok := dirs[path]
+			if !ok {
+				child = &etcdV2Node{Key: strings.TrimRight(path, "/"), Dir: true}
+				dirs[path] = child
+				parent.Nodes = append(parent.Nodes, child)
+			}
+			parent = child
+		}
+		parent.Nodes = append(parent.Nodes, e.nodeV2(key))
+	}
+	if !recursive {
+		for _, child := range root.Nodes {
+			child.Nodes = nil
+		}
+	}
+	return root
+}
+
+// Answers a v2 wait with the first change from waitIndex on.
+func (e *EtcdFakeServer) watchV2(w http.ResponseWriter, r *http.Request, key string) {
+	events := e.wait(r, key, e.next(r.URL.Query().Get("waitIndex")))
+	if events == nil {
+		return
+	}
+	event := events[0]
+	node := &etcdV2Node{Key: event.KV.Key, Value: event.KV.Value, ModifiedIndex: event.KV.Revision}
+	e.reply(w, http.StatusOK, &etcdV2Response{Action: event.Action, Node: node})
+}
+
+// Streams the v3 watch creation and the first batch of changes, ending when the request
+// is over.
+func (e *EtcdFakeServer) watchV3(w http.ResponseWriter, r *http.Request) {
+	var req etcdV3WatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.CreateRequest == nil {
+		e.reply(w, http.StatusBadRequest, &etcdV3Error{Error: "invalid watch request", Message: "invalid watch request", Code: 3})
+		return
+	}
+	key, _ := base64.StdEncoding.DecodeString(req.CreateRequest.Key)
+	revision := e.next(req.CreateRequest.StartRevision)
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.Encode(map[string]interface{}{"result": map[string]interface{}{"created": true}})
+	w.(http.Flusher).Flush()
+	events := e.wait(r, string(key), revision)
+	if events == nil {
+		return
+	}
+	out := []*etcdV3Event{}
+	for _, event := range events {
+		kv := &etcdV3KV{Key: etcdV3Encode(event.KV.Key), ModRevision: strconv.FormatInt(event.KV.Revision, 10)}
+		item := &etcdV3Event{KV: kv}
+		if event.Action == "set" {
+			kv.Value = etcdV3Encode(event.KV.Value)
+		} else {
+			item.Type = "DELETE"
+		}
+		out = append(out, item)
+	}
+	encoder.Encode(map[string]interface{}{"result": map[string]interface{}{"events": out}})
+	w.(http.Flusher).Flush()
+}
+
+// Answers the time to live of a v3 lease.
+func (e *EtcdFakeServer) timeToLiveV3(w http.ResponseWriter, r *http.Request) {
+	var req etcdV3Lease
+	json.NewDecoder(r.Body).Decode(&req)
+	for key, lease := range e.leases {
+		if strconv.FormatInt(lease, 10) == req.ID {
+			e.reply(w, http.StatusOK, &etcdV3Lease{ID: req.ID, TTL: strconv.FormatInt(e.kv(key).TTL, 10)})
+			return
+		}
+	}
+	e.reply(w, http.StatusOK, &etcdV3Lease{ID: req.ID, TTL: "-1"})
+}
+
+// Grants a v3 lease.
+func (e *EtcdFakeServer) grantV3(w http.ResponseWriter, r *http.Request) {
+	var req etcdV3Lease
+	json.NewDecoder(r.Body).Decode(&req)
+	ttl, err := strconv.ParseInt(req.TTL, 10, 64)
+	if err != nil || ttl < 1 {
+		e.reply(w, http.StatusBadRequest, &etcdV3Error{Error: "invalid ttl", Message: "invalid ttl", Code: 3})
+		return
+	}
+	e.reply(w, http.StatusOK, &etcdV3Lease{ID: strconv.FormatInt(e.grant(ttl), 10), TTL: req.TTL})
+}
+
+// Runs a v3 transaction, supporting comparisons of creation revisions and values, puts and
+// deletes.
+func (e *EtcdFakeServer) txnV3(w http.ResponseWriter, r *http.Request) {
+	var req etcdV3Txn
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		e.reply(w, http.StatusBadRequest, &etcdV3Error{Error: err.Error(), Message: err.Error(), Code: 3})
+		return
+	}
+	succeeded := true
+	for _, compare := range req.Compare {
+		key, _ := base64.StdEncoding.DecodeString(compare.Key)
+		kv, exists := e.keys[string(key)]
+		switch compare.Target {
+		case "CREATE":
+			succeeded = succeeded && compare.CreateRevision == "0" && !exists
+		case "VALUE":
+			value, _ := base64.StdEncoding.DecodeString(compare.Value)
+			succeeded = succeeded && exists && kv.Value == string(value)
+		default:
+			succeeded = false
+		}
+	}
+	if succeeded {
+		for _, op := range req.Success {
+			switch {
+			case op.RequestPut != nil:
+				key, _ := base64.StdEncoding.DecodeString(op.RequestPut.Key)
+				value, _ := base64.StdEncoding.DecodeString(op.RequestPut.Value)
+				lease, _ := strconv.ParseInt(op.RequestPut.Lease, 10, 64)
+				e.setLease(string(key), string(value), lease)
+			case op.RequestDeleteRange != nil:
+				key, _ := base64.StdEncoding.DecodeString(op.RequestDeleteRange.Key)
+				if _, ok := e.keys[string(key)]; ok {
+					e.remove(string(key), "delete")
+				}
+			}
+		}
+	}
+	e.reply(w, http.StatusOK, &etcdV3TxnResponse{Succeeded: succeeded})
+}
+
+func (e *EtcdFakeServer) handleV3(w http.ResponseWriter, r *http.Request, method string) {
+	var req etcdV3Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		e.reply(w, http.StatusBadRequest, &etcdV3Error{Error: err.Error(), Message: err.Error(), Code: 3})
+		return
+	}
+	key, _ := base64.StdEncoding.DecodeString(req.Key)
+	rangeEnd, _ := base64.StdEncoding.DecodeString(req.RangeEnd)
+	value, _ := base64.StdEncoding.DecodeString(req.Value)
+	matches := func(k string) bool {
+		if len(rangeEnd) == 0 {
+			return k == string(key)
+		}
+		return k >= string(key) && (string(rangeEnd) == "\x00" || k < string(rangeEnd))
+	}
+	switch method {
+	case "range":
+		resp := &etcdV3Response{}
+		keys := []string{}
+		for k := range e.keys {
+			if matches(k) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			kv := e.keys[k]
+			item := &etcdV3KV{Key: etcdV3Encode(kv.Key), Value: etcdV3Encode(kv.Value), ModRevision: strconv.FormatInt(kv.Revision, 10)}
+			if lease, ok := e.leases[k]; ok {
+				item.Lease = strconv.FormatInt(lease, 10)
+			}
+			resp.KVs = append(resp.KVs, item)
+		}
+		e.reply(w, http.StatusOK, resp)
+	case "put":
+		lease, _ := strconv.ParseInt(req.Lease, 10, 64)
+		e.setLease(string(key), string(value), lease)
+		e.reply(w, http.StatusOK, &etcdV3Response{})
+	case "deleterange":
+		keys := []string{}
+		for k := range e.keys {
+			if matches(k) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			e.remove(k, "delete")
+		}
+		deleted := len(keys)
+		e.reply(w, http.StatusOK, &etcdV3Response{Deleted: strconv.Itoa(deleted)})
+	default:
+		e.reply(w, http.StatusNotFound, &etcdV3Error{Error: "not found", Message: "not found", Code: 5})
+	}
+}
+
+func (e *EtcdFakeServer) reply(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
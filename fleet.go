@@ -1,20 +1,33 @@
 package maestro
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 )
 
 const fleetctl = "fleetctl"
 
-// Checks if fleetctl is available on the system.
+// Fleet target states, as used by the fleet API.
+const (
+	fleetStateInactive = "inactive"
+	fleetStateLoaded   = "loaded"
+	fleetStateLaunched = "launched"
+)
+
+// Checks if fleetctl is available on the system. It is only needed for journals and `maestro exec`.
 func FleetCheckExec() {
 	lg.Debug("checking if fleetctl is in your $PATH", fleetctl)
 	_, err := exec.LookPath(fleetctl)
-	lg.Fatal(err)
+	if err != nil {
+		lg.Debug(err.Error()+". this is not fatal, only journal and exec need fleetctl", fleetctl)
+	}
 }
 
 // Prepares fleetctl arguments with info based from command line
@@ -55,58 +68,193 @@ func FleetProcessOutput(output chan string, exit chan int) (exitCode int) {
 	return
 }
 
+// Returns the fleet state of a unit, or nil if the unit has not been started anywhere.
+func FleetGetUnitState(unitName string) (*FleetUnitState, error) {
+	states, err := fleetClient.UnitStates(unitName)
+	if err != nil {
+		return nil, err
+	}
+	for _, state := range states {
+		if state.Name == unitName {
+			return state, nil
+		}
+	}
+	return nil, nil
+}
+
 // Utility function to check if a unit is already running on the cluster.
 func FleetIsUnitRunning(unitPath string) (ret bool) {
-	ret = false
-	output := make(chan string)
-	exit := make(chan int)
-	go FleetExec([]string{"status", unitPath}, output, exit)
-	_ = <-output
-	exitCode := <-exit
-	if exitCode == 0 {
+	unitName := path.Base(unitPath)
+	state, err := FleetGetUnitState(unitName)
+	if err != nil {
+		lg.DebugError(err)
+		return
+	}
+	if state == nil {
+		return
+	}
+	switch state.SystemdActiveState {
+	case "active":
 		lg.Out("unit " + lg.b(unitPath) + " already running")
 		ret = true
-	} else if exitCode == 3 {
+	case "activating":
 		lg.Out("unit " + lg.b(unitPath) + " already starting")
 		ret = true
 	}
 	return
 }
 
+// Returns the local template path of a numbered unit path.
+func FleetTemplatePath(unitPath string) string {
+	if strings.Contains(unitPath, "@") {
+		split := strings.Split(unitPath, "@")
+		unitPath = fmt.Sprintf("%s@.service", split[0])
+	}
+	return unitPath
+}
+
 // Checks if a unit path is valid, either build unit and run unit.
 func FleetCheckPath(unitPath string) {
 	if strings.Contains(unitPath, "/") {
-		if strings.Contains(unitPath, "@") {
-			split := strings.Split(unitPath, "@")
-			unitPath = fmt.Sprintf("%s@.service", split[0])
-		}
+		unitPath = FleetTemplatePath(unitPath)
 		if _, err := os.Stat(unitPath); err != nil {
-			lg.Debug2("invalid unit or maybe you forgot to run ", "maestro build", fleetctl)
+			lg.Debug2("invalid unit or maybe you forgot to run ", "maestro build", "fleet")
 			lg.Fatal(err)
 		}
-		lg.Debug("unit "+unitPath+" is valid", fleetctl)
+		lg.Debug("unit "+unitPath+" is valid", "fleet")
 	}
 }
 
-// Function able to run a command on a unit path. Output is processed and printed
-// and fleetctl exit code is returned.
-func FleetExecCommand(cmd, unitPath string) (exitCode int) {
-	var args []string
+// Reads a local unit file and converts it into fleet unit options.
+func FleetLoadUnitOptions(unitPath string) ([]*FleetUnitOption, error) {
+	if !strings.Contains(unitPath, "/") {
+		return nil, errors.New("unit " + unitPath + " is not a local unit path, unable to submit it")
+	}
+	data, err := ioutil.ReadFile(FleetTemplatePath(unitPath))
+	if err != nil {
+		return nil, err
+	}
+	return ParseUnitFile(string(data)), nil
+}
+
+// Submits a local unit to fleet with the given desired state. If the unit is already
+// known to fleet, only its desired state is changed.
+func FleetSubmitUnit(unitPath, desiredState string) error {
+	unitName := path.Base(unitPath)
+	unit, err := fleetClient.Unit(unitName)
+	if err != nil {
+		return err
+	}
+	if unit != nil {
+		if desiredState == fleetStateInactive {
+			return nil
+		}
+		return fleetClient.SetUnitTargetState(unitName, desiredState)
+	}
+	options, err := FleetLoadUnitOptions(unitPath)
+	if err != nil {
+		return err
+	}
+	return fleetClient.CreateUnit(&FleetUnit{Name: unitName, Options: options, DesiredState: desiredState})
+}
+
+// Prints the status of a unit as reported by fleet. It returns 0 if the unit is active,
+// 3 if it is inactive or starting and 1 if it failed or it is unknown.
+func FleetPrintStatus(unitName string) (exitCode int) {
+	unit, err := fleetClient.Unit(unitName)
+	if err != nil {
+		lg.Error(err)
+		return 1
+	}
+	if unit == nil {
+		lg.Out("unit " + lg.b(unitName) + " not found")
+		return 1
+	}
+	state, err := FleetGetUnitState(unitName)
+	if err != nil {
+		lg.Error(err)
+		return 1
+	}
+	lg.Out(lg.b("fleet ") + "desired: " + unit.DesiredState + " current: " + unit.CurrentState)
+	if state == nil {
+		lg.Out(lg.b("systemd ") + "unit not scheduled")
+		return 3
+	}
+	lg.Out(lg.b("systemd ") + "load: " + state.SystemdLoadState + " active: " + state.SystemdActiveState +
+		" sub: " + state.SystemdSubState + " machine: " + FleetMachineName(state.MachineID))
+	switch state.SystemdActiveState {
+	case "active":
+		return 0
+	case "failed":
+		return 1
+	}
+	return 3
+}
+
+// Returns a printable machine name "id/ip" for a machine id.
+func FleetMachineName(machineID string) string {
+	machines, err := fleetClient.Machines()
+	if err != nil {
+		lg.DebugError(err)
+		return machineID
+	}
+	for _, machine := range machines {
+		if machine.ID == machineID {
+			return machine.ID + "/" + machine.PrimaryIP
+		}
+	}
+	return machineID
+}
+
+// Shows the journal of a unit. The fleet API does not expose journals, so fleetctl is used.
+func FleetJournal(cmd, unitName string) (exitCode int) {
+	if _, err := exec.LookPath(fleetctl); err != nil {
+		lg.Error(errors.New("journal needs fleetctl in your $PATH: " + err.Error()))
+		return 1
+	}
+	args := []string{"journal"}
+	if cmd == "journalf" {
+		args = append(args, "-f")
+	} else if cmd == "journala" {
+		args = append(args, "-lines=10000")
+	}
 	output := make(chan string)
 	exit := make(chan int)
+	go FleetExec(append(args, unitName), output, exit)
+	return FleetProcessOutput(output, exit)
+}
+
+// Function able to run a command on a unit path. Output is processed and printed
+// and an exit code is returned.
+func FleetExecCommand(cmd, unitPath string) (exitCode int) {
+	var err error
 	FleetCheckPath(unitPath)
-	args = []string{cmd}
-	if cmd == "status" || strings.HasPrefix(cmd, "journal") {
-		if strings.HasPrefix(cmd, "journal") {
-			if cmd == "journalf" {
-				args = append(args, "-f")
-			} else if cmd == "journala" {
-				args = append(args, "-lines=10000")
-			}
-		}
+	unitName := path.Base(unitPath)
+	lg.Debug(cmd+" "+unitName, "fleet")
+	switch cmd {
+	case "submit":
+		err = FleetSubmitUnit(unitPath, fleetStateInactive)
+	case "load":
+		err = FleetSubmitUnit(unitPath, fleetStateLoaded)
+	case "start":
+		err = FleetSubmitUnit(unitPath, fleetStateLaunched)
+	case "stop":
+		err = fleetClient.SetUnitTargetState(unitName, fleetStateLoaded)
+	case "destroy":
+		err = fleetClient.DestroyUnit(unitName)
+	case "status":
+		exitCode = FleetPrintStatus(unitName)
+	case "journal", "journalf", "journala":
+		exitCode = FleetJournal(cmd, unitName)
+	default:
+		err = errors.New("unknown fleet command " + cmd)
+	}
+	if err != nil {
+		lg.Error(err)
+		exitCode = 1
+	} else if cmd != "status" && !strings.HasPrefix(cmd, "journal") {
+		lg.Out(lg.b("fleet ") + cmd + " " + unitName)
 	}
-	go FleetExec(append(args, unitPath), output, exit)
-	exitCode += FleetProcessOutput(output, exit)
 	if exitCode == 3 && (cmd == "status" || strings.HasPrefix(cmd, "journal")) {
 		lg.Debug("please wait, unit " + unitPath + " is starting")
 		exitCode = 0
@@ -116,7 +264,7 @@ func FleetExecCommand(cmd, unitPath string) (exitCode int) {
 
 // Wrapper to run a container build on the coreos cluster.
 func FleetBuildUnit(_, unitPath string) (exitCode int) {
-	lg.Debug("building "+unitPath+" on the cluser", fleetctl)
+	lg.Debug("building "+unitPath+" on the cluser", "fleet")
 	cmds := []string{"destroy", "submit", "load", "start"}
 	for _, cmd := range cmds {
 		exitCode += FleetExecCommand(cmd, unitPath)
@@ -124,14 +272,102 @@ func FleetBuildUnit(_, unitPath string) (exitCode int) {
 	return
 }
 
-// Wrapper to run a unit on the coreos cluster.
+// Checks if the unit submitted to fleet differs from the local unit file.
+func FleetIsUnitChanged(unitPath string) bool {
+	if !strings.Contains(unitPath, "/") {
+		return false
+	}
+	unit, err := fleetClient.Unit(path.Base(unitPath))
+	if err != nil || unit == nil {
+		lg.DebugError(err)
+		return false
+	}
+	options, err := FleetLoadUnitOptions(unitPath)
+	if err != nil {
+		lg.DebugError(err)
+		return false
+	}
+	return GetUnitHash(unit.Options) != GetUnitHash(options)
+}
+
+// Wrapper to run a unit on the coreos cluster, selecting the fleet backend. Running units
+// are left alone, unless their local unit file changed.
 func FleetRunUnit(_, unitPath string) (exitCode int) {
-	lg.Debug("running "+unitPath+" on the cluser", fleetctl)
-	cmds := []string{"submit", "load", "start"}
-	if !FleetIsUnitRunning(unitPath) {
-		for _, cmd := range cmds {
-			exitCode += FleetExecCommand(cmd, unitPath)
+	SetupScheduler("fleet")
+	return SchedulerRunUnit("", unitPath)
+}
+
+func init() {
+	RegisterScheduler("fleet", func() Scheduler { return &FleetScheduler{} })
+}
+
+// Scheduler backend running units on a coreos cluster through fleet.
+type FleetScheduler struct{}
+
+// Submits and loads a unit, publishing first the secrets of its component.
+func (f *FleetScheduler) Submit(unitPath string) int {
+	if component, _, err := config.GetUnitComponent(unitPath); err == nil && len(component.Secrets) > 0 {
+		if err := SecretsPublish(component); err != nil {
+			lg.Error(err)
+			return 1
+		}
+	}
+	return FleetExecCommand("submit", unitPath) + FleetExecCommand("load", unitPath)
+}
+
+func (f *FleetScheduler) Start(unitPath string) int {
+	return FleetExecCommand("start", unitPath)
+}
+
+func (f *FleetScheduler) Stop(unitPath string) int {
+	return FleetExecCommand("stop", unitPath)
+}
+
+func (f *FleetScheduler) Destroy(unitPath string) int {
+	return FleetExecCommand("destroy", unitPath)
+}
+
+func (f *FleetScheduler) Status(unitPath string) int {
+	return FleetExecCommand("status", unitPath)
+}
+
+func (f *FleetScheduler) Journal(unitPath string, follow, all bool) int {
+	cmd := "journal"
+	if follow {
+		cmd = "journalf"
+	} else if all {
+		cmd = "journala"
+	}
+	return FleetExecCommand(cmd, unitPath)
+}
+
+func (f *FleetScheduler) List(prefix string) (names []string, err error) {
+	units, err := fleetClient.Units()
+	if err != nil {
+		return
+	}
+	for _, unit := range units {
+		if strings.HasPrefix(unit.Name, prefix) {
+			names = append(names, unit.Name)
 		}
 	}
+	sort.Strings(names)
 	return
 }
+
+func (f *FleetScheduler) IsRunning(unitPath string) bool {
+	return FleetIsUnitRunning(unitPath)
+}
+
+func (f *FleetScheduler) State(unitPath string) string {
+	state, err := FleetGetUnitState(path.Base(unitPath))
+	if err != nil || state == nil {
+		lg.DebugError(err)
+		return ""
+	}
+	return state.SystemdActiveState
+}
+
+func (f *FleetScheduler) Changed(unitPath string) bool {
+	return FleetIsUnitChanged(unitPath)
+}
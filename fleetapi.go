@@ -0,0 +1,301 @@
+package maestro
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	fleetAPIPrefix  = "/fleet/v1"
+	fleetAPIPort    = "49153"
+	fleetAPITimeout = 30 * time.Second
+)
+
+// Fleet client used by all fleet operations.
+var fleetClient *FleetClient
+
+// Single option of a fleet unit, equivalent to a line of a systemd unit file.
+type FleetUnitOption struct {
+	Section string `json:"section"`
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+}
+
+// Unit as known by the fleet API.
+type FleetUnit struct {
+	Name         string             `json:"name"`
+	Options      []*FleetUnitOption `json:"options,omitempty"`
+	DesiredState string             `json:"desiredState,omitempty"`
+	CurrentState string             `json:"currentState,omitempty"`
+	MachineID    string             `json:"machineID,omitempty"`
+}
+
+// Systemd state of a unit as published by the fleet agent running it.
+type FleetUnitState struct {
+	Name               string `json:"name"`
+	Hash               string `json:"hash"`
+	MachineID          string `json:"machineID"`
+	SystemdLoadState   string `json:"systemdLoadState"`
+	SystemdActiveState string `json:"systemdActiveState"`
+	SystemdSubState    string `json:"systemdSubState"`
+}
+
+// Machine of the coreos cluster as known by fleet.
+type FleetMachine struct {
+	ID        string            `json:"id"`
+	PrimaryIP string            `json:"primaryIP"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// Paginated list of units.
+type fleetUnitPage struct {
+	Units         []*FleetUnit `json:"units"`
+	NextPageToken string       `json:"nextPageToken,omitempty"`
+}
+
+// Paginated list of unit states.
+type fleetUnitStatePage struct {
+	States        []*FleetUnitState `json:"states"`
+	NextPageToken string            `json:"nextPageToken,omitempty"`
+}
+
+// Paginated list of machines.
+type fleetMachinePage struct {
+	Machines      []*FleetMachine `json:"machines"`
+	NextPageToken string          `json:"nextPageToken,omitempty"`
+}
+
+// Error returned by the fleet API.
+type fleetError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Client for the fleet HTTP API.
+type FleetClient struct {
+	Endpoint string
+	HTTP     *http.Client
+}
+
+// Setup the global fleet client. If `endpoint` is empty the API is reached on the
+// default fleet port of the tunnel address.
+func SetupFleetClient(endpoint string) {
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("http://%s:%s", fleetAddress, fleetAPIPort)
+	}
+	lg.Debug("fleet api endpoint "+endpoint, "fleet")
+	fleetClient = NewFleetClient(endpoint)
+}
+
+// Returns a new client for the fleet API available at `endpoint`.
+func NewFleetClient(endpoint string) *FleetClient {
+	return &FleetClient{
+		Endpoint: strings.TrimRight(endpoint, "/"),
+		HTTP:     &http.Client{Timeout: fleetAPITimeout},
+	}
+}
+
+// Performs a request against the fleet API, decoding the response into `out` if not nil.
+// It returns the HTTP status code.
+func (f *FleetClient) do(method, path string, in, out interface{}) (int, error) {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return 0, err
+		}
+	}
+	req, err := http.NewRequest(method, f.Endpoint+fleetAPIPrefix+path, &body)
+	if err != nil {
+		return 0, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	lg.Debug(method+" "+req.URL.String(), "fleet")
+	resp, err := f.HTTP.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode >= 400 {
+		var fErr fleetError
+		if json.Unmarshal(data, &fErr) == nil && fErr.Error.Message != "" {
+			return resp.StatusCode, errors.New("fleet: " + fErr.Error.Message)
+		}
+		return resp.StatusCode, fmt.Errorf("fleet: %s %s returned %s", method, path, resp.Status)
+	}
+	if out != nil && len(data) > 0 {
+		err = json.Unmarshal(data, out)
+	}
+	return resp.StatusCode, err
+}
+
+// Returns all units known to fleet.
+func (f *FleetClient) Units() (units []*FleetUnit, err error) {
+	token := ""
+	for {
+		var page fleetUnitPage
+		if _, err = f.do("GET", "/units"+pageQuery(token, nil), nil, &page); err != nil {
+			return
+		}
+		units = append(units, page.Units...)
+		if token = page.NextPageToken; token == "" {
+			return
+		}
+	}
+}
+
+// Returns a single unit or nil if fleet does not know about it.
+func (f *FleetClient) Unit(name string) (*FleetUnit, error) {
+	var unit FleetUnit
+	code, err := f.do("GET", "/units/"+url.PathEscape(name), nil, &unit)
+	if code == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &unit, nil
+}
+
+// Submits a new unit with its options and desired state.
+func (f *FleetClient) CreateUnit(unit *FleetUnit) error {
+	_, err := f.do("PUT", "/units/"+url.PathEscape(unit.Name), unit, nil)
+	return err
+}
+
+// Changes the desired state (inactive, loaded, launched) of an existing unit.
+func (f *FleetClient) SetUnitTargetState(name, state string) error {
+	_, err := f.do("PUT", "/units/"+url.PathEscape(name), &FleetUnit{Name: name, DesiredState: state}, nil)
+	return err
+}
+
+// Destroys a unit. Destroying an unknown unit is not an error.
+func (f *FleetClient) DestroyUnit(name string) error {
+	code, err := f.do("DELETE", "/units/"+url.PathEscape(name), nil, nil)
+	if code == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// Returns the systemd state of units. If `name` is set only the state of that unit is returned.
+func (f *FleetClient) UnitStates(name string) (states []*FleetUnitState, err error) {
+	token := ""
+	query := url.Values{}
+	if name != "" {
+		query.Set("unitName", name)
+	}
+	for {
+		var page fleetUnitStatePage
+		if _, err = f.do("GET", "/state"+pageQuery(token, query), nil, &page); err != nil {
+			return
+		}
+		states = append(states, page.States...)
+		if token = page.NextPageToken; token == "" {
+			return
+		}
+	}
+}
+
+// Returns all machines in the cluster.
+func (f *FleetClient) Machines() (machines []*FleetMachine, err error) {
+	token := ""
+	for {
+		var page fleetMachinePage
+		if _, err = f.do("GET", "/machines"+pageQuery(token, nil), nil, &page); err != nil {
+			return
+		}
+		machines = append(machines, page.Machines...)
+		if token = page.NextPageToken; token == "" {
+			return
+		}
+	}
+}
+
+// Builds the query string for a paginated request.
+func pageQuery(token string, query url.Values) string {
+	if query == nil {
+		query = url.Values{}
+	}
+	if token != "" {
+		query.Set("nextPageToken", token)
+	}
+	if len(query) == 0 {
+		return ""
+	}
+	return "?" + query.Encode()
+}
+
+// Parses a systemd unit file into fleet unit options. Comments are dropped and
+// lines ending with a backslash are joined with the following one.
+func ParseUnitFile(content string) (options []*FleetUnitOption) {
+	section := ""
+	value := ""
+	name := ""
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if name != "" {
+			if strings.HasSuffix(line, "\\") {
+				value += " " + strings.TrimSpace(strings.TrimSuffix(line, "\\"))
+				continue
+			}
+			options = append(options, &FleetUnitOption{section, name, strings.TrimSpace(value + " " + line)})
+			name = ""
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line[1 : len(line)-1]
+			continue
+		}
+		split := strings.SplitN(line, "=", 2)
+		if len(split) != 2 {
+			continue
+		}
+		if strings.HasSuffix(split[1], "\\") {
+			name = strings.TrimSpace(split[0])
+			value = strings.TrimSpace(strings.TrimSuffix(split[1], "\\"))
+			continue
+		}
+		options = append(options, &FleetUnitOption{section, strings.TrimSpace(split[0]), strings.TrimSpace(split[1])})
+	}
+	if name != "" {
+		options = append(options, &FleetUnitOption{section, name, strings.TrimSpace(value)})
+	}
+	return
+}
+
+// Serializes fleet unit options back into a systemd unit file.
+func SerializeUnitOptions(options []*FleetUnitOption) string {
+	var buf bytes.Buffer
+	section := ""
+	for i, option := range options {
+		if i == 0 || option.Section != section {
+			if i > 0 {
+				buf.WriteString("\n")
+			}
+			section = option.Section
+			buf.WriteString("[" + section + "]\n")
+		}
+		buf.WriteString(option.Name + "=" + option.Value + "\n")
+	}
+	return buf.String()
+}
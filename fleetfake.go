@@ -0,0 +1,234 @@
+package maestro
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// In-process fake of the fleet HTTP API, used to exercise maestro without a cluster.
+// Launched units are scheduled round robin on the fake machines and reported as active,
+// unless their state is forced with SetUnitActiveState.
+type FleetFakeServer struct {
+	*httptest.Server
+	Machines []*FleetMachine
+	// Number of items returned per page, 0 means no pagination.
+	PageSize int
+
+	mu        sync.Mutex
+	units     map[string]*FleetUnit
+	states    map[string]string
+	scheduled int
+}
+
+// Starts a new fake fleet server with three machines.
+func NewFleetFakeServer() *FleetFakeServer {
+	f := &FleetFakeServer{
+		units:  map[string]*FleetUnit{},
+		states: map[string]string{},
+		Machines: []*FleetMachine{
+			{ID: "c0ffee01", PrimaryIP: "172.17.8.101", Metadata: map[string]string{"role": "worker"}},
+			{ID: "c0ffee02", PrimaryIP: "172.17.8.102", Metadata: map[string]string{"role": "worker"}},
+			{ID: "c0ffee03", PrimaryIP: "172.17.8.103", Metadata: map[string]string{"role": "storage"}},
+		},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+// Returns a copy of a unit known to the fake server, or nil.
+func (f *FleetFakeServer) Unit(name string) *FleetUnit {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if unit, ok := f.units[name]; ok {
+		copied := *unit
+		return &copied
+	}
+	return nil
+}
+
+// Returns the sorted names of all units known to the fake server.
+func (f *FleetFakeServer) UnitNames() (names []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for name := range f.units {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Forces the systemd active state reported for a unit (e.g. "activating" or "failed"),
+// even if the unit is destroyed and submitted again. An empty state removes the override.
+func (f *FleetFakeServer) SetUnitActiveState(name, state string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if state == "" {
+		delete(f.states, name)
+		return
+	}
+	f.states[name] = state
+}
+
+func (f *FleetFakeServer) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, fleetAPIPrefix)
+	switch {
+	case path == "/units" && r.Method == "GET":
+		units := []*FleetUnit{}
+		for _, name := range f.sortedUnits() {
+			units = append(units, f.units[name])
+		}
+		start, end, next := f.page(r, len(units))
+		f.reply(w, http.StatusOK, &fleetUnitPage{Units: units[start:end], NextPageToken: next})
+	case strings.HasPrefix(path, "/units/"):
+		f.handleUnit(w, r, strings.TrimPrefix(path, "/units/"))
+	case path == "/state" && r.Method == "GET":
+		states := []*FleetUnitState{}
+		filter := r.URL.Query().Get("unitName")
+		for _, name := range f.sortedUnits() {
+			if filter != "" && filter != name {
+				continue
+			}
+			if state := f.state(f.units[name]); state != nil {
+				states = append(states, state)
+			}
+		}
+		start, end, next := f.page(r, len(states))
+		f.reply(w, http.StatusOK, &fleetUnitStatePage{States: states[start:end], NextPageToken: next})
+	case path == "/machines" && r.Method == "GET":
+		start, end, next := f.page(r, len(f.Machines))
+		f.reply(w, http.StatusOK, &fleetMachinePage{Machines: f.Machines[start:end], NextPageToken: next})
+	default:
+		f.error(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (f *FleetFakeServer) handleUnit(w http.ResponseWriter, r *http.Request, name string) {
+	unit, exists := f.units[name]
+	switch r.Method {
+	case "GET":
+		if !exists {
+			f.error(w, http.StatusNotFound, "unit does not exist")
+			return
+		}
+		f.reply(w, http.StatusOK, unit)
+	case "DELETE":
+		if !exists {
+			f.error(w, http.StatusNotFound, "unit does not exist")
+			return
+		}
+		delete(f.units, name)
+		w.WriteHeader(http.StatusNoContent)
+	case "PUT":
+		var req FleetUnit
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			f.error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !validFleetState(req.DesiredState) {
+			f.error(w, http.StatusBadRequest, "invalid desiredState "+req.DesiredState)
+			return
+		}
+		if exists {
+			if len(req.Options) > 0 && SerializeUnitOptions(req.Options) != SerializeUnitOptions(unit.Options) {
+				f.error(w, http.StatusConflict, "unit "+name+" already exists with different options")
+				return
+			}
+			f.setDesiredState(unit, req.DesiredState)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if len(req.Options) == 0 {
+			f.error(w, http.StatusConflict, "unit "+name+" does not exist and options field empty")
+			return
+		}
+		unit = &FleetUnit{Name: name, Options: req.Options}
+		f.units[name] = unit
+		f.setDesiredState(unit, req.DesiredState)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		f.error(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (f *FleetFakeServer) setDesiredState(unit *FleetUnit, state string) {
+	unit.DesiredState = state
+	unit.CurrentState = state
+	if state == fleetStateInactive {
+		unit.MachineID = ""
+		return
+	}
+	if unit.MachineID == "" && len(f.Machines) > 0 {
+		unit.MachineID = f.Machines[f.scheduled%len(f.Machines)].ID
+		f.scheduled++
+	}
+}
+
+// Builds the systemd state of a unit, nil if the unit is not scheduled.
+func (f *FleetFakeServer) state(unit *FleetUnit) *FleetUnitState {
+	if unit.MachineID == "" {
+		return nil
+	}
+	state := &FleetUnitState{
+		Name:               unit.Name,
+		Hash:               strconv.Itoa(len(SerializeUnitOptions(unit.Options))),
+		MachineID:          unit.MachineID,
+		SystemdLoadState:   "loaded",
+		SystemdActiveState: "inactive",
+		SystemdSubState:    "dead",
+	}
+	if unit.CurrentState == fleetStateLaunched {
+		state.SystemdActiveState = "active"
+		state.SystemdSubState = "running"
+	}
+	if forced, ok := f.states[unit.Name]; ok {
+		state.SystemdActiveState = forced
+		state.SystemdSubState = forced
+	}
+	return state
+}
+
+func (f *FleetFakeServer) sortedUnits() (names []string) {
+	for name := range f.units {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Returns the slice bounds and next page token for a paginated list of `total` items.
+func (f *FleetFakeServer) page(r *http.Request, total int) (start, end int, next string) {
+	start, _ = strconv.Atoi(r.URL.Query().Get("nextPageToken"))
+	if start > total {
+		start = total
+	}
+	end = total
+	if f.PageSize > 0 && start+f.PageSize < total {
+		end = start + f.PageSize
+		next = strconv.Itoa(end)
+	}
+	return
+}
+
+func (f *FleetFakeServer) reply(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (f *FleetFakeServer) error(w http.ResponseWriter, code int, message string) {
+	var body fleetError
+	body.Error.Code = code
+	body.Error.Message = message
+	f.reply(w, code, &body)
+}
+
+func validFleetState(state string) bool {
+	return state == fleetStateInactive || state == fleetStateLoaded || state == fleetStateLaunched
+}
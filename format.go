@@ -0,0 +1,140 @@
+package maestro
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Supported configuration formats.
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// Supported configuration formats, in the order they are listed in help messages.
+var ConfigFormats = []string{FormatJSON, FormatYAML, FormatTOML}
+
+// Returns the format of a configuration file from its extension. Files with an unknown
+// extension are read as JSON, as maestro always did.
+func ConfigFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	}
+	return FormatJSON
+}
+
+// Converts a configuration from any supported format to JSON, so that it is decoded
+// following the json tags of the configuration structs.
+func ConfigToJSON(data []byte, format string) ([]byte, error) {
+	var value interface{}
+	switch format {
+	case FormatJSON:
+		return data, nil
+	case FormatYAML:
+		if err := yaml.Unmarshal(data, &value); err != nil {
+			return nil, err
+		}
+	case FormatTOML:
+		if err := toml.Unmarshal(data, &value); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unsupported configuration format " + format)
+	}
+	value, err := normalizeValue(value)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		value = map[string]interface{}{}
+	}
+	return json.Marshal(value)
+}
+
+// Encodes a value (the configuration or the user) in one of the supported formats.
+func EncodeConfig(v interface{}, format string) ([]byte, error) {
+	if format == FormatJSON {
+		return json.MarshalIndent(v, "", "    ")
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if value, err = normalizeValue(value); err != nil {
+		return nil, err
+	}
+	switch format {
+	case FormatYAML:
+		return yaml.Marshal(value)
+	case FormatTOML:
+		var buf bytes.Buffer
+		err := toml.NewEncoder(&buf).Encode(value)
+		return buf.Bytes(), err
+	}
+	return nil, errors.New("unsupported configuration format " + format)
+}
+
+// Turns a decoded value into plain JSON types: maps with string keys, integer numbers
+// and no null values, which can not be represented in TOML.
+func normalizeValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		object := map[string]interface{}{}
+		for key, item := range v {
+			object[fmt.Sprint(key)] = item
+		}
+		return normalizeValue(object)
+	case map[string]interface{}:
+		object := map[string]interface{}{}
+		for key, item := range v {
+			if item == nil {
+				continue
+			}
+			normalized, err := normalizeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			object[key] = normalized
+		}
+		return object, nil
+	case []interface{}:
+		items := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			normalized, err := normalizeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, normalized)
+		}
+		return items, nil
+	case []map[string]interface{}:
+		items := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			items = append(items, item)
+		}
+		return normalizeValue(items)
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+		return v.Float64()
+	}
+	return value, nil
+}
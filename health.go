@@ -0,0 +1,153 @@
+package maestro
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Healthcheck defaults, the same used by docker.
+const (
+	healthDefaultInterval = "30s"
+	healthDefaultTimeout  = "30s"
+	healthDefaultRetries  = 3
+)
+
+// MaestroHealthcheck structure. Only one of Cmd, HTTP and TCP can be set, they are all
+// checked from inside the container.
+type MaestroHealthcheck struct {
+	Cmd      string `json:"cmd"`
+	HTTP     string `json:"http"`
+	Interval string `json:"interval"`
+	Retries  int    `json:"retries"`
+	TCP      int    `json:"tcp"`
+	Timeout  string `json:"timeout"`
+}
+
+// Returns the shell command run by docker to check the container health.
+func (h *MaestroHealthcheck) Command() string {
+	switch {
+	case h.HTTP != "":
+		// images ship either curl or wget
+		return fmt.Sprintf("curl -fsS -o /dev/null %s || wget -q -O /dev/null %s || exit 1", h.HTTP, h.HTTP)
+	case h.TCP != 0:
+		return fmt.Sprintf("nc -z 127.0.0.1 %d || exit 1", h.TCP)
+	}
+	return h.Cmd
+}
+
+// Returns the healthcheck interval, timeout and retries, defaulting to the docker ones.
+func (h *MaestroHealthcheck) settings() (interval, timeout string, retries int) {
+	interval, timeout, retries = h.Interval, h.Timeout, h.Retries
+	if interval == "" {
+		interval = healthDefaultInterval
+	}
+	if timeout == "" {
+		timeout = healthDefaultTimeout
+	}
+	if retries == 0 {
+		retries = healthDefaultRetries
+	}
+	return
+}
+
+// Returns the `docker run` arguments enabling the healthcheck.
+func (h *MaestroHealthcheck) DockerArgs() []string {
+	interval, timeout, retries := h.settings()
+	return []string{"--health-cmd", h.Command(), "--health-interval", interval,
+		"--health-timeout", timeout, "--health-retries", strconv.Itoa(retries)}
+}
+
+// Returns the systemd command waiting for a container to become healthy. It fails as soon
+// as the container is unhealthy, is not running anymore or is gone, or when docker would
+// have marked it unhealthy if it still is starting.
+func (h *MaestroHealthcheck) WaitCommand(container string) string {
+	interval, timeout, retries := h.settings()
+	i, _ := time.ParseDuration(interval)
+	t, _ := time.ParseDuration(timeout)
+	seconds := int((i + t).Seconds()) * (retries + 1)
+	return fmt.Sprintf(`/usr/bin/sh -c 'i=0; while [ $$i -lt %d ]; do `+
+		`s=$$(/usr/bin/docker inspect -f "{{.State.Running}} {{.State.Health.Status}}" %s 2>/dev/null) || exit 1; `+
+		`case "$$s" in "true healthy") exit 0;; "true starting") ;; *) exit 1;; esac; `+
+		`i=$$((i+1)); sleep 1; done; exit 1'`, seconds, container)
+}
+
+// Validates a healthcheck.
+func (h *MaestroHealthcheck) Validate() (errs []error) {
+	set := 0
+	for _, check := range []bool{h.Cmd != "", h.HTTP != "", h.TCP != 0} {
+		if check {
+			set++
+		}
+	}
+	if set != 1 {
+		errs = append(errs, errors.New("healthcheck needs exactly one of cmd, http and tcp"))
+	}
+	if h.HTTP != "" && !strings.HasPrefix(h.HTTP, "http://") && !strings.HasPrefix(h.HTTP, "https://") {
+		errs = append(errs, fmt.Errorf("healthcheck http %q is not an http(s) url", h.HTTP))
+	}
+	if h.TCP < 0 || h.TCP > 65535 {
+		errs = append(errs, fmt.Errorf("invalid healthcheck tcp port %d", h.TCP))
+	}
+	if _, err := time.ParseDuration(h.Interval); h.Interval != "" && err != nil {
+		errs = append(errs, fmt.Errorf("invalid healthcheck interval %q", h.Interval))
+	}
+	if _, err := time.ParseDuration(h.Timeout); h.Timeout != "" && err != nil {
+		errs = append(errs, fmt.Errorf("invalid healthcheck timeout %q", h.Timeout))
+	}
+	if h.Retries < 0 {
+		errs = append(errs, fmt.Errorf("healthcheck retries %d must not be negative", h.Retries))
+	}
+	return
+}
+
+// Quotes an argument for a systemd command line, escaping specifiers and variables.
+func systemdArg(arg string) string {
+	arg = strings.Replace(arg, "%", "%%", -1)
+	arg = strings.Replace(arg, "$", "$$", -1)
+	if !strings.ContainsAny(arg, " \t\"'\\;") {
+		return arg
+	}
+	return `"` + strings.Replace(strings.Replace(arg, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+// Waits until all units in the current app are active, which for components with a
+// healthcheck means healthy. It can wait for a single unit, using `unit` argument.
+// If any unit fails or is not active before `timeout`, the state of every unit is printed.
+func MaestroWait(unit string, timeout time.Duration) (exitCode int) {
+	units := []string{}
+	if unit != "" {
+		units = append(units, unit)
+	} else {
+		for _, stage := range config.Stages {
+			for _, component := range stage.Components {
+				for i := 1; i < component.Scale+1; i++ {
+					units = append(units, config.GetNumberedUnitPath(component.UnitPath, strconv.Itoa(i)))
+				}
+			}
+		}
+	}
+	lg.Out(lg.b("maestro ") + "waiting for " + strconv.Itoa(len(units)) + " instances to become healthy")
+	failed := SchedulerWaitActive(units, timeout)
+	if len(failed) == 0 {
+		lg.Out(lg.b("maestro ") + "all instances are " + lg.g("healthy"))
+		return
+	}
+	lg.Out(lg.b("maestro ") + "run " + lg.r("failed"))
+	for _, unit := range units {
+		state := scheduler.State(unit)
+		switch {
+		case state == "active":
+			state = lg.g(state)
+		case state == "":
+			state = lg.r("unknown")
+		default:
+			state = lg.r(state)
+		}
+		lg.Out("unit " + lg.b(strings.TrimSuffix(path.Base(unit), ".service")) + " is " + state)
+	}
+	return 1
+}
@@ -0,0 +1,306 @@
+package maestro
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default number of revisions kept in the deployment history of a stage.
+const HistoryDefaultLimit = 20
+
+var (
+	historyLimit   = HistoryDefaultLimit
+	historyDigests = true
+)
+
+// MaestroRevision structure. Revision of an app stage, recorded after every successful
+// command changing it, with the unit files submitted and the stage configuration they were
+// rendered from.
+type MaestroRevision struct {
+	Revision int               `json:"revision"`
+	Command  string            `json:"command"`
+	User     string            `json:"user"`
+	Time     time.Time         `json:"time"`
+	Images   map[string]string `json:"images"`
+	Units    map[string]string `json:"units"`
+	Stage    MaestroStage      `json:"stage"`
+}
+
+// Setup the deployment history, keeping `limit` revisions per stage (0 disables it) and
+// resolving the image digests with `digests`.
+func SetupHistory(limit int, digests bool) {
+	historyLimit = limit
+	historyDigests = digests
+}
+
+// Returns the etcd key of a revision, zero padded to keep revisions sorted.
+func historyKey(stage string, revision int) string {
+	return fmt.Sprintf("%s/%08d", config.GetHistoryKey(stage), revision)
+}
+
+// Returns the recorded revisions of a stage, oldest first.
+func HistoryRevisions(stage string) (revisions []*MaestroRevision, err error) {
+	kvs, err := etcdClient.List(config.GetHistoryKey(stage))
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range kvs {
+		revision := &MaestroRevision{}
+		if err := json.Unmarshal([]byte(kv.Value), revision); err != nil {
+			return nil, fmt.Errorf("invalid revision %s: %s", kv.Key, err)
+		}
+		revisions = append(revisions, revision)
+	}
+	sort.Slice(revisions, func(i, j int) bool { return revisions[i].Revision < revisions[j].Revision })
+	return
+}
+
+// Builds the revision of a stage from its local unit files.
+func HistoryBuildRevision(stage *MaestroStage, command string) (*MaestroRevision, error) {
+	revision := &MaestroRevision{
+		Command: command,
+		User:    historyUser(),
+		Time:    time.Now().UTC(),
+		Images:  map[string]string{},
+		Units:   map[string]string{},
+		Stage:   *stage,
+	}
+	for _, component := range stage.Components {
+		data, err := ioutil.ReadFile(component.UnitPath)
+		if err != nil {
+			return nil, err
+		}
+		unit := path.Base(component.UnitPath)
+		revision.Units[unit] = string(data)
+		revision.Images[component.Name] = component.Src
+		if !historyDigests {
+			continue
+		}
+		if digest, err := ImageDigest(component.Src); err == nil {
+			image := strings.SplitN(component.Src, "@", 2)[0] + "@" + digest
+			revision.Images[component.Name] = image
+			// units are recorded pinned to the digest, rollbacks run the same image
+			revision.Units[unit] = historyPinImage(revision.Units[unit], component.Src, image)
+		} else {
+			lg.Debug(err.Error(), "history")
+		}
+	}
+	return revision, nil
+}
+
+// Replaces the references to the image `src` in a unit file with `image`. References
+// already pinned to a digest are left alone.
+func historyPinImage(unit, src, image string) string {
+	if src == image {
+		return unit
+	}
+	return regexp.MustCompile(`(?m)`+regexp.QuoteMeta(src)+`(\s|$)`).ReplaceAllString(unit, image+"${1}")
+}
+
+// Returns the user running maestro.
+func historyUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// Records a revision of every stage of the current app. Failures are only reported, as
+// the command recording the revision already succeeded.
+func HistoryRecord(command string) {
+	if historyLimit == 0 {
+		return
+	}
+	for i := range config.Stages {
+		if err := historyRecordStage(&config.Stages[i], command); err != nil {
+			lg.Warn("unable to record the " + config.Stages[i].Name + " revision in the deployment history: " + err.Error())
+		}
+	}
+}
+
+// Records a revision of a stage, unless its units and images match the latest revision,
+// and removes the revisions over the history limit.
+func historyRecordStage(stage *MaestroStage, command string) error {
+	revisions, err := HistoryRevisions(stage.Name)
+	if err != nil {
+		return err
+	}
+	revision, err := HistoryBuildRevision(stage, command)
+	if err != nil {
+		return err
+	}
+	if len(revisions) > 0 {
+		latest := revisions[len(revisions)-1]
+		if reflect.DeepEqual(latest.Units, revision.Units) && reflect.DeepEqual(latest.Images, revision.Images) {
+			lg.Debug("no changes since revision "+strconv.Itoa(latest.Revision), "history", stage.Name)
+			return nil
+		}
+		revision.Revision = latest.Revision
+	}
+	revision.Revision++
+	data, err := json.Marshal(revision)
+	if err != nil {
+		return err
+	}
+	if err = etcdClient.Set(historyKey(stage.Name, revision.Revision), string(data)); err != nil {
+		return err
+	}
+	lg.Out(lg.b("maestro ") + "recorded revision " + lg.g(strconv.Itoa(revision.Revision)) + " of " + lg.y(stage.Name))
+	revisions = append(revisions, revision)
+	for len(revisions) > historyLimit {
+		if err = etcdClient.Delete(historyKey(stage.Name, revisions[0].Revision)); err != nil && err != ErrEtcdKeyNotFound {
+			return err
+		}
+		revisions = revisions[1:]
+	}
+	return nil
+}
+
+// Prints the deployment history of a stage, as json with `asJSON`.
+func MaestroHistory(stage string, asJSON bool) (exitCode int) {
+	stage, err := commandStage(stage)
+	if err != nil {
+		lg.Error(err)
+		return 1
+	}
+	revisions, err := HistoryRevisions(stage)
+	if err != nil {
+		lg.Error(err)
+		return 1
+	}
+	if asJSON {
+		if revisions == nil {
+			revisions = []*MaestroRevision{}
+		}
+		data, _ := json.MarshalIndent(revisions, "", "    ")
+		lg.Out(string(data))
+		return
+	}
+	if len(revisions) == 0 {
+		lg.Out("no revisions recorded for stage " + stage)
+		return
+	}
+	for _, revision := range revisions {
+		lg.Out(fmt.Sprintf("%s %-5d %s  %-12s %s", lg.b("revision"), revision.Revision,
+			revision.Time.Local().Format("2006-01-02 15:04:05"), revision.User, revision.Command))
+		names := []string{}
+		for name := range revision.Images {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			lg.Out("    " + lg.g(name) + " " + revision.Images[name])
+		}
+	}
+	return
+}
+
+// Submits again the unit files of a recorded revision of a stage, the previous one if
+// `revision` is 0. Units of the stage which are not part of the revision are destroyed.
+func MaestroRollback(stage string, revision int) (exitCode int) {
+	stage, err := commandStage(stage)
+	if err != nil {
+		lg.Error(err)
+		return 1
+	}
+	revisions, err := HistoryRevisions(stage)
+	if err != nil {
+		lg.Error(err)
+		return 1
+	}
+	var target *MaestroRevision
+	if revision == 0 && len(revisions) > 1 {
+		target = revisions[len(revisions)-2]
+	}
+	for _, r := range revisions {
+		if revision != 0 && r.Revision == revision {
+			target = r
+		}
+	}
+	if target == nil {
+		if revision == 0 {
+			err = errors.New("no previous revision of stage " + stage + " to roll back to")
+		} else {
+			err = fmt.Errorf("revision %d of stage %s not found, see maestro history", revision, stage)
+		}
+		lg.Error(err)
+		return 1
+	}
+	lg.Out(lg.b("maestro ") + "rolling back " + lg.y(stage) + " to revision " + lg.g(strconv.Itoa(target.Revision)))
+	rollback, err := historyRestoreStage(target)
+	if err != nil {
+		lg.Error(err)
+		return 1
+	}
+	defer DNSSync()
+	units := map[string]bool{}
+	for _, component := range SortComponents(rollback.Components) {
+		for i := 1; i < component.Scale+1; i++ {
+			units[config.GetUnitName(&component, strconv.Itoa(i))+".service"] = true
+			exitCode += SchedulerRunUnit("", config.GetNumberedUnitPath(component.UnitPath, strconv.Itoa(i)))
+		}
+	}
+	names, err := scheduler.List(config.GetAppPrefix(stage))
+	if err != nil {
+		lg.Error(err)
+		return 1
+	}
+	for _, name := range names {
+		if units[name] || strings.HasSuffix(name, "-build.service") {
+			continue
+		}
+		lg.Out("unit " + lg.b(name) + " is not part of revision " + strconv.Itoa(target.Revision) + ", removing it")
+		exitCode += scheduler.Stop(name)
+		exitCode += scheduler.Destroy(name)
+	}
+	if exitCode == 0 {
+		if err := historyRecordStage(rollback, "rollback "+strconv.Itoa(target.Revision)); err != nil {
+			lg.Warn("unable to record the rollback in the deployment history: " + err.Error())
+		}
+	}
+	return
+}
+
+// Replaces a stage of the current app with the stage of a revision, writing its unit files
+// in the local app directory. Components are pinned to the image digests recorded in the
+// revision, matching its unit files.
+func historyRestoreStage(revision *MaestroRevision) (*MaestroStage, error) {
+	for i := range config.Stages {
+		if config.Stages[i].Name != revision.Stage.Name {
+			continue
+		}
+		config.Stages[i] = revision.Stage
+		stage := &config.Stages[i]
+		for k := range stage.Components {
+			// local paths depend on the host the revision was recorded on
+			component := &stage.Components[k]
+			component.UnitPath = config.GetUnitPath(component, "run")
+			if component.GitSrc != "" {
+				component.BuildUnitPath = config.GetUnitPath(component, "build")
+			}
+			content, ok := revision.Units[path.Base(component.UnitPath)]
+			if !ok {
+				return nil, fmt.Errorf("revision %d has no unit file for component %s", revision.Revision, component.Name)
+			}
+			if image := revision.Images[component.Name]; strings.Contains(image, "@") {
+				component.Src = image
+			}
+			if err := ioutil.WriteFile(component.UnitPath, []byte(content), 0644); err != nil {
+				return nil, err
+			}
+		}
+		return stage, nil
+	}
+	return nil, errors.New("stage " + revision.Stage.Name + " not found in current app")
+}
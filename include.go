@@ -0,0 +1,189 @@
+package maestro
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// A configuration file, converted to JSON, with variables interpolated.
+type configPart struct {
+	path string
+	data map[string]interface{}
+}
+
+// Reads configuration files and the files they include, merging them into a single JSON
+// configuration. Stages are merged by name and components are added to their stage, a
+// component defined in more than one file is an error. `app` and `username` can be set in
+// more than one file only if they have the same value.
+func MergeConfigFiles(paths []string) ([]byte, error) {
+	parts := []configPart{}
+	seen := map[string]string{}
+	for _, path := range paths {
+		read, err := readConfigFile(path, "", seen)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, read...)
+	}
+	root := map[string]interface{}{}
+	owners := map[string]string{}
+	for _, part := range parts {
+		if err := mergeConfigPart(root, part, owners); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(root)
+}
+
+// Reads a configuration file, followed by the files it includes. Include globs are
+// relative to the directory of the including file.
+func readConfigFile(path, includedBy string, seen map[string]string) ([]configPart, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	by := includedBy
+	if by == "" {
+		by = "command line"
+	}
+	if previous, ok := seen[abs]; ok {
+		return nil, fmt.Errorf("config file %s included more than once (by %s and %s)", path, previous, by)
+	}
+	seen[abs] = by
+	format := ConfigFormat(path)
+	lg.Debug2("maestro "+format+" config file is ", path)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = ConfigToJSON(data, format); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if data, err = InterpolateConfig(data); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	CheckConfigFields(path, data)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var object map[string]interface{}
+	if err := decoder.Decode(&object); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	parts := []configPart{{path: path, data: object}}
+	includes, _ := object["include"].([]interface{})
+	delete(object, "include")
+	for _, include := range includes {
+		pattern, _ := include.(string)
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: include %s: %s", path, include, err)
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, fmt.Errorf("%s: include %s: no such file", path, include)
+		}
+		for _, match := range matches {
+			lg.Debug2("including config file", match)
+			included, err := readConfigFile(match, path, seen)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, included...)
+		}
+	}
+	return parts, nil
+}
+
+// Merges a configuration file into `root`. `owners` maps every component to the file
+// defining it, to report conflicts.
+func mergeConfigPart(root map[string]interface{}, part configPart, owners map[string]string) error {
+	keys := []string{}
+	for key := range part.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := part.data[key]
+		switch key {
+		case "components":
+			components, _ := value.([]interface{})
+			merged, err := mergeComponents(root[key], components, "component %q", "components", part.path, owners)
+			if err != nil {
+				return err
+			}
+			root[key] = merged
+		case "stages":
+			stages, _ := value.([]interface{})
+			for _, item := range stages {
+				if err := mergeStage(root, item, part.path, owners); err != nil {
+					return err
+				}
+			}
+		default:
+			if previous, ok := root[key]; ok && !reflect.DeepEqual(previous, value) {
+				return fmt.Errorf("%s: conflicting %s %v, already set to %v in %s", part.path, key, value, previous, owners[key])
+			}
+			root[key] = value
+			if _, ok := owners[key]; !ok {
+				owners[key] = part.path
+			}
+		}
+	}
+	return nil
+}
+
+// Merges a stage into the stages of `root`, matching it by name.
+func mergeStage(root map[string]interface{}, item interface{}, path string, owners map[string]string) error {
+	stage, ok := item.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	stages, _ := root["stages"].([]interface{})
+	var target map[string]interface{}
+	for _, existing := range stages {
+		if existing.(map[string]interface{})["name"] == stage["name"] {
+			target = existing.(map[string]interface{})
+		}
+	}
+	if target == nil {
+		target = map[string]interface{}{"name": stage["name"]}
+		root["stages"] = append(stages, target)
+	}
+	for key, value := range stage {
+		if key != "components" {
+			target[key] = value
+			continue
+		}
+		components, _ := value.([]interface{})
+		merged, err := mergeComponents(target[key], components, fmt.Sprintf("component %%q in stage %q", stage["name"]),
+			fmt.Sprintf("stages/%v", stage["name"]), path, owners)
+		if err != nil {
+			return err
+		}
+		target[key] = merged
+	}
+	return nil
+}
+
+// Appends components to a list, failing if a component is already defined in another file.
+func mergeComponents(existing interface{}, components []interface{}, what, namespace, path string, owners map[string]string) ([]interface{}, error) {
+	merged, _ := existing.([]interface{})
+	for _, component := range components {
+		name := componentName(component)
+		key := namespace + "/" + name
+		if owner, ok := owners[key]; ok && name != "" && owner != path {
+			return nil, fmt.Errorf(what+" is defined in both %s and %s", name, owner, path)
+		}
+		owners[key] = path
+		merged = append(merged, component)
+	}
+	return merged, nil
+}
@@ -0,0 +1,347 @@
+package maestro
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Docker labels used to find back the unit a local container belongs to and the
+// hash of the unit it was created from.
+const (
+	localUnitLabel = "maestro.unit"
+	localHashLabel = "maestro.hash"
+)
+
+func init() {
+	RegisterScheduler("local", func() Scheduler { return NewLocalScheduler("docker") })
+}
+
+// Scheduler backend running app components as containers on the local docker daemon.
+// Units are mapped back to their components, so the same names used on the cluster
+// are used for local containers.
+type LocalScheduler struct {
+	Docker string
+}
+
+// Returns a local scheduler using the `docker` binary.
+func NewLocalScheduler(docker string) *LocalScheduler {
+	return &LocalScheduler{Docker: docker}
+}
+
+// Wrapper around docker, able to run every command. It uses two channels to communicate
+// output and return code of every command issued.
+func (l *LocalScheduler) Exec(args []string, output chan string, exit chan int) {
+	cmd := exec.Command(l.Docker, args...)
+	lg.Debug("docker args "+strings.Join(args, " "), "local")
+	exitCode := MaestroCommandExec(cmd, output)
+	lg.Debug("exit code: "+strconv.Itoa(exitCode), "local")
+	exit <- exitCode
+	close(exit)
+}
+
+// Runs docker printing its output.
+func (l *LocalScheduler) run(args ...string) int {
+	output := make(chan string)
+	exit := make(chan int)
+	go l.Exec(args, output, exit)
+	return FleetProcessOutput(output, exit)
+}
+
+// Runs docker returning its output lines.
+func (l *LocalScheduler) query(args ...string) (lines []string, exitCode int) {
+	output := make(chan string)
+	exit := make(chan int)
+	go l.Exec(args, output, exit)
+	for line := range output {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	exitCode = <-exit
+	return
+}
+
+// Finds the component and the instance number of a unit path or unit name.
+func (l *LocalScheduler) lookup(unitPath string) (*MaestroComponent, string, error) {
+	return config.GetUnitComponent(unitPath)
+}
+
+// Returns the unit name of a component instance.
+func (l *LocalScheduler) unitName(component *MaestroComponent, instance string) string {
+	return component.UnitName + instance + ".service"
+}
+
+// Returns the container name of a component instance.
+func (l *LocalScheduler) containerName(component *MaestroComponent, instance string) string {
+	return strings.Replace(component.ContainerName, "%i", instance, -1)
+}
+
+// Returns the local hostname, used in place of the coreos node name.
+func (l *LocalScheduler) hostname() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return hostname
+}
+
+// Builds the `docker create` arguments for a component instance, mirroring run-unit.tmpl.
+// Secrets are read from `envFile`, if set.
+func (l *LocalScheduler) createArgs(component *MaestroComponent, instance, envFile string) []string {
+	hostname := l.hostname()
+	id := "1"
+	if component.Scale > 1 {
+		id = instance
+	}
+	args := []string{"create", "--name", l.containerName(component, instance),
+		"--label", localUnitLabel + "=" + l.unitName(component, instance),
+		"--label", localHashLabel + "=" + l.unitHash(component)}
+	// docker can not both restart and remove a container on exit
+	if component.Restart != "" && component.Restart != "no" {
+		args = append(args, "--restart", component.Restart)
+	} else if !component.KeepOnExit {
+		args = append(args, "--rm")
+	}
+	args = append(args, strings.Fields(component.DockerArgs)...)
+	if component.Healthcheck != nil {
+		args = append(args, component.Healthcheck.DockerArgs()...)
+	}
+	if component.Memory != "" {
+		args = append(args, "--memory", component.Memory)
+	}
+	if component.CPUs != 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(component.CPUs, 'f', -1, 64))
+	}
+	for _, port := range component.Ports {
+		args = append(args, port.DockerArgs()...)
+	}
+	for _, volume := range component.Volumes {
+		args = append(args, "-v", volume)
+	}
+	for _, env := range component.Env {
+		args = append(args, "-e", env)
+	}
+	if envFile != "" {
+		args = append(args, "--env-file", envFile)
+	}
+	args = append(args,
+		"-e", "MAESTRO_NODE="+hostname,
+		"-e", "MAESTRO_USERNAME="+component.Username,
+		"-e", "MAESTRO_STAGE="+component.Stage,
+		"-e", "MAESTRO_APP="+component.App,
+		"-e", "MAESTRO_COMPONENT="+component.Name,
+		"-e", "MAESTRO_ID="+id,
+		"-e", "MAESTRO_FRONTEND="+boolEnv(component.Frontend),
+		"-e", "MAESTRO_DNS="+strings.Replace(strings.Replace(component.DNS, "."+domain, "", 1), "%H", hostname, -1),
+		"-e", "MAESTRO_GLOBAL="+boolEnv(component.Global),
+		component.Src)
+	return append(args, strings.Fields(component.Cmd)...)
+}
+
+// Returns the hash of the local unit file of a component.
+func (l *LocalScheduler) unitHash(component *MaestroComponent) string {
+	options, err := FleetLoadUnitOptions(component.UnitPath)
+	if err != nil {
+		lg.DebugError(err)
+		return ""
+	}
+	return GetUnitHash(options)
+}
+
+// Returns "true" or an empty string, as rendered by run-unit.tmpl.
+func boolEnv(value bool) string {
+	if value {
+		return "true"
+	}
+	return ""
+}
+
+// Returns the units a component instance depends on, started before it.
+func (l *LocalScheduler) dependencyUnits(component *MaestroComponent, instance string) []string {
+	units := []string{}
+	for _, unit := range component.AfterUnits {
+		units = append(units, strings.Replace(unit, "%i", instance, -1))
+	}
+	return units
+}
+
+// Creates the container of a unit, replacing any stale container with the same name.
+func (l *LocalScheduler) Submit(unitPath string) (exitCode int) {
+	component, instance, err := l.lookup(unitPath)
+	if err != nil {
+		lg.Error(err)
+		return 1
+	}
+	name := l.containerName(component, instance)
+	l.query("rm", "-f", name)
+	if len(component.Volumes) > 0 {
+		if err := os.MkdirAll(component.VolumesDir, 0755); err != nil {
+			lg.Error(err)
+		}
+	}
+	envFile := ""
+	if len(component.Secrets) > 0 {
+		if envFile, err = SecretsEnvFile(component); err != nil {
+			lg.Error(err)
+			return 1
+		}
+		// docker reads the env-file only on create
+		defer os.Remove(envFile)
+	}
+	exitCode = l.run(l.createArgs(component, instance, envFile)...)
+	if exitCode == 0 {
+		lg.Out(lg.b("local ") + "created " + name)
+	}
+	return
+}
+
+// Starts the container of a unit, starting first the unit it has to run after.
+func (l *LocalScheduler) Start(unitPath string) (exitCode int) {
+	component, instance, err := l.lookup(unitPath)
+	if err != nil {
+		lg.Error(err)
+		return 1
+	}
+	for _, dependency := range l.dependencyUnits(component, instance) {
+		if !l.IsRunning(dependency) {
+			lg.Debug("starting "+dependency+" first", "local")
+			exitCode += SchedulerRunUnit("", dependency)
+		}
+	}
+	name := l.containerName(component, instance)
+	if _, code := l.query("inspect", name); code != 0 {
+		exitCode += l.Submit(unitPath)
+	}
+	code := l.run("start", name)
+	if code == 0 {
+		lg.Out(lg.b("local ") + "started " + name)
+	}
+	return exitCode + code
+}
+
+func (l *LocalScheduler) Stop(unitPath string) int {
+	return l.container(unitPath, "stop")
+}
+
+func (l *LocalScheduler) Destroy(unitPath string) int {
+	return l.container(unitPath, "rm", "-f")
+}
+
+// Runs a docker command on the container of a unit.
+func (l *LocalScheduler) container(unitPath string, args ...string) int {
+	component, instance, err := l.lookup(unitPath)
+	if err != nil {
+		lg.Error(err)
+		return 1
+	}
+	return l.run(append(args, l.containerName(component, instance))...)
+}
+
+// Prints the container status. It returns 0 if the container is running, 3 if it exists
+// but it is not running and 1 if it does not exist.
+func (l *LocalScheduler) Status(unitPath string) int {
+	component, instance, err := l.lookup(unitPath)
+	if err != nil {
+		lg.Error(err)
+		return 1
+	}
+	name := l.containerName(component, instance)
+	lines, exitCode := l.query("inspect", "-f", "{{.State.Status}} {{.Id}}", name)
+	if exitCode != 0 || len(lines) == 0 {
+		lg.Out("container " + lg.b(name) + " not found")
+		return 1
+	}
+	lg.Out(lg.b("docker ") + name + " " + lines[0])
+	if strings.HasPrefix(lines[0], "running") {
+		return 0
+	}
+	return 3
+}
+
+// Prints the container logs.
+func (l *LocalScheduler) Journal(unitPath string, follow, all bool) int {
+	args := []string{"logs"}
+	if follow {
+		args = append(args, "-f")
+	} else if !all {
+		args = append(args, "--tail", "10")
+	}
+	return l.container(unitPath, args...)
+}
+
+func (l *LocalScheduler) List(prefix string) (names []string, err error) {
+	lines, exitCode := l.query("ps", "-a", "--filter", "label="+localUnitLabel, "--format", "{{.Label \""+localUnitLabel+"\"}}")
+	if exitCode != 0 {
+		return nil, errors.New("docker ps exited with code " + strconv.Itoa(exitCode))
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(line, prefix) {
+			names = append(names, line)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+func (l *LocalScheduler) IsRunning(unitPath string) bool {
+	component, instance, err := l.lookup(unitPath)
+	if err != nil {
+		lg.DebugError(err)
+		return false
+	}
+	lines, exitCode := l.query("inspect", "-f", "{{.State.Running}}", l.containerName(component, instance))
+	return exitCode == 0 && len(lines) > 0 && lines[0] == "true"
+}
+
+// Maps the container state to a systemd like active state.
+func (l *LocalScheduler) State(unitPath string) string {
+	component, instance, err := l.lookup(unitPath)
+	if err != nil {
+		lg.DebugError(err)
+		return ""
+	}
+	lines, exitCode := l.query("inspect", "-f", "{{.State.Status}} {{.State.ExitCode}} {{if .State.Health}}{{.State.Health.Status}}{{end}}",
+		l.containerName(component, instance))
+	if exitCode != 0 || len(lines) == 0 {
+		return ""
+	}
+	fields := strings.Fields(lines[0])
+	switch fields[0] {
+	case "running":
+		if len(fields) > 2 && fields[2] == "starting" {
+			return "activating"
+		}
+		if len(fields) > 2 && fields[2] == "unhealthy" {
+			return "failed"
+		}
+		return "active"
+	case "created", "restarting":
+		return "activating"
+	case "exited", "dead":
+		if len(fields) > 1 && fields[1] != "0" {
+			return "failed"
+		}
+	}
+	return "inactive"
+}
+
+func (l *LocalScheduler) Changed(unitPath string) bool {
+	component, instance, err := l.lookup(unitPath)
+	if err != nil {
+		lg.DebugError(err)
+		return false
+	}
+	lines, exitCode := l.query("inspect", "-f", "{{index .Config.Labels \""+localHashLabel+"\"}}", l.containerName(component, instance))
+	if exitCode != 0 {
+		return false
+	}
+	hash := ""
+	if len(lines) > 0 {
+		hash = lines[0]
+	}
+	return hash != l.unitHash(component)
+}
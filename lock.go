@@ -0,0 +1,215 @@
+package maestro
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// Default time to live of the deploy lock, refreshed while the command holding it runs.
+	LockDefaultTTL = time.Minute
+	// Shortest interval between two refreshes of the deploy lock.
+	lockMinRefresh = time.Second
+)
+
+var lockTTL = LockDefaultTTL
+
+// MaestroLock structure. Holder of the deploy lock of an app stage, with the seconds left
+// before the lock expires.
+type MaestroLock struct {
+	User    string    `json:"user"`
+	Host    string    `json:"host"`
+	PID     int       `json:"pid"`
+	Command string    `json:"command"`
+	Time    time.Time `json:"time"`
+	TTL     int64     `json:"ttl,omitempty"`
+}
+
+// Describes the holder of a lock.
+func (l *MaestroLock) String() string {
+	s := fmt.Sprintf("%s@%s (%s, pid %d) since %s", l.User, l.Host, l.Command, l.PID, l.Time.Local().Format("2006-01-02 15:04:05"))
+	if l.TTL > 0 {
+		s += ", expiring in " + strconv.FormatInt(l.TTL, 10) + "s"
+	}
+	return s
+}
+
+// Returns true if the lock is held by the current user on this host.
+func (l *MaestroLock) Mine() bool {
+	host, _ := os.Hostname()
+	return l.User == historyUser() && l.Host == host
+}
+
+// Setup the time to live of the deploy lock, 0 disables locking.
+func SetupLock(ttl time.Duration) {
+	if ttl < 0 {
+		lg.Fatal(errors.New("lock time to live can not be negative, use 0 to disable the deploy lock"))
+	}
+	lockTTL = ttl
+}
+
+// Deploy locks held on the stages of the current app while a command changes them.
+type AppLock struct {
+	value string
+	ttl   time.Duration
+	keys  []string
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// Locks every stage of the current app for `command`, failing if another user holds the
+// lock of any of them. Locks are refreshed until Unlock is called. Apps run by the local
+// backend are not locked.
+func LockApp(command string) (lock *AppLock, exitCode int) {
+	lock = &AppLock{ttl: lockTTL}
+	if _, ok := scheduler.(*FleetScheduler); !ok || lockTTL == 0 {
+		return
+	}
+	host, _ := os.Hostname()
+	data, _ := json.Marshal(&MaestroLock{User: historyUser(), Host: host, PID: os.Getpid(), Command: command, Time: time.Now().UTC()})
+	lock.value = string(data)
+	for _, stage := range config.Stages {
+		key := config.GetLockKey(stage.Name)
+		err := etcdClient.Create(key, lock.value, lock.seconds())
+		if err == ErrEtcdKeyExists {
+			err = errors.New("stage " + stage.Name + " of " + config.Username + "/" + config.App + " is locked")
+			if holder, _ := LockHolder(stage.Name); holder != nil {
+				err = errors.New(err.Error() + " by " + holder.String())
+			}
+			err = errors.New(err.Error() + ", if the lock is stale remove it with " + lg.b("maestro unlock --force"))
+		}
+		if err != nil {
+			lock.Unlock()
+			lg.Error(err)
+			return lock, 1
+		}
+		lg.Debug("locked "+key, "lock", stage.Name)
+		lock.keys = append(lock.keys, key)
+	}
+	lock.stop = make(chan struct{})
+	lock.done = make(chan struct{})
+	go lock.refresh()
+	return
+}
+
+// Time to live of the lock in seconds.
+func (l *AppLock) seconds() int64 {
+	if ttl := int64(l.ttl.Seconds()); ttl > 0 {
+		return ttl
+	}
+	return 1
+}
+
+// Refreshes the locks every third of their time to live, at most once a second.
+func (l *AppLock) refresh() {
+	defer close(l.done)
+	interval := l.ttl / 3
+	if interval < lockMinRefresh {
+		interval = lockMinRefresh
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			for _, key := range l.keys {
+				if err := etcdClient.Refresh(key, l.value, l.seconds()); err != nil {
+					lg.Warn("unable to refresh the lock " + key + ": " + err.Error())
+				}
+			}
+		}
+	}
+}
+
+// Releases the locks, unless another user took them over.
+func (l *AppLock) Unlock() {
+	if l.stop != nil {
+		close(l.stop)
+		<-l.done
+		l.stop = nil
+	}
+	for _, key := range l.keys {
+		err := etcdClient.CompareAndDelete(key, l.value)
+		if err == ErrEtcdCompareFailed {
+			lg.Warn("lock " + key + " was taken over by someone else, leaving it")
+		} else if err != nil && err != ErrEtcdKeyNotFound {
+			lg.Warn("unable to release the lock " + key + ": " + err.Error())
+		}
+	}
+	l.keys = nil
+}
+
+// Returns the holder of the lock of a stage, nil if it is not locked.
+func LockHolder(stage string) (*MaestroLock, error) {
+	kv, err := etcdClient.Get(config.GetLockKey(stage))
+	if err != nil || kv == nil {
+		return nil, err
+	}
+	holder := &MaestroLock{}
+	if err := json.Unmarshal([]byte(kv.Value), holder); err != nil {
+		return nil, fmt.Errorf("invalid lock %s: %s", kv.Key, err)
+	}
+	holder.TTL = kv.TTL
+	return holder, nil
+}
+
+// Prints who holds the lock of every stage of the current app.
+func MaestroLockStatus() (exitCode int) {
+	for _, stage := range config.Stages {
+		holder, err := LockHolder(stage.Name)
+		if err != nil {
+			lg.Error(err)
+			exitCode = 1
+			continue
+		}
+		if holder == nil {
+			lg.Out("stage " + lg.y(stage.Name) + " is " + lg.g("unlocked"))
+		} else {
+			lg.Out("stage " + lg.y(stage.Name) + " is " + lg.r("locked") + " by " + holder.String())
+		}
+	}
+	return
+}
+
+// Removes the lock of a stage, or of every stage if `stage` is empty. Locks held by other
+// users, or by the current user on another host, are only removed with `force`.
+func MaestroUnlock(stage string, force bool) (exitCode int) {
+	stages := []string{}
+	if stage != "" {
+		if _, err := config.Stage(stage); err != nil {
+			lg.Error(err)
+			return 1
+		}
+		stages = append(stages, stage)
+	}
+	for _, s := range config.Stages {
+		if stage == "" {
+			stages = append(stages, s.Name)
+		}
+	}
+	for _, stage := range stages {
+		holder, err := LockHolder(stage)
+		if err == nil && holder == nil {
+			continue
+		}
+		if err == nil && !force && !holder.Mine() {
+			err = errors.New("stage " + stage + " is locked by " + holder.String() + ", use --force to remove the lock")
+		}
+		if err == nil {
+			err = etcdClient.Delete(config.GetLockKey(stage))
+		}
+		if err != nil && err != ErrEtcdKeyNotFound {
+			lg.Error(err)
+			exitCode = 1
+			continue
+		}
+		lg.Out("stage " + lg.y(stage) + " " + lg.g("unlocked"))
+	}
+	return
+}
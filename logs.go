@@ -115,6 +115,11 @@ func (l MaestroLog) Error(err error) {
 	}
 }
 
+// Logs a warning
+func (l MaestroLog) Warn(msg string) {
+	l.output.Printf("%s: %s", l.y("WARNING"), msg)
+}
+
 // Logs an error and gracefully exit
 func (l MaestroLog) Fatal(err error) {
 	if err != nil {
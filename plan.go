@@ -0,0 +1,188 @@
+package maestro
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// Plan actions for a single unit.
+const (
+	PlanCreate    = "create"
+	PlanReplace   = "replace"
+	PlanDestroy   = "destroy"
+	PlanUnchanged = "unchanged"
+)
+
+// Change a run would apply to a single unit.
+type PlanUnit struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	Diff   string `json:"diff,omitempty"`
+}
+
+// Changes a run would apply to the cluster.
+type Plan struct {
+	Create    []string   `json:"create"`
+	Replace   []string   `json:"replace"`
+	Destroy   []string   `json:"destroy"`
+	Unchanged []string   `json:"unchanged"`
+	Units     []PlanUnit `json:"units"`
+}
+
+// Returns true if applying the plan would change anything.
+func (p *Plan) HasChanges() bool {
+	return len(p.Create)+len(p.Replace)+len(p.Destroy) > 0
+}
+
+// Renders in memory all run units of the current app, indexed by unit name and
+// normalized as fleet stores them.
+func PlanLocalUnits() map[string]string {
+	units := map[string]string{}
+	for _, stage := range config.Stages {
+		for _, component := range stage.Components {
+			content := SerializeUnitOptions(ParseUnitFile(RenderUnitTmpl(component, component.Name, "run-unit.tmpl")))
+			for i := 1; i < component.Scale+1; i++ {
+				units[config.GetUnitName(&component, strconv.Itoa(i))+".service"] = content
+			}
+		}
+	}
+	return units
+}
+
+// Fetches from fleet all run units of the current app, indexed by unit name.
+func PlanRemoteUnits() (map[string]string, error) {
+	units := map[string]string{}
+	remote, err := fleetClient.Units()
+	if err != nil {
+		return nil, err
+	}
+	for _, unit := range remote {
+		if strings.HasSuffix(unit.Name, "-build.service") {
+			continue
+		}
+		for _, stage := range config.Stages {
+			if strings.HasPrefix(unit.Name, config.GetAppPrefix(stage.Name)) {
+				units[unit.Name] = SerializeUnitOptions(unit.Options)
+			}
+		}
+	}
+	return units, nil
+}
+
+// Compares local and remote units, returning the plan to go from remote to local.
+func PlanUnits(local, remote map[string]string) (plan *Plan) {
+	plan = &Plan{Create: []string{}, Replace: []string{}, Destroy: []string{}, Unchanged: []string{}, Units: []PlanUnit{}}
+	names := []string{}
+	for name := range local {
+		names = append(names, name)
+	}
+	for name := range remote {
+		if _, ok := local[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		localUnit, isLocal := local[name]
+		remoteUnit, isRemote := remote[name]
+		unit := PlanUnit{Name: name}
+		switch {
+		case !isRemote:
+			unit.Action = PlanCreate
+			plan.Create = append(plan.Create, name)
+		case !isLocal:
+			unit.Action = PlanDestroy
+			plan.Destroy = append(plan.Destroy, name)
+		case localUnit != remoteUnit:
+			unit.Action = PlanReplace
+			plan.Replace = append(plan.Replace, name)
+		default:
+			unit.Action = PlanUnchanged
+			plan.Unchanged = append(plan.Unchanged, name)
+		}
+		if unit.Action != PlanUnchanged {
+			unit.Diff = UnitDiff(name, remoteUnit, localUnit)
+		}
+		plan.Units = append(plan.Units, unit)
+	}
+	return
+}
+
+// Returns an unified diff between the unit known to fleet and the local one.
+func UnitDiff(name, remote, local string) string {
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(remote),
+		B:        difflib.SplitLines(local),
+		FromFile: "fleet/" + name,
+		ToFile:   "local/" + name,
+		Context:  3,
+	})
+	lg.DebugError(err)
+	return diff
+}
+
+// Prints what a run of the current app would change on the cluster, either as
+// colored unified diffs or as JSON. With `detailed` the exit code is 2 when there are changes.
+func MaestroPlan(asJSON, detailed bool) (exitCode int) {
+	if _, ok := scheduler.(*FleetScheduler); !ok {
+		lg.Error(errors.New("plan is only available with the fleet backend"))
+		return 1
+	}
+	remote, err := PlanRemoteUnits()
+	if err != nil {
+		lg.Error(err)
+		return 1
+	}
+	plan := PlanUnits(PlanLocalUnits(), remote)
+	if detailed && plan.HasChanges() {
+		exitCode = 2
+	}
+	if asJSON {
+		data, _ := json.MarshalIndent(plan, "", "    ")
+		lg.Out(string(data))
+		return
+	}
+	for _, unit := range plan.Units {
+		if unit.Action == PlanUnchanged {
+			continue
+		}
+		lg.Out(lg.b("maestro ") + PlanColor(unit.Action) + " " + unit.Name)
+		for _, line := range strings.Split(strings.TrimRight(unit.Diff, "\n"), "\n") {
+			switch {
+			case strings.HasPrefix(line, "+++") || strings.HasPrefix(line, "---"):
+				lg.Out(lg.b(line))
+			case strings.HasPrefix(line, "+"):
+				lg.Out(lg.g(line))
+			case strings.HasPrefix(line, "-"):
+				lg.Out(lg.r(line))
+			case strings.HasPrefix(line, "@@"):
+				lg.Out(lg.c(line))
+			default:
+				lg.Out(line)
+			}
+		}
+		lg.Out("")
+	}
+	lg.Out(lg.b("maestro ") + "plan: " + lg.g(strconv.Itoa(len(plan.Create))) + " to create, " +
+		lg.y(strconv.Itoa(len(plan.Replace))) + " to replace, " + lg.r(strconv.Itoa(len(plan.Destroy))) +
+		" to destroy, " + strconv.Itoa(len(plan.Unchanged)) + " unchanged")
+	return
+}
+
+// Returns a colored plan action.
+func PlanColor(action string) string {
+	switch action {
+	case PlanCreate:
+		return lg.g(action)
+	case PlanReplace:
+		return lg.y(action)
+	case PlanDestroy:
+		return lg.r(action)
+	}
+	return action
+}
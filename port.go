@@ -0,0 +1,155 @@
+package maestro
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Protocols docker can publish ports with.
+var portProtocols = []string{"tcp", "udp", "sctp"}
+
+// MaestroPort structure. A port is written in the configuration either as a number, only
+// exposed to the other containers, or as a "[host_ip:][host_port:]port[/protocol]" string,
+// published on the host when host_port is set.
+type MaestroPort struct {
+	HostIP   string
+	HostPort int
+	Port     int
+	Protocol string
+}
+
+// Parses a port in the "[host_ip:][host_port:]port[/protocol]" syntax used by `docker run -p`.
+func ParsePort(s string) (port MaestroPort, err error) {
+	invalid := fmt.Errorf("invalid port %q, expected [host_ip:][host_port:]port[/protocol]", s)
+	spec := s
+	if i := strings.LastIndex(spec, "/"); i != -1 {
+		spec, port.Protocol = spec[:i], spec[i+1:]
+	}
+	if strings.HasPrefix(spec, "[") {
+		end := strings.Index(spec, "]:")
+		if end == -1 {
+			return port, invalid
+		}
+		port.HostIP, spec = spec[1:end], spec[end+2:]
+		if !strings.Contains(spec, ":") {
+			return port, invalid
+		}
+	}
+	parts := strings.Split(spec, ":")
+	if port.HostIP == "" && len(parts) == 3 {
+		port.HostIP, parts = parts[0], parts[1:]
+	}
+	if len(parts) > 2 {
+		return port, invalid
+	}
+	if len(parts) == 2 {
+		if port.HostPort, err = strconv.Atoi(parts[0]); err != nil {
+			return port, invalid
+		}
+	}
+	if port.Port, err = strconv.Atoi(parts[len(parts)-1]); err != nil {
+		return port, invalid
+	}
+	return port, nil
+}
+
+// Returns true if the port is published on the host.
+func (p MaestroPort) Published() bool {
+	return p.HostPort != 0
+}
+
+// Returns the port in the "[host_ip:][host_port:]port[/protocol]" syntax.
+func (p MaestroPort) String() string {
+	s := strconv.Itoa(p.Port)
+	if p.Published() {
+		s = strconv.Itoa(p.HostPort) + ":" + s
+		if strings.Contains(p.HostIP, ":") {
+			s = "[" + p.HostIP + "]:" + s
+		} else if p.HostIP != "" {
+			s = p.HostIP + ":" + s
+		}
+	}
+	if p.Protocol != "" {
+		s += "/" + p.Protocol
+	}
+	return s
+}
+
+// Returns the `docker run` arguments exposing or publishing the port.
+func (p MaestroPort) DockerArgs() []string {
+	if p.Published() {
+		return []string{"-p", p.String()}
+	}
+	return []string{"--expose", p.String()}
+}
+
+// Returns true if two ports can not be published on the same host.
+func (p MaestroPort) Conflicts(other MaestroPort) bool {
+	if !p.Published() || p.HostPort != other.HostPort || p.protocol() != other.protocol() {
+		return false
+	}
+	return p.HostIP == "" || other.HostIP == "" || p.HostIP == other.HostIP
+}
+
+func (p MaestroPort) protocol() string {
+	if p.Protocol == "" {
+		return "tcp"
+	}
+	return p.Protocol
+}
+
+// Validates a port.
+func (p MaestroPort) Validate() (errs []error) {
+	if p.Port < 1 || p.Port > 65535 {
+		errs = append(errs, fmt.Errorf("invalid port %d", p.Port))
+	}
+	if p.HostPort < 0 || p.HostPort > 65535 {
+		errs = append(errs, fmt.Errorf("invalid host port %d", p.HostPort))
+	}
+	if p.HostIP != "" && net.ParseIP(p.HostIP) == nil {
+		errs = append(errs, fmt.Errorf("invalid host ip %q", p.HostIP))
+	}
+	if p.HostIP != "" && !p.Published() {
+		errs = append(errs, fmt.Errorf("port %s binds a host ip without a host port", p))
+	}
+	if p.Protocol != "" && !stringIn(p.Protocol, portProtocols) {
+		errs = append(errs, fmt.Errorf("invalid protocol %q, expected one of %s", p.Protocol, strings.Join(portProtocols, ", ")))
+	}
+	return
+}
+
+// Reads a port written either as a number or as a string.
+func (p *MaestroPort) UnmarshalJSON(data []byte) (err error) {
+	var number int
+	if err = json.Unmarshal(data, &number); err == nil {
+		*p = MaestroPort{Port: number}
+		return
+	}
+	var s string
+	if err = json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid port %s, expected a number or a string", data)
+	}
+	*p, err = ParsePort(s)
+	return
+}
+
+// Writes exposed ports as numbers, as they used to be, and the other ones as strings.
+func (p MaestroPort) MarshalJSON() ([]byte, error) {
+	if !p.Published() && p.Protocol == "" {
+		return json.Marshal(p.Port)
+	}
+	return json.Marshal(p.String())
+}
+
+// Ports are either a number or a "[host_ip:][host_port:]port[/protocol]" string.
+func (p MaestroPort) JSONSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"oneOf": []interface{}{
+			map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 65535},
+			map[string]interface{}{"type": "string", "pattern": `^((\[[0-9a-fA-F:.]+\]|[0-9.]+):)?([0-9]+:)?[0-9]+(/(tcp|udp|sctp))?$`},
+		},
+	}
+}
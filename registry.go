@@ -0,0 +1,140 @@
+package maestro
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	registryDockerHub = "registry-1.docker.io"
+	registryTimeout   = 10 * time.Second
+)
+
+// Manifest types accepted when resolving image digests.
+var registryManifestTypes = []string{
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+// HTTP client used to talk to docker registries.
+var registryHTTP = &http.Client{Timeout: registryTimeout}
+
+// Splits an image reference into registry, repository and tag or digest, e.g.
+// hub.maestro.io:5000/crisidev/grafana:v2 into hub.maestro.io:5000, crisidev/grafana and v2.
+// Images without registry are on the docker hub.
+func ParseImage(src string) (registry, repository, reference string) {
+	name := src
+	reference = "latest"
+	if i := strings.Index(name, "@"); i != -1 {
+		name, reference = name[:i], name[i+1:]
+	} else if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, reference = name[:i], name[i+1:]
+	}
+	registry = registryDockerHub
+	if i := strings.Index(name, "/"); i != -1 && (strings.ContainsAny(name[:i], ".:") || name[:i] == "localhost") {
+		registry, name = name[:i], name[i+1:]
+	}
+	if registry == registryDockerHub && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	return registry, name, reference
+}
+
+// Returns the digest of an image, e.g. sha256:..., asking its registry through the docker
+// registry v2 API. Registries are reached through https, falling back to http.
+func ImageDigest(src string) (string, error) {
+	registry, repository, reference := ParseImage(src)
+	if strings.Contains(reference, ":") {
+		return reference, nil
+	}
+	var err error
+	for _, scheme := range []string{"https://", "http://"} {
+		var digest string
+		u := scheme + registry + "/v2/" + repository + "/manifests/" + reference
+		if digest, err = registryManifestDigest(u, ""); err == nil {
+			return digest, nil
+		}
+		lg.DebugError(err)
+	}
+	return "", fmt.Errorf("unable to resolve the digest of %s: %s", src, err)
+}
+
+// Asks the digest of the manifest at `u`, getting an anonymous token if the registry
+// requires one.
+func registryManifestDigest(u, token string) (string, error) {
+	req, err := http.NewRequest("HEAD", u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", strings.Join(registryManifestTypes, ", "))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	lg.Debug("HEAD "+u, "registry")
+	resp, err := registryHTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	challenge := resp.Header.Get("Www-Authenticate")
+	if resp.StatusCode == http.StatusUnauthorized && token == "" && strings.HasPrefix(challenge, "Bearer ") {
+		if token, err = registryToken(challenge); err != nil {
+			return "", err
+		}
+		return registryManifestDigest(u, token)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry returned %d for %s", resp.StatusCode, u)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", errors.New("registry returned no digest for " + u)
+	}
+	return digest, nil
+}
+
+// Gets an anonymous token for a bearer challenge, e.g.
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="...".
+func registryToken(challenge string) (string, error) {
+	params := map[string]string{}
+	for _, param := range strings.Split(strings.TrimPrefix(challenge, "Bearer "), ",") {
+		if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+	if params["realm"] == "" {
+		return "", errors.New("invalid registry challenge " + challenge)
+	}
+	query := url.Values{}
+	for _, name := range []string{"service", "scope"} {
+		if params[name] != "" {
+			query.Set(name, params[name])
+		}
+	}
+	resp, err := registryHTTP.Get(params["realm"] + "?" + query.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry token request returned %d", resp.StatusCode)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token == "" {
+		body.Token = body.AccessToken
+	}
+	return body.Token, nil
+}
@@ -0,0 +1,103 @@
+package maestro
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Changes the number of running instances of a component, without editing the configuration.
+// Missing instances up to `scale` are started, while instances with a higher index found on
+// the backend, either surplus or orphaned by a previous run, are stopped and destroyed.
+func MaestroScale(name string, scale int) (exitCode int) {
+	if scale < 0 {
+		lg.Error(errors.New("scale must be at least 0"))
+		return 1
+	}
+	found := false
+	defer DNSSync()
+	for i := range config.Stages {
+		stage := &config.Stages[i]
+		for k := range stage.Components {
+			component := &stage.Components[k]
+			if component.Name != name {
+				continue
+			}
+			found = true
+			if component.Global {
+				lg.Error(errors.New("component " + name + " is global, it can not be scaled"))
+				return 1
+			}
+			lg.Out(lg.b("maestro ") + "scaling " + lg.y(stage.Name) + "/" + lg.b(component.Name) +
+				" from " + strconv.Itoa(component.Scale) + " to " + strconv.Itoa(scale))
+			units := scaleDependencyUnits(stage)
+			config.SetComponentScale(component, scale)
+			ProcessUnitTmpl(*component, component.Name, component.UnitPath, "run-unit.tmpl")
+			for i := 1; i < component.Scale+1; i++ {
+				exitCode += SchedulerRunUnit("", config.GetNumberedUnitPath(component.UnitPath, strconv.Itoa(i)))
+			}
+			// dependents stop referencing the removed instances before they are destroyed
+			exitCode += scaleReplaceDependents(stage, component, units)
+			exitCode += ScaleDownComponent(component)
+		}
+	}
+	if !found {
+		lg.Error(errors.New("component " + name + " not found in current app"))
+		return 1
+	}
+	if exitCode == 0 {
+		HistoryRecord("scale " + name + " " + strconv.Itoa(scale))
+	}
+	return
+}
+
+// Returns the units every component of a stage depends on or runs next to, by component.
+func scaleDependencyUnits(stage *MaestroStage) map[string]string {
+	units := map[string]string{}
+	for _, component := range stage.Components {
+		units[component.Name] = fmt.Sprint(component.AfterUnits, component.RequiresUnits,
+			component.BindsToUnits, component.WantsUnits, component.AffinityUnit)
+	}
+	return units
+}
+
+// Renders again the components of a stage whose dependency or affinity units changed since
+// `units` were taken, after scaling `scaled`, replacing their submitted instances.
+func scaleReplaceDependents(stage *MaestroStage, scaled *MaestroComponent, units map[string]string) (exitCode int) {
+	current := scaleDependencyUnits(stage)
+	for k := range stage.Components {
+		component := &stage.Components[k]
+		if component.Name == scaled.Name || current[component.Name] == units[component.Name] {
+			continue
+		}
+		lg.Out("dependencies of " + lg.b(component.Name) + " changed, updating its units")
+		ProcessUnitTmpl(*component, component.Name, component.UnitPath, "run-unit.tmpl")
+		for i := 1; i < component.Scale+1; i++ {
+			// instances which are not submitted are left alone
+			if unitPath := config.GetNumberedUnitPath(component.UnitPath, strconv.Itoa(i)); scheduler.Changed(unitPath) {
+				exitCode += SchedulerRunUnit("", unitPath)
+			}
+		}
+	}
+	return
+}
+
+// Stops and destroys the instances of a component with an index higher than its scale.
+func ScaleDownComponent(component *MaestroComponent) (exitCode int) {
+	units, err := scheduler.List(component.UnitName)
+	if err != nil {
+		lg.Error(err)
+		return 1
+	}
+	for _, unit := range units {
+		index, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(unit, component.UnitName), ".service"))
+		if err != nil || index <= component.Scale {
+			continue
+		}
+		lg.Out("unit " + lg.b(unit) + " is over scale, removing it")
+		exitCode += scheduler.Stop(unit)
+		exitCode += scheduler.Destroy(unit)
+	}
+	return
+}
@@ -0,0 +1,146 @@
+package maestro
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backend able to run the units of an app. Every method taking a unit path accepts
+// either a local numbered unit path or a bare unit name and returns an exit code.
+type Scheduler interface {
+	// Submits a unit to the backend without starting it.
+	Submit(unitPath string) int
+	// Starts a unit, submitting it if needed.
+	Start(unitPath string) int
+	// Stops a unit, keeping it submitted.
+	Stop(unitPath string) int
+	// Stops and removes a unit from the backend.
+	Destroy(unitPath string) int
+	// Prints the status of a unit.
+	Status(unitPath string) int
+	// Prints the journal of a unit.
+	Journal(unitPath string, follow, all bool) int
+	// Returns the sorted names of units known to the backend starting with `prefix`.
+	List(prefix string) ([]string, error)
+	// Checks if a unit is running or starting.
+	IsRunning(unitPath string) bool
+	// Returns the systemd like active state of a unit (active, activating, inactive, failed),
+	// or an empty string if the unit is unknown.
+	State(unitPath string) string
+	// Checks if the unit known to the backend differs from the local unit file.
+	// Units unknown to the backend are not changed.
+	Changed(unitPath string) bool
+}
+
+// Backend used when none is selected.
+const defaultScheduler = "fleet"
+
+var (
+	scheduler  Scheduler
+	schedulers = map[string]func() Scheduler{}
+)
+
+// Registers a scheduler backend constructor under `name`, making it available to SetupScheduler.
+func RegisterScheduler(name string, fn func() Scheduler) {
+	schedulers[name] = fn
+}
+
+// Returns the sorted names of the registered scheduler backends.
+func SchedulerNames() (names []string) {
+	for name := range schedulers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Selects the scheduler backend used by all app commands.
+func SetupScheduler(name string) {
+	fn, ok := schedulers[name]
+	if !ok {
+		lg.Fatal(errors.New("unknown backend " + name + ", available: " + strings.Join(SchedulerNames(), ", ")))
+	}
+	lg.Debug("using backend "+name, "scheduler")
+	scheduler = fn()
+}
+
+// Runs a unit with the current scheduler, unless it is already running. A unit whose
+// local content changed since it was submitted is destroyed and submitted again.
+func SchedulerRunUnit(_, unitPath string) (exitCode int) {
+	if scheduler.Changed(unitPath) {
+		lg.Out("unit " + lg.b(unitPath) + " changed, replacing it")
+		exitCode += scheduler.Destroy(unitPath)
+	} else if scheduler.IsRunning(unitPath) {
+		return
+	}
+	exitCode += scheduler.Submit(unitPath)
+	exitCode += scheduler.Start(unitPath)
+	return
+}
+
+// Dispatches a command (stop, destroy, status, journal, journalf, journala) to the current scheduler.
+func SchedulerCommand(cmd, unitPath string) (exitCode int) {
+	switch cmd {
+	case "submit":
+		return scheduler.Submit(unitPath)
+	case "start":
+		return scheduler.Start(unitPath)
+	case "stop":
+		return scheduler.Stop(unitPath)
+	case "destroy":
+		return scheduler.Destroy(unitPath)
+	case "status":
+		return scheduler.Status(unitPath)
+	case "journal":
+		return scheduler.Journal(unitPath, false, false)
+	case "journalf":
+		return scheduler.Journal(unitPath, true, false)
+	case "journala":
+		return scheduler.Journal(unitPath, false, true)
+	}
+	lg.Error(errors.New("unknown command " + cmd))
+	return 1
+}
+
+// Interval between two checks of units state.
+var schedulerPollInterval = 2 * time.Second
+
+// Waits until all units are active, printing the state of pending units when it changes.
+// It returns the state of the units which failed or which did not become active before
+// `timeout`, an empty map if all units are active.
+func SchedulerWaitActive(units []string, timeout time.Duration) map[string]string {
+	deadline := time.Now().Add(timeout)
+	pending := map[string]string{}
+	printed := map[string]string{}
+	for _, unit := range units {
+		pending[unit] = ""
+	}
+	for {
+		for unit := range pending {
+			state := scheduler.State(unit)
+			switch state {
+			case "active":
+				lg.Debug("unit "+unit+" is active", "scheduler")
+				delete(pending, unit)
+			case "failed":
+				return map[string]string{unit: state}
+			default:
+				pending[unit] = state
+				if seen, ok := printed[unit]; !ok || seen != state {
+					if state == "" {
+						state = "unknown"
+					}
+					lg.Out("unit " + lg.b(strings.TrimSuffix(path.Base(unit), ".service")) + " is " + lg.y(state) + ", waiting")
+					printed[unit] = pending[unit]
+				}
+			}
+		}
+		if len(pending) == 0 || time.Now().After(deadline) {
+			return pending
+		}
+		time.Sleep(schedulerPollInterval)
+	}
+}
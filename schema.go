@@ -0,0 +1,271 @@
+package maestro
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Struct tag used to mark fields which are required in the configuration
+// (`maestro:"required"`) or computed by maestro and not read from it (`maestro:"computed"`).
+const (
+	schemaTag      = "maestro"
+	schemaRequired = "required"
+	schemaComputed = "computed"
+	schemaDraft    = "http://json-schema.org/draft-07/schema#"
+)
+
+// Warn instead of failing when the configuration contains unknown fields.
+var laxConfig bool
+
+// Types implementing SchemaType describe their own JSON schema, used for fields which
+// accept more than one JSON representation.
+type SchemaType interface {
+	JSONSchema() map[string]interface{}
+}
+
+var schemaTypeInterface = reflect.TypeOf((*SchemaType)(nil)).Elem()
+
+// Setup unknown fields handling while loading the configuration.
+func SetupConfigCheck(lax bool) {
+	laxConfig = lax
+}
+
+// Generates the JSON schema of the configuration file.
+func MaestroSchema() map[string]interface{} {
+	schema := schemaOf(reflect.TypeOf(MaestroConfig{}))
+	schema["$schema"] = schemaDraft
+	schema["title"] = "maestro configuration"
+	return schema
+}
+
+// Prints the JSON schema of the configuration file.
+func MaestroPrintSchema() (exitCode int) {
+	data, _ := json.MarshalIndent(MaestroSchema(), "", "    ")
+	lg.Out(string(data))
+	return
+}
+
+// Builds the schema of a Go type, following the json tags of structs.
+func schemaOf(t reflect.Type) map[string]interface{} {
+	if custom, ok := schemaCustom(t); ok {
+		return custom.JSONSchema()
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		required := []string{}
+		for _, field := range schemaFields(t) {
+			properties[field.name] = schemaOf(field.Type)
+			if field.required {
+				required = append(required, field.name)
+			}
+		}
+		schema := map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		if len(required) > 0 {
+			sort.Strings(required)
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]interface{}{}
+}
+
+// Returns the SchemaType implementation of a type, if any.
+func schemaCustom(t reflect.Type) (SchemaType, bool) {
+	if t.Implements(schemaTypeInterface) {
+		custom, ok := reflect.Zero(t).Interface().(SchemaType)
+		return custom, ok
+	}
+	if reflect.PtrTo(t).Implements(schemaTypeInterface) {
+		return reflect.New(t).Interface().(SchemaType), true
+	}
+	return nil, false
+}
+
+// Configuration field of a struct.
+type schemaField struct {
+	reflect.StructField
+	name     string
+	required bool
+}
+
+// Returns the fields of a struct which can be set in the configuration.
+func schemaFields(t reflect.Type) (fields []schemaField) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if field.PkgPath != "" || name == "-" || field.Tag.Get(schemaTag) == schemaComputed {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, schemaField{field, name, field.Tag.Get(schemaTag) == schemaRequired})
+	}
+	return
+}
+
+// Checks a JSON configuration for fields unknown to maestro, returning an error for each
+// of them, prefixed with its stage/component path and with a suggestion if one is close enough.
+func CheckUnknownFields(data []byte) (errs []error) {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return []error{err}
+	}
+	unknownFields(value, reflect.TypeOf(MaestroConfig{}), "config", &errs)
+	return
+}
+
+func unknownFields(value interface{}, t reflect.Type, path string, errs *[]error) {
+	if _, ok := schemaCustom(t); ok {
+		return
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		unknownFields(value, t.Elem(), path, errs)
+	case reflect.Slice, reflect.Array:
+		items, ok := value.([]interface{})
+		if !ok {
+			return
+		}
+		for i, item := range items {
+			unknownFields(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+		fields := map[string]schemaField{}
+		names := []string{}
+		for _, field := range schemaFields(t) {
+			fields[field.name] = field
+			names = append(names, field.name)
+		}
+		keys := []string{}
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			field, ok := fields[key]
+			if !ok {
+				msg := fmt.Sprintf("%s: unknown field %q", path, key)
+				if suggestion := suggestField(key, names); suggestion != "" {
+					msg += fmt.Sprintf(", did you mean %q?", suggestion)
+				}
+				*errs = append(*errs, fmt.Errorf("%s", msg))
+				continue
+			}
+			if items, ok := object[key].([]interface{}); ok && field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.Struct {
+				for i, item := range items {
+					unknownFields(item, field.Type.Elem(), childPath(path, key, i, item), errs)
+				}
+				continue
+			}
+			unknownFields(object[key], field.Type, path+"/"+key, errs)
+		}
+	}
+}
+
+// Returns the path of the i-th element of a list of objects, named after its "name"
+// field when set, as used in validation errors (e.g. "prod/grafana" or "prod/components[1]").
+func childPath(parent, field string, i int, item interface{}) string {
+	prefix := ""
+	if parent != "config" {
+		prefix = parent + "/"
+	}
+	if object, ok := item.(map[string]interface{}); ok {
+		if name, ok := object["name"].(string); ok && name != "" {
+			return prefix + name
+		}
+	}
+	return fmt.Sprintf("%s%s[%d]", prefix, field, i)
+}
+
+// Returns the known field closest to an unknown one, if it is close enough to be a typo.
+func suggestField(name string, known []string) (suggestion string) {
+	best := -1
+	for _, candidate := range known {
+		distance := levenshtein(name, candidate)
+		if distance <= 1 || distance*3 <= len(candidate)+1 {
+			if best == -1 || distance < best {
+				best = distance
+				suggestion = candidate
+			}
+		}
+	}
+	return
+}
+
+// Edit distance between two strings.
+func levenshtein(a, b string) int {
+	row := make([]int, len(b)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		prev := row[0]
+		row[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current := row[j]
+			row[j] = min3(row[j]+1, row[j-1]+1, prev+cost)
+			prev = current
+		}
+	}
+	return row[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// Reports unknown fields of a JSON configuration, exiting unless the check is lax.
+func CheckConfigFields(path string, data []byte) {
+	errs := CheckUnknownFields(data)
+	if len(errs) == 0 {
+		return
+	}
+	for _, err := range errs {
+		if laxConfig {
+			lg.Warn(err.Error())
+		} else {
+			lg.Error(err)
+		}
+	}
+	if !laxConfig {
+		lg.Fatal(fmt.Errorf("invalid configuration %s, %d unknown fields found (use --lax to ignore them)", path, len(errs)))
+	}
+}
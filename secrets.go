@@ -0,0 +1,413 @@
+package maestro
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Secrets are encrypted as `openssl enc -aes-256-cbc -pbkdf2 -a -A` does, so that
+// cluster nodes can decrypt them with openssl and the passphrase in secretsNodeKey.
+const (
+	secretsMagic      = "Salted__"
+	secretsSaltSize   = 8
+	secretsIterations = 10000
+	secretsNodeKey    = "/etc/maestro/secrets.key"
+)
+
+var (
+	secrets       SecretStore
+	secretKeyFile string
+)
+
+// Storage of encrypted secrets, by stage and name. Values are never decrypted by the store.
+type SecretStore interface {
+	Get(stage, name string) (string, error)
+	Set(stage, name, value string) error
+	Delete(stage, name string) error
+	List(stage string) ([]string, error)
+}
+
+// Setup the secret store and the file holding the passphrase used to encrypt secrets
+// (default to $maestrodir/secrets.key). Secrets are stored in etcd, unless `file` is set.
+func SetupSecrets(keyFile, file string) {
+	secretKeyFile = keyFile
+	if secretKeyFile == "" {
+		secretKeyFile = path.Join(maestroDir, "secrets.key")
+	}
+	if file != "" {
+		secrets = NewFileSecretStore(file)
+	} else {
+		secrets = &EtcdSecretStore{}
+	}
+}
+
+// Reads the passphrase used to encrypt and decrypt secrets.
+func SecretPassphrase() (string, error) {
+	data, err := ioutil.ReadFile(secretKeyFile)
+	if err != nil {
+		return "", fmt.Errorf("unable to read secrets passphrase: %s (it has to match %s on the cluster nodes)", err, secretsNodeKey)
+	}
+	passphrase := strings.TrimSpace(string(data))
+	if passphrase == "" {
+		return "", errors.New("secrets passphrase in " + secretKeyFile + " is empty")
+	}
+	return passphrase, nil
+}
+
+// Encrypts a secret, returning it base64 encoded.
+func SecretEncrypt(plaintext, passphrase string) (string, error) {
+	salt := make([]byte, secretsSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	block, iv := secretsCipher(passphrase, salt)
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	data := append([]byte(plaintext), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+	return base64.StdEncoding.EncodeToString(append(append([]byte(secretsMagic), salt...), data...)), nil
+}
+
+// Decrypts a base64 encoded secret.
+func SecretDecrypt(encrypted, passphrase string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encrypted))
+	if err != nil {
+		return "", err
+	}
+	header := len(secretsMagic) + secretsSaltSize
+	if len(data) < header+aes.BlockSize || string(data[:len(secretsMagic)]) != secretsMagic || (len(data)-header)%aes.BlockSize != 0 {
+		return "", errors.New("invalid encrypted secret")
+	}
+	block, iv := secretsCipher(passphrase, data[len(secretsMagic):header])
+	data = data[header:]
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+	padding := int(data[len(data)-1])
+	if padding == 0 || padding > aes.BlockSize || !bytes.Equal(data[len(data)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return "", errors.New("unable to decrypt secret, wrong passphrase")
+	}
+	return string(data[:len(data)-padding]), nil
+}
+
+// Derives key and iv from a passphrase, using PBKDF2 with HMAC-SHA256.
+func secretsCipher(passphrase string, salt []byte) (cipher.Block, []byte) {
+	keyLen := 32 + aes.BlockSize
+	derived := []byte{}
+	for i := uint32(1); len(derived) < keyLen; i++ {
+		mac := hmac.New(sha256.New, []byte(passphrase))
+		mac.Write(salt)
+		binary.Write(mac, binary.BigEndian, i)
+		u := mac.Sum(nil)
+		t := append([]byte{}, u...)
+		for n := 1; n < secretsIterations; n++ {
+			mac.Reset()
+			mac.Write(u)
+			u = mac.Sum(u[:0])
+			for k := range t {
+				t[k] ^= u[k]
+			}
+		}
+		derived = append(derived, t...)
+	}
+	block, _ := aes.NewCipher(derived[:32])
+	return block, derived[32:keyLen]
+}
+
+// Secret store keeping secrets in etcd, under the app namespace of every stage.
+type EtcdSecretStore struct{}
+
+func (e *EtcdSecretStore) key(stage, name string) string {
+	return config.GetSecretsKey(stage) + "/" + name
+}
+
+func (e *EtcdSecretStore) Get(stage, name string) (string, error) {
+	kv, err := etcdClient.Get(e.key(stage, name))
+	if err != nil {
+		return "", err
+	}
+	if kv == nil {
+		return "", fmt.Errorf("secret %s not found in stage %s", name, stage)
+	}
+	return kv.Value, nil
+}
+
+func (e *EtcdSecretStore) Set(stage, name, value string) error {
+	if err := etcdClient.Set(e.key(stage, name), value); err != nil {
+		return fmt.Errorf("unable to store secret %s: %s", name, err)
+	}
+	return nil
+}
+
+func (e *EtcdSecretStore) Delete(stage, name string) error {
+	err := etcdClient.Delete(e.key(stage, name))
+	if err == ErrEtcdKeyNotFound {
+		return fmt.Errorf("secret %s not found in stage %s", name, stage)
+	}
+	return err
+}
+
+func (e *EtcdSecretStore) List(stage string) (names []string, err error) {
+	kvs, err := etcdClient.List(config.GetSecretsKey(stage))
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range kvs {
+		names = append(names, path.Base(kv.Key))
+	}
+	sort.Strings(names)
+	return
+}
+
+// Secret store keeping secrets in a local JSON file, encrypted, indexed by stage and name.
+// The file can be safely committed along with the app configuration.
+type FileSecretStore struct {
+	Path string
+}
+
+// Returns a secret store using the file in `path`.
+func NewFileSecretStore(path string) *FileSecretStore {
+	return &FileSecretStore{Path: path}
+}
+
+func (f *FileSecretStore) load() (map[string]map[string]string, error) {
+	stages := map[string]map[string]string{}
+	data, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return stages, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stages, json.Unmarshal(data, &stages)
+}
+
+func (f *FileSecretStore) save(stages map[string]map[string]string) error {
+	data, _ := json.MarshalIndent(stages, "", "    ")
+	return ioutil.WriteFile(f.Path, append(data, '\n'), 0600)
+}
+
+func (f *FileSecretStore) Get(stage, name string) (string, error) {
+	stages, err := f.load()
+	if err != nil {
+		return "", err
+	}
+	value, ok := stages[stage][name]
+	if !ok {
+		return "", fmt.Errorf("secret %s not found in stage %s", name, stage)
+	}
+	return value, nil
+}
+
+func (f *FileSecretStore) Set(stage, name, value string) error {
+	stages, err := f.load()
+	if err != nil {
+		return err
+	}
+	if stages[stage] == nil {
+		stages[stage] = map[string]string{}
+	}
+	stages[stage][name] = value
+	return f.save(stages)
+}
+
+func (f *FileSecretStore) Delete(stage, name string) error {
+	stages, err := f.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := stages[stage][name]; !ok {
+		return fmt.Errorf("secret %s not found in stage %s", name, stage)
+	}
+	delete(stages[stage], name)
+	return f.save(stages)
+}
+
+func (f *FileSecretStore) List(stage string) (names []string, err error) {
+	stages, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	for name := range stages[stage] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Makes the secrets of a component available to the cluster. Secrets kept in a local file
+// are copied, still encrypted, to etcd, where the unit reads them from.
+func SecretsPublish(component *MaestroComponent) error {
+	etcd := &EtcdSecretStore{}
+	for _, name := range component.Secrets {
+		value, err := secrets.Get(component.Stage, name)
+		if err != nil {
+			return err
+		}
+		if _, ok := secrets.(*EtcdSecretStore); ok {
+			continue
+		}
+		lg.Debug("publishing secret "+name+" to etcd", component.Stage, component.Name)
+		if err := etcd.Set(component.Stage, name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decrypts the secrets of a component into a docker env-file, readable only by the user.
+// The caller has to remove the file.
+func SecretsEnvFile(component *MaestroComponent) (string, error) {
+	passphrase, err := SecretPassphrase()
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	for _, name := range component.Secrets {
+		value, err := secrets.Get(component.Stage, name)
+		if err != nil {
+			return "", err
+		}
+		plaintext, err := SecretDecrypt(value, passphrase)
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %s", name, err)
+		}
+		buf.WriteString(name + "=" + plaintext + "\n")
+	}
+	file, err := ioutil.TempFile(maestroDir, "secrets-*.env")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// Returns the stage secrets and history commands act on, the only stage if there is just one.
+func commandStage(stage string) (string, error) {
+	if stage != "" {
+		if _, err := config.Stage(stage); err != nil {
+			return "", err
+		}
+		return stage, nil
+	}
+	if len(config.Stages) == 1 {
+		return config.Stages[0].Name, nil
+	}
+	return "", errors.New("more than one stage in current app, choose one with --stage")
+}
+
+// Encrypts and stores a secret. The value is read from standard input when empty. Values
+// are passed to containers through docker env-files, one variable per line, so they can not
+// span multiple lines.
+func MaestroSecretSet(stage, name, value string) (exitCode int) {
+	stage, err := commandStage(stage)
+	if err == nil && !validEnvName(name) {
+		err = fmt.Errorf("invalid secret name %q, it has to be a valid environment variable name", name)
+	}
+	if err != nil {
+		lg.Error(err)
+		return 1
+	}
+	if value == "" {
+		data, err := ioutil.ReadAll(os.Stdin)
+		lg.Fatal(err)
+		value = strings.TrimRight(string(data), "\r\n")
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		lg.Error(fmt.Errorf("secret %s spans multiple lines, docker env-files only take single line values: encode it, e.g. with base64", name))
+		return 1
+	}
+	passphrase, err := SecretPassphrase()
+	if err == nil {
+		value, err = SecretEncrypt(value, passphrase)
+	}
+	if err == nil {
+		err = secrets.Set(stage, name, value)
+	}
+	if err != nil {
+		lg.Error(err)
+		return 1
+	}
+	lg.Out(lg.b("maestro ") + "secret " + lg.y(stage) + "/" + lg.b(name) + " " + lg.g("stored"))
+	return
+}
+
+// Prints a decrypted secret.
+func MaestroSecretGet(stage, name string) (exitCode int) {
+	stage, err := commandStage(stage)
+	var value, passphrase string
+	if err == nil {
+		value, err = secrets.Get(stage, name)
+	}
+	if err == nil {
+		passphrase, err = SecretPassphrase()
+	}
+	if err == nil {
+		value, err = SecretDecrypt(value, passphrase)
+	}
+	if err != nil {
+		lg.Error(err)
+		return 1
+	}
+	lg.Out(value)
+	return
+}
+
+// Lists the secrets of a stage.
+func MaestroSecretList(stage string) (exitCode int) {
+	stage, err := commandStage(stage)
+	var names []string
+	if err == nil {
+		names, err = secrets.List(stage)
+	}
+	if err != nil {
+		lg.Error(err)
+		return 1
+	}
+	for _, name := range names {
+		lg.Out(name)
+	}
+	return
+}
+
+// Removes a secret.
+func MaestroSecretDelete(stage, name string) (exitCode int) {
+	stage, err := commandStage(stage)
+	if err == nil {
+		err = secrets.Delete(stage, name)
+	}
+	if err != nil {
+		lg.Error(err)
+		return 1
+	}
+	lg.Out(lg.b("maestro ") + "secret " + lg.y(stage) + "/" + lg.b(name) + " " + lg.r("removed"))
+	return
+}
+
+// Returns true if `name` is a valid environment variable name.
+func validEnvName(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for _, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -1,7 +1,12 @@
 package maestro
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
 	"os"
+	"reflect"
 	"strings"
 	"text/template"
 )
@@ -13,21 +18,119 @@ func GetTmpl(name string) string {
 	return string(data)
 }
 
-// Renders a template onto a file.
-func ProcessUnitTmpl(component MaestroComponent, unitName, unitPath, tmplName string) {
+// Unit templates rendered for every component.
+var unitTemplates = []string{"run-unit.tmpl", "build-unit.tmpl"}
+
+// Functions available to unit templates.
+var unitTmplFuncs = template.FuncMap{
 	// Little function to cut the domain from the dns
-	funcMap := template.FuncMap{
-		"cutDomain": func(s string) string {
-			return strings.Replace(s, ".maestro.io", "", 1)
-		},
+	"cutDomain": func(s string) string {
+		return strings.Replace(s, ".maestro.io", "", 1)
+	},
+	"systemdArg": systemdArg,
+	"etcdctlGet": EtcdctlGet,
+}
+
+// Renders a template into a string.
+func RenderUnitTmpl(component MaestroComponent, unitName, tmplName string) string {
+	content, err := renderTmpl(component, unitName, tmplName)
+	lg.Fatal(err)
+	return SetUnitHash(content)
+}
+
+func renderTmpl(component MaestroComponent, unitName, tmplName string) (string, error) {
+	var buf bytes.Buffer
+	lg.Debug("getting template " + tmplName + " from asset data")
+	tmpl, err := template.New(unitName).Funcs(unitTmplFuncs).Parse(GetTmpl(tmplName))
+	if err != nil {
+		return "", err
 	}
+	lg.Debug("processing template " + tmplName + " for " + unitName)
+	err = tmpl.Execute(&buf, component)
+	return buf.String(), err
+}
 
+// Renders every unit template with an empty component and with a component having all
+// fields set, so that all template branches are run. It returns the errors found, e.g.
+// templates referencing fields MaestroComponent does not have.
+func CheckUnitTemplates() (errs []error) {
+	full := MaestroComponent{}
+	fillValue(reflect.ValueOf(&full).Elem())
+	for _, tmplName := range unitTemplates {
+		for _, component := range []MaestroComponent{{}, full} {
+			if _, err := renderTmpl(component, "check", tmplName); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s", tmplName, err))
+				break
+			}
+		}
+	}
+	return
+}
+
+// Sets all fields of a value to a non zero value.
+func fillValue(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(2)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(2)
+	case reflect.Ptr:
+		v.Set(reflect.New(v.Type().Elem()))
+		fillValue(v.Elem())
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fillValue(v.Index(0))
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).CanSet() {
+				fillValue(v.Field(i))
+			}
+		}
+	}
+}
+
+// Option of the [Unit] section storing the hash of the unit content. Systemd ignores
+// options starting with X-, so it is only used by maestro to detect changed units.
+const unitHashOption = "X-Maestro-Hash"
+
+// Returns the hash of a unit content, ignoring formatting, comments and the hash option itself.
+func UnitOptionsHash(options []*FleetUnitOption) string {
+	filtered := []*FleetUnitOption{}
+	for _, option := range options {
+		if option.Name != unitHashOption {
+			filtered = append(filtered, option)
+		}
+	}
+	sum := sha1.Sum([]byte(SerializeUnitOptions(filtered)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the hash stored in the unit options, or the hash of the options if none is stored.
+func GetUnitHash(options []*FleetUnitOption) string {
+	for _, option := range options {
+		if option.Section == "Unit" && option.Name == unitHashOption {
+			return option.Value
+		}
+	}
+	return UnitOptionsHash(options)
+}
+
+// Stores the hash of a rendered unit into its [Unit] section.
+func SetUnitHash(content string) string {
+	hash := UnitOptionsHash(ParseUnitFile(content))
+	return strings.Replace(content, "[Unit]\n", "[Unit]\n"+unitHashOption+"="+hash+"\n", 1)
+}
+
+// Renders a template onto a file.
+func ProcessUnitTmpl(component MaestroComponent, unitName, unitPath, tmplName string) {
+	content := RenderUnitTmpl(component, unitName, tmplName)
 	fd := GetUnitFd(unitPath)
-	lg.Debug("getting template " + tmplName + " from asset data")
-	tmpl, err := template.New(unitName).Funcs(funcMap).Parse(GetTmpl(tmplName))
-	lg.Fatal(err)
-	lg.Debug("processing template into " + unitPath)
-	err = tmpl.Execute(fd, component)
+	lg.Debug("writing template into " + unitPath)
+	_, err := fd.WriteString(content)
 	lg.Fatal(err)
 	fd.Close()
 }
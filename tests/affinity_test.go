@@ -0,0 +1,104 @@
+package maestro_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/crisidev/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+const affinityTestConfig = `{
+  "username": "crisidev",
+  "app": "shop",
+  "stages": [
+    {
+      "name": "prod",
+      "components": [
+        {
+          "name": "postgres",
+          "src": "postgres",
+          "machine_metadata": ["disk=ssd", "region=eu"]
+        },
+        {
+          "name": "pgbouncer",
+          "src": "pgbouncer",
+          "affinity": "postgres"
+        },
+        {
+          "name": "web",
+          "src": "nginx",
+          "scale": 3,
+          "anti_affinity": ["web", "postgres"]
+        },
+        {
+          "name": "cache",
+          "src": "redis",
+          "scale": 3,
+          "affinity": "web",
+          "machine_id": "2c0c2e4e3b7e4c6a9d1f0a8b7c6d5e4f"
+        }
+      ]
+    }
+  ]
+}`
+
+func TestAffinityUnit(t *testing.T) {
+	server, config := setupFakeFleet(t, affinityTestConfig)
+	components := config.Stages[0].Components
+	assert.Equal(t, "postgres", components[1].Affinity)
+	assert.Equal(t, "crisidev_prod_shop_postgres@1.service", components[1].AffinityUnit)
+	assert.Equal(t, []string{"crisidev_prod_shop_postgres@*", "crisidev_prod_shop_web@*"}, components[2].Conflicts)
+	assert.Equal(t, "crisidev_prod_shop_web@%i.service", components[3].AffinityUnit)
+	assert.Empty(t, config.Validate())
+
+	assert.Equal(t, 0, maestro.MaestroRun(""))
+	unit := func(name string) string {
+		return maestro.SerializeUnitOptions(server.Unit(name).Options)
+	}
+	assert.Contains(t, unit("crisidev_prod_shop_postgres@1.service"), "[X-Fleet]\nMachineMetadata=disk=ssd\nMachineMetadata=region=eu\n")
+	assert.Contains(t, unit("crisidev_prod_shop_pgbouncer@1.service"), "[X-Fleet]\nMachineOf=crisidev_prod_shop_postgres@1.service\n")
+	assert.Contains(t, unit("crisidev_prod_shop_web@2.service"), "[X-Fleet]\nConflicts=crisidev_prod_shop_postgres@*\nConflicts=crisidev_prod_shop_web@*\n")
+	assert.Contains(t, unit("crisidev_prod_shop_cache@2.service"), "[X-Fleet]\nMachineOf=crisidev_prod_shop_web@%i.service\nMachineID=2c0c2e4e3b7e4c6a9d1f0a8b7c6d5e4f\n")
+}
+
+func TestAffinityUnitScale(t *testing.T) {
+	// cache has more instances than web, they all run next to the first web instance
+	server, config := setupFakeFleet(t, strings.Replace(affinityTestConfig, `"scale": 3,
+          "anti_affinity"`, `"scale": 2,
+          "anti_affinity"`, 1))
+	assert.Equal(t, "crisidev_prod_shop_web@1.service", config.Stages[0].Components[3].AffinityUnit)
+	assert.Equal(t, 0, maestro.MaestroRun(""))
+	assert.Contains(t, maestro.SerializeUnitOptions(server.Unit("crisidev_prod_shop_cache@3.service").Options),
+		"[X-Fleet]\nMachineOf=crisidev_prod_shop_web@1.service\n")
+}
+
+func TestValidateAffinity(t *testing.T) {
+	var config maestro.MaestroConfig
+	assert.Nil(t, json.Unmarshal([]byte(`{
+  "app": "shop",
+  "stages": [
+    {
+      "name": "prod",
+      "components": [
+        {"name": "db", "src": "postgres", "affinity": "db", "machine_id": "node1", "machine_metadata": ["disk"]},
+        {"name": "web", "src": "nginx", "affinity": "db", "anti_affinity": ["db", "cache"]},
+        {"name": "agent", "src": "agent", "global": true, "anti_affinity": ["web"], "machine_metadata": ["role=worker"]}
+      ]
+    }
+  ]
+}`), &config))
+	errs := []string{}
+	for _, err := range config.Validate() {
+		errs = append(errs, err.Error())
+	}
+	assert.Equal(t, []string{
+		`prod/db: affinity references the component itself`,
+		`prod/db: invalid machine_id "node1"`,
+		`prod/db: invalid machine_metadata "disk", expected key=value`,
+		`prod/web: component "db" is both in affinity and anti_affinity`,
+		`prod/web: anti_affinity references unknown component "cache"`,
+		`prod/agent: global components can only be constrained with machine_metadata`,
+	}, errs)
+}
@@ -0,0 +1,97 @@
+package maestro_test
+
+import (
+	"testing"
+
+	"github.com/crisidev/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+const defaultsTestConfig = `{
+  "username": "crisidev",
+  "app": "metrics",
+  "components": [
+    {
+      "name": "prometheus",
+      "src": "hub.maestro.io:5000/crisidev/prometheus:1.0",
+      "ports": [9090],
+      "frontend": true,
+      "env": ["RETENTION=15d", "LOG=info"]
+    },
+    {
+      "name": "grafana",
+      "src": "hub.maestro.io:5000/crisidev/grafana",
+      "after": "prometheus"
+    }
+  ],
+  "stages": [
+    {
+      "name": "dev"
+    },
+    {
+      "name": "prod",
+      "components": [
+        {
+          "name": "prometheus",
+          "src": "hub.maestro.io:5000/crisidev/prometheus:1.1",
+          "scale": 3,
+          "frontend": false,
+          "env": ["LOG=warn", "STORAGE=/data"]
+        },
+        {
+          "name": "alertmanager",
+          "src": "hub.maestro.io:5000/crisidev/alertmanager"
+        }
+      ]
+    }
+  ]
+}`
+
+func TestMergeComponentDefaults(t *testing.T) {
+	_, config := setupFakeFleet(t, defaultsTestConfig)
+	assert.Empty(t, config.Components)
+	assert.Equal(t, 2, len(config.Stages))
+
+	dev := config.Stages[0].Components
+	assert.Equal(t, 2, len(dev))
+	assert.Equal(t, "prometheus", dev[0].Name)
+	assert.Equal(t, "hub.maestro.io:5000/crisidev/prometheus:1.0", dev[0].Src)
+	assert.Equal(t, 1, dev[0].Scale)
+	assert.True(t, dev[0].Frontend)
+	assert.Equal(t, []string{"RETENTION=15d", "LOG=info"}, dev[0].Env)
+	assert.Equal(t, "crisidev_dev_metrics_prometheus@", dev[0].UnitName)
+	assert.Equal(t, "grafana", dev[1].Name)
+	assert.Equal(t, []string{"crisidev_dev_metrics_prometheus@1.service"}, dev[1].AfterUnits)
+
+	prod := config.Stages[1].Components
+	assert.Equal(t, 3, len(prod))
+	assert.Equal(t, "hub.maestro.io:5000/crisidev/prometheus:1.1", prod[0].Src)
+	assert.Equal(t, 3, prod[0].Scale)
+	assert.False(t, prod[0].Frontend)
+	assert.Equal(t, []maestro.MaestroPort{{Port: 9090}}, prod[0].Ports)
+	assert.Equal(t, []string{"RETENTION=15d", "LOG=warn", "STORAGE=/data"}, prod[0].Env)
+	assert.Equal(t, "crisidev_prod_metrics_prometheus@", prod[0].UnitName)
+	assert.Equal(t, "grafana", prod[1].Name)
+	assert.Equal(t, "crisidev_prod_metrics_grafana@", prod[1].UnitName)
+	assert.Equal(t, []string{"crisidev_prod_metrics_prometheus@1.service", "crisidev_prod_metrics_prometheus@2.service",
+		"crisidev_prod_metrics_prometheus@3.service"}, prod[1].AfterUnits)
+	assert.Equal(t, "alertmanager", prod[2].Name)
+
+	stage, err := config.Stage("prod")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(stage.Stages))
+	assert.Equal(t, "prod", stage.Stages[0].Name)
+	assert.Equal(t, 2, len(config.Stages))
+	_, err = config.Stage("staging")
+	assert.NotNil(t, err)
+}
+
+func TestMergeComponentDefaultsErrors(t *testing.T) {
+	_, err := maestro.MergeComponentDefaults([]byte(`{"components": [{"src": "busybox"}], "stages": []}`))
+	assert.EqualError(t, err, "components[0]: component name is empty")
+	_, err = maestro.MergeComponentDefaults([]byte(`{"components": [{"name": "a"}, {"name": "a"}], "stages": []}`))
+	assert.EqualError(t, err, `components[1]: duplicate component name "a"`)
+	data, err := maestro.MergeComponentDefaults([]byte(`{"app": "x"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"app": "x"}`, string(data))
+}
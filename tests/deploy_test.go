@@ -0,0 +1,33 @@
+package maestro_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crisidev/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeployRolling(t *testing.T) {
+	server, _ := setupFakeFleet(t, fleetTestConfig)
+	assert.Equal(t, 0, maestro.MaestroRun(""))
+	prometheus := server.Unit("crisidev_prod_metrics_prometheus@1.service")
+
+	updated := strings.Replace(fleetTestConfig, "crisidev/grafana", "crisidev/grafana:v2", 1)
+	loadConfig(t, updated)
+	assert.Equal(t, 0, maestro.MaestroDeploy("", 1, time.Second))
+	for _, name := range []string{"crisidev_prod_metrics_grafana@1.service", "crisidev_prod_metrics_grafana@2.service"} {
+		assert.Contains(t, maestro.SerializeUnitOptions(server.Unit(name).Options), "crisidev/grafana:v2")
+	}
+	assert.Equal(t, prometheus, server.Unit("crisidev_prod_metrics_prometheus@1.service"))
+
+	// the first instance fails, the second one is left on the previous version
+	server.SetUnitActiveState("crisidev_prod_metrics_grafana@1.service", "failed")
+	loadConfig(t, strings.Replace(fleetTestConfig, "crisidev/grafana", "crisidev/grafana:v3", 1))
+	assert.Equal(t, 1, maestro.MaestroDeploy("grafana", 1, time.Second))
+	assert.Contains(t, maestro.SerializeUnitOptions(server.Unit("crisidev_prod_metrics_grafana@1.service").Options), "crisidev/grafana:v3")
+	assert.Contains(t, maestro.SerializeUnitOptions(server.Unit("crisidev_prod_metrics_grafana@2.service").Options), "crisidev/grafana:v2")
+
+	assert.Equal(t, 1, maestro.MaestroDeploy("missing", 1, time.Second))
+}
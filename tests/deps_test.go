@@ -0,0 +1,111 @@
+package maestro_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/crisidev/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+const depsTestConfig = `{
+  "username": "crisidev",
+  "app": "shop",
+  "stages": [
+    {
+      "name": "prod",
+      "components": [
+        {"name": "web", "src": "nginx", "scale": 3, "after": ["db", "cache"], "requires": "cache", "wants": ["metrics"]},
+        {"name": "worker", "src": "worker", "scale": 4, "requires": "cache"},
+        {"name": "cache", "src": "redis", "scale": 3, "after": "db"},
+        {"name": "db", "src": "postgres"},
+        {"name": "metrics", "src": "prometheus", "scale": 2}
+      ]
+    }
+  ]
+}`
+
+func TestMaestroDepsJSON(t *testing.T) {
+	var component maestro.MaestroComponent
+	assert.Nil(t, json.Unmarshal([]byte(`{"after": "db", "requires": ["db", "cache"], "wants": ""}`), &component))
+	assert.Equal(t, maestro.MaestroDeps{"db"}, component.After)
+	assert.Equal(t, maestro.MaestroDeps{"db", "cache"}, component.Requires)
+	assert.Empty(t, component.Wants)
+	assert.Equal(t, []string{"db", "cache"}, component.Dependencies())
+	assert.EqualError(t, json.Unmarshal([]byte(`{"after": 1}`), &component),
+		"invalid dependencies 1, expected a component name or a list of names")
+}
+
+func TestDependencyUnits(t *testing.T) {
+	server, config := setupFakeFleet(t, depsTestConfig)
+	components := config.Stages[0].Components
+	web, worker, cache := components[0], components[1], components[2]
+	// scaled components follow the same instance of dependencies with enough instances
+	assert.Equal(t, []string{"crisidev_prod_shop_db@1.service", "crisidev_prod_shop_cache@%i.service",
+		"crisidev_prod_shop_metrics@1.service", "crisidev_prod_shop_metrics@2.service"}, web.AfterUnits)
+	// after also requires and binds to its dependencies
+	assert.Equal(t, []string{"crisidev_prod_shop_db@1.service", "crisidev_prod_shop_cache@%i.service"}, web.RequiresUnits)
+	assert.Equal(t, []string{"crisidev_prod_shop_db@1.service", "crisidev_prod_shop_cache@%i.service"}, web.BindsToUnits)
+	assert.Equal(t, []string{"crisidev_prod_shop_metrics@1.service", "crisidev_prod_shop_metrics@2.service"}, web.WantsUnits)
+	assert.Equal(t, []string{"crisidev_prod_shop_cache@1.service", "crisidev_prod_shop_cache@2.service",
+		"crisidev_prod_shop_cache@3.service"}, worker.RequiresUnits)
+	assert.Empty(t, worker.BindsToUnits)
+	// the target has scale 1, its only instance is used
+	assert.Equal(t, []string{"crisidev_prod_shop_db@1.service"}, cache.AfterUnits)
+
+	assert.Equal(t, 0, maestro.MaestroRun(""))
+	unit := maestro.SerializeUnitOptions(server.Unit("crisidev_prod_shop_web@2.service").Options)
+	assert.Contains(t, unit, "After=crisidev_prod_shop_db@1.service\nAfter=crisidev_prod_shop_cache@%i.service\n"+
+		"After=crisidev_prod_shop_metrics@1.service\nAfter=crisidev_prod_shop_metrics@2.service\n"+
+		"Requires=crisidev_prod_shop_db@1.service\nRequires=crisidev_prod_shop_cache@%i.service\n"+
+		"BindsTo=crisidev_prod_shop_db@1.service\nBindsTo=crisidev_prod_shop_cache@%i.service\n"+
+		"Wants=crisidev_prod_shop_metrics@1.service\nWants=crisidev_prod_shop_metrics@2.service\n")
+	assert.NotContains(t, unit, "sleep")
+	assert.NotContains(t, maestro.SerializeUnitOptions(server.Unit("crisidev_prod_shop_worker@1.service").Options), "BindsTo")
+}
+
+func TestSortComponents(t *testing.T) {
+	_, config := setupFakeFleet(t, depsTestConfig)
+	names := []string{}
+	for _, component := range maestro.SortComponents(config.Stages[0].Components) {
+		names = append(names, component.Name)
+	}
+	assert.Equal(t, []string{"db", "cache", "worker", "metrics", "web"}, names)
+}
+
+func TestValidateDependencies(t *testing.T) {
+	var config maestro.MaestroConfig
+	assert.Nil(t, json.Unmarshal([]byte(`{
+  "app": "shop",
+  "stages": [
+    {
+      "name": "prod",
+      "components": [
+        {"name": "a", "src": "a", "after": "b", "wants": ["a"]},
+        {"name": "b", "src": "b", "requires": ["c", "missing"]},
+        {"name": "c", "src": "c", "wants": "a"},
+        {"name": "d", "src": "d", "after": "c"}
+      ]
+    },
+    {
+      "name": "dev",
+      "components": [
+        {"name": "a", "src": "a", "after": "b"},
+        {"name": "b", "src": "b"}
+      ]
+    }
+  ]
+}`), &config))
+	errs := []string{}
+	for _, err := range config.Validate() {
+		errs = append(errs, err.Error())
+	}
+	assert.Equal(t, []string{
+		`prod/a: wants references the component itself`,
+		`prod/b: requires references unknown component "missing"`,
+		`prod: dependency cycle a -> b -> c -> a`,
+	}, errs)
+	assert.Equal(t, []string{"a", "b", "a"}, maestro.DependencyCycle([]maestro.MaestroComponent{
+		{Name: "a", Requires: maestro.MaestroDeps{"b"}}, {Name: "b", After: maestro.MaestroDeps{"b", "a"}}}))
+	assert.Nil(t, maestro.DependencyCycle([]maestro.MaestroComponent{{Name: "a", After: maestro.MaestroDeps{"b"}}, {Name: "b"}}))
+}
@@ -0,0 +1,101 @@
+package maestro_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/crisidev/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+const dnsTestConfig = `{
+  "username": "crisidev",
+  "app": "metrics",
+  "stages": [
+    {
+      "name": "prod",
+      "components": [
+        {"name": "grafana", "dns": "grafana", "scale": 2, "src": "grafana/grafana"},
+        {"name": "cadvisor", "dns": "cadvisor", "global": true, "src": "google/cadvisor"},
+        {"name": "prometheus", "src": "prom/prometheus"}
+      ]
+    }
+  ]
+}`
+
+// Returns the skydns records known to the fake etcd server as key to value.
+func skydnsKeys(server *maestro.EtcdFakeServer) map[string]string {
+	keys := map[string]string{}
+	for _, key := range server.Keys() {
+		if strings.HasPrefix(key, "/skydns/") {
+			keys[key], _ = server.Value(key)
+		}
+	}
+	return keys
+}
+
+func TestDNSRecords(t *testing.T) {
+	// skydns only reads the v2 api
+	setupFakeFleet(t, dnsTestConfig)
+	setupFakeEtcd(t, "v3")
+	assert.Equal(t, 1, maestro.MaestroDNS("", false))
+
+	server, _ := setupFakeFleet(t, dnsTestConfig)
+	etcd := setupFakeEtcd(t, "v2")
+	maestro.SetupHistory(0, false)
+	defer maestro.SetupHistory(maestro.HistoryDefaultLimit, true)
+	maestro.SetupDNS(true)
+	defer maestro.SetupDNS(false)
+
+	// records of other apps are left alone
+	etcd.SetTTL("/skydns/io/maestro/crisidev/prod/web/nginx/1", `{"host": "172.17.8.101"}`, 0)
+	etcd.SetTTL("/skydns/io/maestro/grafana/crisidev_prod_metrics_v2_grafana-1", `{"host": "172.17.8.102"}`, 0)
+	assert.Equal(t, 0, maestro.MaestroRun(""))
+	records, err := maestro.DNSRecords("prod")
+	assert.Nil(t, err)
+	names := []string{}
+	for _, record := range records {
+		names = append(names, record.Key+" "+record.Host)
+	}
+	assert.Equal(t, []string{
+		"/skydns/io/maestro/cadvisor-c0ffee03/crisidev_prod_metrics_cadvisor-1 172.17.8.103",
+		"/skydns/io/maestro/crisidev/prod/metrics/cadvisor/c0ffee03 172.17.8.103",
+		"/skydns/io/maestro/crisidev/prod/metrics/grafana/1 172.17.8.101",
+		"/skydns/io/maestro/crisidev/prod/metrics/grafana/2 172.17.8.102",
+		"/skydns/io/maestro/crisidev/prod/metrics/prometheus/1 172.17.8.101",
+		"/skydns/io/maestro/grafana/crisidev_prod_metrics_grafana-1 172.17.8.101",
+		"/skydns/io/maestro/grafana/crisidev_prod_metrics_grafana-2 172.17.8.102",
+	}, names)
+	keys := skydnsKeys(etcd)
+	assert.Equal(t, 9, len(keys))
+	assert.JSONEq(t, `{"host": "172.17.8.101"}`, keys["/skydns/io/maestro/grafana/crisidev_prod_metrics_grafana-1"])
+	assert.Equal(t, 0, maestro.MaestroDNS("", false))
+	assert.Equal(t, 1, maestro.MaestroDNS("staging", false))
+
+	// stopped instances are removed
+	assert.Equal(t, 0, maestro.MaestroStop("crisidev_prod_metrics_grafana@1.service"))
+	keys = skydnsKeys(etcd)
+	assert.Equal(t, 7, len(keys))
+	assert.NotContains(t, keys, "/skydns/io/maestro/crisidev/prod/metrics/grafana/1")
+	assert.NotContains(t, keys, "/skydns/io/maestro/grafana/crisidev_prod_metrics_grafana-1")
+
+	// wrong and stale records are reported and fixed
+	maestro.SetupDNS(false)
+	etcd.SetTTL("/skydns/io/maestro/crisidev/prod/metrics/prometheus/1", `{"host": "10.0.0.1"}`, 0)
+	etcd.SetTTL("/skydns/io/maestro/grafana/crisidev_prod_metrics_grafana-3", `{"host": "10.0.0.1"}`, 0)
+	assert.Equal(t, 1, maestro.MaestroDNS("prod", false))
+	assert.Equal(t, 0, maestro.MaestroDNS("prod", true))
+	assert.Equal(t, 0, maestro.MaestroDNS("prod", false))
+	keys = skydnsKeys(etcd)
+	assert.JSONEq(t, `{"host": "172.17.8.101"}`, keys["/skydns/io/maestro/crisidev/prod/metrics/prometheus/1"])
+	assert.NotContains(t, keys, "/skydns/io/maestro/grafana/crisidev_prod_metrics_grafana-3")
+
+	// nuked apps leave no records behind
+	maestro.SetupDNS(true)
+	assert.Equal(t, 0, maestro.MaestroNuke(""))
+	assert.Equal(t, map[string]string{
+		"/skydns/io/maestro/crisidev/prod/web/nginx/1":                  `{"host": "172.17.8.101"}`,
+		"/skydns/io/maestro/grafana/crisidev_prod_metrics_v2_grafana-1": `{"host": "172.17.8.102"}`,
+	}, skydnsKeys(etcd))
+	assert.Equal(t, 0, len(server.UnitNames()))
+}
@@ -0,0 +1,261 @@
+package maestro_test
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crisidev/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+// Starts a fake etcd server and uses it, through the `api` version, as etcd cluster.
+func setupFakeEtcd(t *testing.T, api string) *maestro.EtcdFakeServer {
+	server := maestro.NewEtcdFakeServer()
+	t.Cleanup(server.Close)
+	maestro.SetupEtcdClient(server.URL, api, "", "", "")
+	return server
+}
+
+func TestEtcdClient(t *testing.T) {
+	for _, api := range maestro.EtcdAPIs {
+		server := maestro.NewEtcdFakeServer()
+		defer server.Close()
+		client, err := maestro.NewEtcdClient([]string{server.URL}, api, nil)
+		assert.Nil(t, err)
+
+		kv, err := client.Get("/maestro.io/crisidev/missing")
+		assert.Nil(t, err, api)
+		assert.Nil(t, kv, api)
+		assert.Nil(t, client.Set("/maestro.io/crisidev/prod/metrics/a", "1"), api)
+		assert.Nil(t, client.Set("/maestro.io/crisidev/prod/metrics/b/c", "2"), api)
+		assert.Nil(t, client.Set("/maestro.iox", "3"), api)
+		kv, err = client.Get("/maestro.io/crisidev/prod/metrics/a")
+		assert.Nil(t, err, api)
+		assert.Equal(t, "1", kv.Value, api)
+		assert.Equal(t, int64(1), kv.Revision, api)
+
+		kvs, err := client.List("/maestro.io")
+		assert.Nil(t, err, api)
+		keys := []string{}
+		for _, kv := range kvs {
+			keys = append(keys, kv.Key+"="+kv.Value)
+		}
+		assert.Equal(t, []string{"/maestro.io/crisidev/prod/metrics/a=1", "/maestro.io/crisidev/prod/metrics/b/c=2"}, keys, api)
+		kvs, err = client.List("/")
+		assert.Nil(t, err, api)
+		assert.Equal(t, 3, len(kvs), api)
+		kvs, err = client.List("/missing")
+		assert.Nil(t, err, api)
+		assert.Empty(t, kvs, api)
+
+		assert.Nil(t, client.Delete("/maestro.io/crisidev/prod/metrics/a"), api)
+		assert.Equal(t, maestro.ErrEtcdKeyNotFound, client.Delete("/maestro.io/crisidev/prod/metrics/a"), api)
+		assert.Equal(t, []string{"/maestro.io/crisidev/prod/metrics/b/c", "/maestro.iox"}, server.Keys(), api)
+	}
+	_, err := maestro.NewEtcdClient([]string{"127.0.0.1:2379"}, "v4", nil)
+	assert.EqualError(t, err, `etcd: unknown api "v4", expected one of v2, v3`)
+	_, err = maestro.NewEtcdClient([]string{" "}, "v2", nil)
+	assert.EqualError(t, err, "etcd: no endpoints")
+}
+
+func TestEtcdClientFailover(t *testing.T) {
+	server := maestro.NewEtcdFakeServer()
+	defer server.Close()
+	down := maestro.NewEtcdFakeServer()
+	down.Close()
+	client, err := maestro.NewEtcdClient([]string{down.URL, strings.TrimPrefix(server.URL, "http://")}, "v2", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, client.Set("/a", "1"))
+	value, _ := server.Value("/a")
+	assert.Equal(t, "1", value)
+
+	client, _ = maestro.NewEtcdClient([]string{down.URL}, "v2", nil)
+	err = client.Set("/a", "1")
+	assert.NotNil(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "etcd: no endpoint available: "))
+}
+
+func TestEtcdClientTLS(t *testing.T) {
+	server := maestro.NewEtcdFakeTLSServer()
+	defer server.Close()
+	dir := t.TempDir()
+	ca := path.Join(dir, "ca.pem")
+	assert.Nil(t, ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644))
+
+	for _, api := range maestro.EtcdAPIs {
+		tlsConfig, err := maestro.EtcdTLSConfig("", "", ca)
+		assert.Nil(t, err)
+		// endpoints without scheme use https with tls
+		client, err := maestro.NewEtcdClient([]string{strings.TrimPrefix(server.URL, "https://")}, api, tlsConfig)
+		assert.Nil(t, err)
+		assert.Nil(t, client.Set("/secure", api), api)
+		kv, err := client.Get("/secure")
+		assert.Nil(t, err, api)
+		assert.Equal(t, api, kv.Value, api)
+	}
+
+	// the server certificate is not trusted without the ca
+	client, _ := maestro.NewEtcdClient([]string{server.URL}, "v2", nil)
+	assert.NotNil(t, client.Set("/secure", "v2"))
+
+	_, err := maestro.EtcdTLSConfig(path.Join(dir, "cert.pem"), path.Join(dir, "key.pem"), "")
+	assert.True(t, strings.HasPrefix(err.Error(), "etcd: unable to load client certificate: "))
+	_, err = maestro.EtcdTLSConfig("", "", path.Join(dir, "missing.pem"))
+	assert.True(t, strings.HasPrefix(err.Error(), "etcd: unable to load ca: "))
+	assert.Nil(t, ioutil.WriteFile(path.Join(dir, "empty.pem"), []byte("nothing"), 0644))
+	_, err = maestro.EtcdTLSConfig("", "", path.Join(dir, "empty.pem"))
+	assert.EqualError(t, err, "etcd: no certificate found in "+path.Join(dir, "empty.pem"))
+}
+
+func TestEtcdPullKeys(t *testing.T) {
+	setupFakeFleet(t, fleetTestConfig)
+	for _, api := range maestro.EtcdAPIs {
+		server := setupFakeEtcd(t, api)
+		client, _ := maestro.NewEtcdClient([]string{server.URL}, api, nil)
+		assert.Nil(t, client.Set("/maestro.io/crisidev/prod/metrics/secrets/A", "x"))
+		assert.Nil(t, client.Set("/skydns/io/maestro/grafana", `{"host":"10.0.0.1"}`))
+		prefixes := maestro.EtcdPrefixes(false, false)
+		assert.Equal(t, 0, maestro.EtcdPullKeys(prefixes, "", false, false), api)
+		assert.Equal(t, 0, maestro.EtcdPullKeys(maestro.EtcdPrefixes(true, false), "", true, false), api)
+		assert.Equal(t, 0, maestro.EtcdPullKeys(maestro.EtcdPrefixes(false, true), "", false, true), api)
+		assert.Equal(t, 0, maestro.EtcdPullKeys(prefixes, "/skydns/io/maestro/grafana", false, true), api)
+		assert.Equal(t, 1, maestro.EtcdPullKeys(prefixes, "/missing", false, false), api)
+		assert.Equal(t, 1, maestro.EtcdPullKeys(prefixes, "", true, true), api)
+		assert.Equal(t, 1, maestro.EtcdWatchKeys(prefixes, "/skydns/io/maestro/grafana", false, false), api)
+		assert.Equal(t, 1, maestro.EtcdWatchKeys(prefixes, "", true, false), api)
+	}
+}
+
+func TestEtcdPrefixes(t *testing.T) {
+	_, config := setupFakeFleet(t, fleetTestConfig)
+	assert.Equal(t, []string{"/maestro.io/"}, maestro.EtcdPrefixes(false, false))
+	assert.Equal(t, []string{"/maestro.io/", "/skydns/"}, maestro.EtcdPrefixes(true, false))
+	assert.Equal(t, []string{"/"}, maestro.EtcdPrefixes(true, true))
+	assert.Equal(t, []string{"/maestro.io/crisidev/prod/metrics/"}, config.GetEtcdPrefixes(false))
+	assert.Equal(t, []string{"/maestro.io/crisidev/prod/metrics/", "/skydns/io/maestro/crisidev/prod/metrics/"}, config.GetEtcdPrefixes(true))
+	assert.Equal(t, "/skydns/io/maestro/crisidev/prod/metrics/1/grafana", maestro.SkydnsPath("grafana.1.metrics.prod.crisidev.maestro.io."))
+
+	kvs := []*maestro.EtcdKV{{Key: "/maestro.io/crisidev/prod/metrics/secrets/A"}, {Key: "/maestro.io/crisidev/prod/other/a"}, {Key: "/skydns/io/maestro/crisidev/prod/metrics/1"}}
+	filtered := maestro.EtcdFilterKeys(kvs, config.GetEtcdPrefixes(true))
+	assert.Equal(t, []*maestro.EtcdKV{kvs[0], kvs[2]}, filtered)
+}
+
+func TestEtcdTree(t *testing.T) {
+	assert.Equal(t, []string{
+		"maestro.io/",
+		"  crisidev/",
+		"    prod/",
+		"      metrics/",
+		"        lock",
+		"        secrets/",
+		"          A",
+		"          B",
+		"    test/",
+		"      metrics",
+		"skydns/",
+		"  io/",
+		"    maestro",
+	}, maestro.EtcdTree([]string{
+		"/maestro.io/crisidev/prod/metrics/lock",
+		"/maestro.io/crisidev/prod/metrics/secrets/A",
+		"/maestro.io/crisidev/prod/metrics/secrets/B",
+		"/maestro.io/crisidev/test/metrics",
+		"/skydns/io/maestro",
+	}))
+	assert.Empty(t, maestro.EtcdTree(nil))
+}
+
+func TestEtcdTTL(t *testing.T) {
+	for _, api := range maestro.EtcdAPIs {
+		server := maestro.NewEtcdFakeServer()
+		defer server.Close()
+		client, _ := maestro.NewEtcdClient([]string{server.URL}, api, nil)
+		server.SetTTL("/maestro.io/lock", "crisidev", 30)
+		assert.Nil(t, client.Set("/maestro.io/key", "value"))
+		kv, err := client.Get("/maestro.io/lock")
+		assert.Nil(t, err, api)
+		assert.Equal(t, int64(30), kv.TTL, api)
+		kvs, _ := client.List("/maestro.io")
+		assert.Equal(t, int64(30), kvs[1].TTL, api)
+		assert.Equal(t, int64(0), kvs[0].TTL, api)
+
+		server.Expire("/maestro.io/lock")
+		kv, err = client.Get("/maestro.io/lock")
+		assert.Nil(t, err, api)
+		assert.Nil(t, kv, api)
+	}
+}
+
+func TestEtcdWatch(t *testing.T) {
+	for _, api := range maestro.EtcdAPIs {
+		server := maestro.NewEtcdFakeServer()
+		defer server.Close()
+		client, _ := maestro.NewEtcdClient([]string{server.URL}, api, nil)
+		assert.Nil(t, client.Set("/maestro.io/crisidev/a", "1"))
+		assert.Nil(t, client.Set("/other/b", "2"))
+
+		// without revision the watch waits for the next change
+		var events []*maestro.EtcdEvent
+		var err error
+		done := make(chan bool)
+		go func() {
+			events, err = client.Watch("/maestro.io", 0)
+			done <- true
+		}()
+		// changes are made until the watch sees one, as it may not be waiting yet
+		for waiting := true; waiting; {
+			assert.Nil(t, client.Set("/other/c", "3"))
+			assert.Nil(t, client.Set("/maestro.io/crisidev/a", "4"))
+			select {
+			case <-done:
+				waiting = false
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+		assert.Nil(t, err, api)
+		assert.Equal(t, 1, len(events), api)
+		assert.Equal(t, "put /maestro.io/crisidev/a", maestro.FormatEtcdEvent(events[0], false), api)
+		assert.Equal(t, "4", events[0].Value, api)
+
+		// changes made after a revision are returned at once
+		kv, _ := client.Get("/maestro.io/crisidev/a")
+		assert.Nil(t, client.Delete("/maestro.io/crisidev/a"))
+		deleted := strconv.FormatInt(kv.Revision+1, 10)
+		events, err = client.Watch("/maestro.io", kv.Revision)
+		assert.Nil(t, err, api)
+		assert.Equal(t, 1, len(events), api)
+		assert.Equal(t, `{"type":"delete","key":"/maestro.io/crisidev/a","value":"","revision":`+deleted+`}`, maestro.FormatEtcdEvent(events[0], true), api)
+
+		server.SetTTL("/maestro.io/lock", "crisidev", 30)
+		server.Expire("/maestro.io/lock")
+		events, err = client.Watch("/maestro.io", events[0].Revision)
+		assert.Nil(t, err, api)
+		assert.Equal(t, maestro.EtcdPut, events[0].Type, api)
+		events, err = client.Watch("/maestro.io", events[0].Revision)
+		assert.Nil(t, err, api)
+		assert.Equal(t, "delete /maestro.io/lock", maestro.FormatEtcdEvent(events[0], false), api)
+	}
+}
+
+func TestEtcdSecretStore(t *testing.T) {
+	setupFakeFleet(t, secretsTestConfig)
+	key := path.Join(t.TempDir(), "secrets.key")
+	assert.Nil(t, ioutil.WriteFile(key, []byte("s3cr3t\n"), 0600))
+	defer maestro.SetupSecrets("", "")
+	for _, api := range maestro.EtcdAPIs {
+		setupFakeEtcd(t, api)
+		maestro.SetupSecrets(key, "")
+		assert.Equal(t, 0, maestro.MaestroSecretSet("", "GF_ADMIN_PASSWORD", "admin"), api)
+		assert.Equal(t, 0, maestro.MaestroSecretSet("", "GF_DB_PASSWORD", "db"), api)
+		assert.Equal(t, 0, maestro.MaestroSecretList(""), api)
+		assert.Equal(t, 0, maestro.MaestroSecretGet("", "GF_DB_PASSWORD"), api)
+		assert.Equal(t, 0, maestro.MaestroSecretDelete("", "GF_DB_PASSWORD"), api)
+		assert.Equal(t, 1, maestro.MaestroSecretDelete("", "GF_DB_PASSWORD"), api)
+		assert.Equal(t, 1, maestro.MaestroSecretGet("", "GF_DB_PASSWORD"), api)
+	}
+}
@@ -1 +1,136 @@
 package maestro_test
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/crisidev/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+const fleetTestConfig = `{
+  "username": "crisidev",
+  "app": "metrics",
+  "stages": [
+    {
+      "name": "prod",
+      "components": [
+        {
+          "name": "prometheus",
+          "src": "hub.maestro.io:5000/crisidev/prometheus",
+          "ports": [9090]
+        },
+        {
+          "name": "grafana",
+          "src": "hub.maestro.io:5000/crisidev/grafana",
+          "scale": 2,
+          "after": "prometheus"
+        }
+      ]
+    }
+  ]
+}`
+
+// Initializes maestro against a fake fleet server and loads `cfg` as app configuration.
+func setupFakeFleet(t *testing.T, cfg string) (*maestro.FleetFakeServer, maestro.MaestroConfig) {
+	server := maestro.NewFleetFakeServer()
+	t.Cleanup(server.Close)
+	maestro.Init(t.TempDir(), "maestro.io", "127.0.0.1", "/share/maestro", "", []string{}, false)
+	maestro.SetupFleetClient(server.URL)
+	return server, loadConfig(t, cfg)
+}
+
+// Loads `cfg` as app configuration.
+func loadConfig(t *testing.T, cfg string) maestro.MaestroConfig {
+	configPath := path.Join(t.TempDir(), "maestro.json")
+	assert.Nil(t, ioutil.WriteFile(configPath, []byte(cfg), 0644))
+	return maestro.BuildMaestroConfig(configPath)
+}
+
+func TestParseUnitFile(t *testing.T) {
+	options := maestro.ParseUnitFile("[Unit]\n# comment\nDescription=test\n\n[Service]\nExecStart=/usr/bin/docker run \\\n  --name test \\\n  busybox\n")
+	assert.Equal(t, 2, len(options))
+	assert.Equal(t, maestro.FleetUnitOption{Section: "Unit", Name: "Description", Value: "test"}, *options[0])
+	assert.Equal(t, maestro.FleetUnitOption{Section: "Service", Name: "ExecStart", Value: "/usr/bin/docker run --name test busybox"}, *options[1])
+	assert.Equal(t, "[Unit]\nDescription=test\n\n[Service]\nExecStart=/usr/bin/docker run --name test busybox\n", maestro.SerializeUnitOptions(options))
+}
+
+func TestFleetClientPagination(t *testing.T) {
+	server := maestro.NewFleetFakeServer()
+	defer server.Close()
+	server.PageSize = 1
+	client := maestro.NewFleetClient(server.URL)
+	machines, err := client.Machines()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(machines))
+	for _, name := range []string{"a.service", "b.service", "c.service"} {
+		options := []*maestro.FleetUnitOption{{Section: "Service", Name: "ExecStart", Value: "/bin/true"}}
+		assert.Nil(t, client.CreateUnit(&maestro.FleetUnit{Name: name, Options: options, DesiredState: "launched"}))
+	}
+	units, err := client.Units()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(units))
+	states, err := client.UnitStates("b.service")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(states))
+	assert.Equal(t, "active", states[0].SystemdActiveState)
+	unit, err := client.Unit("missing.service")
+	assert.Nil(t, err)
+	assert.Nil(t, unit)
+	assert.Nil(t, client.DestroyUnit("missing.service"))
+}
+
+func TestFleetRunStopNuke(t *testing.T) {
+	server, config := setupFakeFleet(t, fleetTestConfig)
+	assert.Equal(t, 0, maestro.MaestroRun(""))
+	assert.Equal(t, []string{
+		"crisidev_prod_metrics_grafana@1.service",
+		"crisidev_prod_metrics_grafana@2.service",
+		"crisidev_prod_metrics_prometheus@1.service",
+	}, server.UnitNames())
+
+	unit := server.Unit("crisidev_prod_metrics_grafana@2.service")
+	assert.Equal(t, "launched", unit.DesiredState)
+	assert.Contains(t, maestro.SerializeUnitOptions(unit.Options), "--name crisidev_prod_metrics_grafana%i")
+	assert.True(t, maestro.FleetIsUnitRunning(config.GetNumberedUnitPath(config.Stages[0].Components[0].UnitPath, "1")))
+	assert.Equal(t, 0, maestro.MaestroStatus(""))
+
+	// running again keeps the already running units untouched
+	assert.Equal(t, 0, maestro.MaestroRun(""))
+	assert.Equal(t, 3, len(server.UnitNames()))
+
+	assert.Equal(t, 0, maestro.MaestroStop(""))
+	assert.Equal(t, "loaded", server.Unit("crisidev_prod_metrics_prometheus@1.service").DesiredState)
+	assert.False(t, maestro.FleetIsUnitRunning("crisidev_prod_metrics_prometheus@1.service"))
+
+	server.SetUnitActiveState("crisidev_prod_metrics_grafana@1.service", "failed")
+	assert.Equal(t, 1, maestro.FleetExecCommand("status", "crisidev_prod_metrics_grafana@1.service"))
+
+	assert.Equal(t, 0, maestro.MaestroNuke(""))
+	assert.Equal(t, 0, len(server.UnitNames()))
+}
+
+func TestFleetRunReplacesChangedUnits(t *testing.T) {
+	server, _ := setupFakeFleet(t, fleetTestConfig)
+	assert.Equal(t, 0, maestro.MaestroRun(""))
+	prometheus := server.Unit("crisidev_prod_metrics_prometheus@1.service")
+	grafana := server.Unit("crisidev_prod_metrics_grafana@1.service")
+	assert.Contains(t, maestro.SerializeUnitOptions(grafana.Options), "X-Maestro-Hash="+maestro.UnitOptionsHash(grafana.Options))
+
+	loadConfig(t, strings.Replace(fleetTestConfig, `"scale": 2,`, `"scale": 2, "env": ["DEBUG=1"],`, 1))
+	assert.Equal(t, 0, maestro.MaestroRun(""))
+	changed := server.Unit("crisidev_prod_metrics_grafana@1.service")
+	assert.Contains(t, maestro.SerializeUnitOptions(changed.Options), "-e DEBUG=1")
+	assert.Equal(t, "launched", changed.DesiredState)
+	assert.NotEqual(t, maestro.GetUnitHash(grafana.Options), maestro.GetUnitHash(changed.Options))
+	assert.Equal(t, prometheus, server.Unit("crisidev_prod_metrics_prometheus@1.service"))
+
+	// stopped units with a stale content are replaced too
+	assert.Equal(t, 0, maestro.MaestroStop(""))
+	loadConfig(t, fleetTestConfig)
+	assert.Equal(t, 0, maestro.MaestroRun(""))
+	assert.Equal(t, grafana.Options, server.Unit("crisidev_prod_metrics_grafana@2.service").Options)
+	assert.Equal(t, "launched", server.Unit("crisidev_prod_metrics_prometheus@1.service").DesiredState)
+}
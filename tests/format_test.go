@@ -0,0 +1,91 @@
+package maestro_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/crisidev/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+const yamlTestConfig = `
+username: crisidev
+app: metrics
+stages:
+  - name: prod
+    components:
+      - name: prometheus
+        src: hub.maestro.io:5000/crisidev/prometheus
+        ports: [9090]
+      - name: grafana
+        src: hub.maestro.io:5000/crisidev/grafana
+        scale: 2
+        after: prometheus
+`
+
+const tomlTestConfig = `
+username = "crisidev"
+app = "metrics"
+
+[[stages]]
+name = "prod"
+
+  [[stages.components]]
+  name = "prometheus"
+  src = "hub.maestro.io:5000/crisidev/prometheus"
+  ports = [9090]
+
+  [[stages.components]]
+  name = "grafana"
+  src = "hub.maestro.io:5000/crisidev/grafana"
+  scale = 2
+  after = "prometheus"
+`
+
+// Loads `cfg` as app configuration from a file called `name`.
+func loadConfigFile(t *testing.T, name, cfg string) maestro.MaestroConfig {
+	configPath := path.Join(t.TempDir(), name)
+	assert.Nil(t, ioutil.WriteFile(configPath, []byte(cfg), 0644))
+	return maestro.BuildMaestroConfig(configPath)
+}
+
+func TestConfigFormat(t *testing.T) {
+	assert.Equal(t, maestro.FormatJSON, maestro.ConfigFormat("maestro.json"))
+	assert.Equal(t, maestro.FormatYAML, maestro.ConfigFormat("maestro.yaml"))
+	assert.Equal(t, maestro.FormatYAML, maestro.ConfigFormat("/etc/maestro.YML"))
+	assert.Equal(t, maestro.FormatTOML, maestro.ConfigFormat("maestro.toml"))
+	assert.Equal(t, maestro.FormatJSON, maestro.ConfigFormat("maestro"))
+}
+
+func TestLoadYAMLAndTOMLConfig(t *testing.T) {
+	_, expected := setupFakeFleet(t, fleetTestConfig)
+	assert.Equal(t, expected, loadConfigFile(t, "maestro.yaml", yamlTestConfig))
+	assert.Equal(t, expected, loadConfigFile(t, "maestro.toml", tomlTestConfig))
+}
+
+func TestUnknownFieldsInYAML(t *testing.T) {
+	data, err := maestro.ConfigToJSON([]byte("app: metrics\nstages:\n  - name: prod\n    components:\n      - name: grafana\n        keep_on_exti: true\n"), maestro.FormatYAML)
+	assert.Nil(t, err)
+	errs := maestro.CheckUnknownFields(data)
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t, `prod/grafana: unknown field "keep_on_exti", did you mean "keep_on_exit"?`, errs[0].Error())
+}
+
+func TestEncodeConfig(t *testing.T) {
+	_, config := setupFakeFleet(t, fleetTestConfig)
+	for _, format := range maestro.ConfigFormats {
+		data, err := maestro.EncodeConfig(config, format)
+		assert.Nil(t, err, format)
+		decoded, err := maestro.ConfigToJSON(data, format)
+		assert.Nil(t, err, format)
+		var config2 maestro.MaestroConfig
+		assert.Nil(t, json.Unmarshal(decoded, &config2), format)
+		assert.Equal(t, config, config2, format)
+	}
+	data, err := maestro.EncodeConfig(config, maestro.FormatYAML)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), "\n  name: prod\n")
+	assert.Contains(t, string(data), "    - 9090\n")
+}
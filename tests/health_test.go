@@ -0,0 +1,127 @@
+package maestro_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crisidev/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+const healthTestConfig = `{
+  "username": "crisidev",
+  "app": "metrics",
+  "stages": [
+    {
+      "name": "prod",
+      "components": [
+        {
+          "name": "prometheus",
+          "src": "hub.maestro.io:5000/crisidev/prometheus",
+          "ports": [9090],
+          "healthcheck": {"http": "http://localhost:9090/-/healthy", "interval": "10s", "retries": 5}
+        },
+        {
+          "name": "grafana",
+          "src": "hub.maestro.io:5000/crisidev/grafana",
+          "after": "prometheus"
+        }
+      ]
+    }
+  ]
+}`
+
+func TestHealthcheckUnit(t *testing.T) {
+	server, _ := setupFakeFleet(t, healthTestConfig)
+	assert.Equal(t, 0, maestro.MaestroRun(""))
+	unit := maestro.SerializeUnitOptions(server.Unit("crisidev_prod_metrics_prometheus@1.service").Options)
+	assert.Contains(t, unit, `--health-cmd "curl -fsS -o /dev/null http://localhost:9090/-/healthy || wget -q -O /dev/null http://localhost:9090/-/healthy || exit 1" `+
+		"--health-interval 10s --health-timeout 30s --health-retries 5 ")
+	assert.Contains(t, unit, "ExecStartPost="+(&maestro.MaestroHealthcheck{Interval: "10s", Retries: 5}).WaitCommand("crisidev_prod_metrics_prometheus1")+"\n")
+	unit = maestro.SerializeUnitOptions(server.Unit("crisidev_prod_metrics_grafana@1.service").Options)
+	assert.NotContains(t, unit, "--health-cmd")
+	assert.NotContains(t, unit, "ExecStartPost")
+}
+
+func TestHealthcheckDockerArgs(t *testing.T) {
+	assert.Equal(t, []string{"--health-cmd", "nc -z 127.0.0.1 5432 || exit 1", "--health-interval", "30s",
+		"--health-timeout", "30s", "--health-retries", "3"}, (&maestro.MaestroHealthcheck{TCP: 5432}).DockerArgs())
+	assert.Equal(t, "pg_isready", (&maestro.MaestroHealthcheck{Cmd: "pg_isready"}).Command())
+}
+
+func TestHealthcheckWaitCommand(t *testing.T) {
+	// (10s interval + 30s timeout) * (5 retries + 1)
+	assert.Equal(t, `/usr/bin/sh -c 'i=0; while [ $$i -lt 240 ]; do `+
+		`s=$$(/usr/bin/docker inspect -f "{{.State.Running}} {{.State.Health.Status}}" grafana1 2>/dev/null) || exit 1; `+
+		`case "$$s" in "true healthy") exit 0;; "true starting") ;; *) exit 1;; esac; `+
+		`i=$$((i+1)); sleep 1; done; exit 1'`, (&maestro.MaestroHealthcheck{Interval: "10s", Retries: 5}).WaitCommand("grafana1"))
+	assert.Contains(t, (&maestro.MaestroHealthcheck{TCP: 80}).WaitCommand("grafana1"), "-lt 240 ]")
+}
+
+func TestHealthcheckValidate(t *testing.T) {
+	assert.Empty(t, (&maestro.MaestroHealthcheck{Cmd: "true", Interval: "1m", Timeout: "5s"}).Validate())
+	errs := (&maestro.MaestroHealthcheck{}).Validate()
+	assert.Equal(t, "healthcheck needs exactly one of cmd, http and tcp", errs[0].Error())
+	errs = (&maestro.MaestroHealthcheck{HTTP: "localhost:80", TCP: 70000, Interval: "often", Retries: -1}).Validate()
+	messages := []string{}
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	assert.Equal(t, []string{
+		"healthcheck needs exactly one of cmd, http and tcp",
+		`healthcheck http "localhost:80" is not an http(s) url`,
+		"invalid healthcheck tcp port 70000",
+		`invalid healthcheck interval "often"`,
+		"healthcheck retries -1 must not be negative",
+	}, messages)
+}
+
+func TestMaestroWait(t *testing.T) {
+	server, _ := setupFakeFleet(t, healthTestConfig)
+	assert.Equal(t, 0, maestro.MaestroRun(""))
+	assert.Equal(t, 0, maestro.MaestroWait("", 0))
+	assert.Equal(t, 0, maestro.MaestroWait("crisidev_prod_metrics_grafana@1.service", 0))
+
+	// the healthcheck of prometheus never passes
+	server.SetUnitActiveState("crisidev_prod_metrics_prometheus@1.service", "activating")
+	assert.Equal(t, 1, maestro.MaestroWait("", 0))
+	assert.Equal(t, 0, maestro.MaestroWait("crisidev_prod_metrics_grafana@1.service", 0))
+
+	server.SetUnitActiveState("crisidev_prod_metrics_prometheus@1.service", "failed")
+	assert.Equal(t, 1, maestro.MaestroWait("", 0))
+}
+
+func TestMaestroRunWaitUnit(t *testing.T) {
+	server, config := setupFakeFleet(t, healthTestConfig)
+	unitPath := config.GetNumberedUnitPath(config.Stages[0].Components[0].UnitPath, "1")
+
+	// only the unit run is waited for, grafana is never submitted
+	server.SetUnitActiveState("crisidev_prod_metrics_prometheus@1.service", "activating")
+	go func() {
+		time.Sleep(time.Second)
+		server.SetUnitActiveState("crisidev_prod_metrics_prometheus@1.service", "")
+	}()
+	assert.Equal(t, 0, maestro.MaestroRun(unitPath))
+	assert.Equal(t, 0, maestro.MaestroWait(unitPath, time.Minute))
+	assert.Nil(t, server.Unit("crisidev_prod_metrics_grafana@1.service"))
+
+	server.SetUnitActiveState("crisidev_prod_metrics_prometheus@1.service", "failed")
+	assert.Equal(t, 1, maestro.MaestroWait(unitPath, time.Minute))
+}
+
+func TestLocalSchedulerHealthcheck(t *testing.T) {
+	setupFakeFleet(t, healthTestConfig)
+	dir := setupFakeDocker(t)
+	defer maestro.SetupScheduler("fleet")
+
+	assert.Equal(t, 0, maestro.MaestroRun(""))
+	for _, line := range dockerLog(t, dir) {
+		if strings.HasPrefix(line, "create") && strings.Contains(line, "crisidev_prod_metrics_prometheus1") {
+			assert.Contains(t, line, "--health-cmd curl -fsS -o /dev/null http://localhost:9090/-/healthy")
+			assert.Contains(t, line, "--health-interval 10s --health-timeout 30s --health-retries 5")
+			return
+		}
+	}
+	t.Error("prometheus container not created")
+}
@@ -0,0 +1,134 @@
+package maestro_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/crisidev/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+const historyTestConfig = `{
+  "username": "crisidev",
+  "app": "metrics",
+  "stages": [
+    {
+      "name": "prod",
+      "components": [
+        {
+          "name": "grafana",
+          "src": "REGISTRY/crisidev/grafana:v1"
+        }
+      ]
+    }
+  ]
+}`
+
+// Starts a fake docker registry serving the digest of every manifest as sha256:<tag>,
+// asking for an anonymous token like the docker hub.
+func setupFakeRegistry(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token" && r.URL.Query().Get("scope") == "repository:crisidev/grafana:pull":
+			w.Write([]byte(`{"token": "anonymous"}`))
+		case r.Header.Get("Authorization") != "Bearer anonymous":
+			w.Header().Set("Www-Authenticate", `Bearer realm="`+server.URL+`/token",service="registry",scope="repository:crisidev/grafana:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case strings.HasPrefix(r.URL.Path, "/v2/crisidev/grafana/manifests/") && r.Method == "HEAD":
+			w.Header().Set("Docker-Content-Digest", "sha256:"+strings.TrimPrefix(r.URL.Path, "/v2/crisidev/grafana/manifests/"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestParseImage(t *testing.T) {
+	for src, expected := range map[string][]string{
+		"postgres":                                 {"registry-1.docker.io", "library/postgres", "latest"},
+		"grafana/grafana:7.0":                      {"registry-1.docker.io", "grafana/grafana", "7.0"},
+		"hub.maestro.io:5000/crisidev/grafana":     {"hub.maestro.io:5000", "crisidev/grafana", "latest"},
+		"localhost/grafana:v2":                     {"localhost", "grafana", "v2"},
+		"quay.io/prometheus/prometheus@sha256:abc": {"quay.io", "prometheus/prometheus", "sha256:abc"},
+	} {
+		registry, repository, reference := maestro.ParseImage(src)
+		assert.Equal(t, expected, []string{registry, repository, reference}, src)
+	}
+}
+
+func TestImageDigest(t *testing.T) {
+	registry := strings.TrimPrefix(setupFakeRegistry(t).URL, "http://")
+	digest, err := maestro.ImageDigest(registry + "/crisidev/grafana:v1")
+	assert.Nil(t, err)
+	assert.Equal(t, "sha256:v1", digest)
+	digest, err = maestro.ImageDigest("hub.maestro.io:5000/crisidev/grafana@sha256:abc")
+	assert.Nil(t, err)
+	assert.Equal(t, "sha256:abc", digest)
+	_, err = maestro.ImageDigest(registry + "/crisidev/prometheus")
+	assert.NotNil(t, err)
+}
+
+func TestHistoryRollback(t *testing.T) {
+	for _, api := range maestro.EtcdAPIs {
+		registry := strings.TrimPrefix(setupFakeRegistry(t).URL, "http://")
+		cfg := strings.Replace(historyTestConfig, "REGISTRY", registry, 1)
+		server, _ := setupFakeFleet(t, cfg)
+		setupFakeEtcd(t, api)
+		maestro.SetupHistory(maestro.HistoryDefaultLimit, true)
+		defer maestro.SetupHistory(maestro.HistoryDefaultLimit, true)
+
+		assert.Equal(t, 1, maestro.MaestroRollback("", 0), api)
+		assert.Equal(t, 0, maestro.MaestroRun(""), api)
+		// unchanged runs are not recorded
+		assert.Equal(t, 0, maestro.MaestroRun(""), api)
+		revisions, err := maestro.HistoryRevisions("prod")
+		assert.Nil(t, err, api)
+		assert.Equal(t, 1, len(revisions), api)
+		assert.Equal(t, "run", revisions[0].Command, api)
+		assert.Equal(t, map[string]string{"grafana": registry + "/crisidev/grafana:v1@sha256:v1"}, revisions[0].Images, api)
+		assert.Contains(t, revisions[0].Units["crisidev_prod_metrics_grafana@.service"], "crisidev/grafana:v1@sha256:v1 ", api)
+		assert.NotContains(t, revisions[0].Units["crisidev_prod_metrics_grafana@.service"], "crisidev/grafana:v1 ", api)
+		assert.Equal(t, "grafana", revisions[0].Stage.Components[0].Name, api)
+
+		loadConfig(t, strings.Replace(strings.Replace(cfg, ":v1", ":v2", 1), `"src"`, `"scale": 2, "src"`, 1))
+		assert.Equal(t, 0, maestro.MaestroRun(""), api)
+		assert.Equal(t, 0, maestro.MaestroHistory("", false), api)
+		assert.Equal(t, 0, maestro.MaestroHistory("prod", true), api)
+		assert.Equal(t, 1, maestro.MaestroHistory("staging", false), api)
+		assert.Contains(t, maestro.SerializeUnitOptions(server.Unit("crisidev_prod_metrics_grafana@2.service").Options), "crisidev/grafana:v2", api)
+
+		// the previous revision is submitted again pinned to its digest, the second instance is
+		// not part of it
+		assert.Equal(t, 0, maestro.MaestroRollback("", 0), api)
+		assert.Contains(t, maestro.SerializeUnitOptions(server.Unit("crisidev_prod_metrics_grafana@1.service").Options), "crisidev/grafana:v1@sha256:v1", api)
+		assert.Nil(t, server.Unit("crisidev_prod_metrics_grafana@2.service"), api)
+		revisions, _ = maestro.HistoryRevisions("prod")
+		assert.Equal(t, 3, len(revisions), api)
+		assert.Equal(t, "rollback 1", revisions[2].Command, api)
+		assert.Equal(t, revisions[0].Units, revisions[2].Units, api)
+		assert.Equal(t, revisions[0].Images, revisions[2].Images, api)
+		assert.Equal(t, "crisidev/grafana:v1@sha256:v1", revisions[2].Stage.Components[0].Src[len(registry)+1:], api)
+
+		assert.Equal(t, 0, maestro.MaestroRollback("prod", 2), api)
+		assert.Contains(t, maestro.SerializeUnitOptions(server.Unit("crisidev_prod_metrics_grafana@2.service").Options), "crisidev/grafana:v2", api)
+		assert.Equal(t, 1, maestro.MaestroRollback("", 99), api)
+
+		// older revisions are removed over the limit
+		maestro.SetupHistory(2, false)
+		assert.Equal(t, 0, maestro.MaestroRollback("", 1), api)
+		revisions, _ = maestro.HistoryRevisions("prod")
+		assert.Equal(t, []int{4, 5}, []int{revisions[0].Revision, revisions[1].Revision}, api)
+		assert.Equal(t, map[string]string{"grafana": registry + "/crisidev/grafana:v1@sha256:v1"}, revisions[1].Images, api)
+
+		// a disabled history records nothing
+		maestro.SetupHistory(0, false)
+		loadConfig(t, strings.Replace(cfg, ":v1", ":v3", 1))
+		assert.Equal(t, 0, maestro.MaestroRun(""), api)
+		revisions, _ = maestro.HistoryRevisions("prod")
+		assert.Equal(t, 2, len(revisions), api)
+	}
+}
@@ -0,0 +1,101 @@
+package maestro_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/crisidev/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+// Writes the config files in `files` into a temporary directory, returning it.
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		assert.Nil(t, os.MkdirAll(path.Dir(path.Join(dir, name)), 0755))
+		assert.Nil(t, ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644))
+	}
+	return dir
+}
+
+func TestConfigIncludes(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"maestro.json": `{
+  "username": "crisidev",
+  "app": "metrics",
+  "include": ["components/*"],
+  "stages": [{"name": "prod", "components": [{"name": "prometheus", "src": "prometheus", "ports": [9090]}]}]
+}`,
+		"components/grafana.yaml": `
+app: metrics
+stages:
+  - name: prod
+    components:
+      - name: grafana
+        src: grafana
+        after: prometheus
+`,
+		"components/node.toml": `
+[[stages]]
+name = "dev"
+
+  [[stages.components]]
+  name = "node-exporter"
+  src = "node-exporter"
+  global = true
+`,
+	})
+	setupFakeFleet(t, fleetTestConfig)
+	config := maestro.BuildMaestroConfig(path.Join(dir, "maestro.json"))
+	assert.Empty(t, config.Include)
+	assert.Equal(t, 2, len(config.Stages))
+	prod := config.Stages[0]
+	assert.Equal(t, "prod", prod.Name)
+	assert.Equal(t, 2, len(prod.Components))
+	assert.Equal(t, "prometheus", prod.Components[0].Name)
+	assert.Equal(t, "grafana", prod.Components[1].Name)
+	assert.Equal(t, []string{"crisidev_prod_metrics_prometheus@1.service"}, prod.Components[1].AfterUnits)
+	assert.Equal(t, "dev", config.Stages[1].Name)
+	assert.Equal(t, "crisidev_dev_metrics_node-exporter@", config.Stages[1].Components[0].UnitName)
+}
+
+func TestMultipleConfigFiles(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"maestro.json": `{"username": "crisidev", "app": "metrics", "components": [{"name": "prometheus", "src": "prometheus"}], "stages": [{"name": "prod"}]}`,
+		"prod.yaml":    "stages:\n  - name: prod\n    components:\n      - name: prometheus\n        scale: 2\n",
+	})
+	setupFakeFleet(t, fleetTestConfig)
+	config := maestro.BuildMaestroConfig(path.Join(dir, "maestro.json"), path.Join(dir, "prod.yaml"))
+	assert.Equal(t, 1, len(config.Stages))
+	assert.Equal(t, 1, len(config.Stages[0].Components))
+	assert.Equal(t, "prometheus", config.Stages[0].Components[0].Src)
+	assert.Equal(t, 2, config.Stages[0].Components[0].Scale)
+}
+
+func TestConfigIncludeErrors(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"maestro.json":  `{"app": "metrics", "include": ["a.json", "b.json"], "stages": [{"name": "prod"}]}`,
+		"a.json":        `{"stages": [{"name": "prod", "components": [{"name": "grafana", "src": "grafana"}]}]}`,
+		"b.json":        `{"stages": [{"name": "prod", "components": [{"name": "grafana", "src": "grafana:2"}]}]}`,
+		"other.json":    `{"app": "weather", "components": [{"name": "grafana", "src": "grafana"}]}`,
+		"missing.json":  `{"include": ["nothere.json", "nothere/*.json"]}`,
+		"cycle.json":    `{"include": ["cycle2.json"]}`,
+		"cycle2.json":   `{"include": ["cycle.json"]}`,
+		"defaults.json": `{"components": [{"name": "grafana", "src": "grafana"}]}`,
+		"app.json":      `{"app": "metrics"}`,
+	})
+	_, err := maestro.MergeConfigFiles([]string{path.Join(dir, "maestro.json")})
+	assert.EqualError(t, err, `component "grafana" in stage "prod" is defined in both `+path.Join(dir, "a.json")+" and "+path.Join(dir, "b.json"))
+	_, err = maestro.MergeConfigFiles([]string{path.Join(dir, "a.json"), path.Join(dir, "other.json")})
+	assert.Nil(t, err)
+	_, err = maestro.MergeConfigFiles([]string{path.Join(dir, "other.json"), path.Join(dir, "defaults.json")})
+	assert.EqualError(t, err, `component "grafana" is defined in both `+path.Join(dir, "other.json")+" and "+path.Join(dir, "defaults.json"))
+	_, err = maestro.MergeConfigFiles([]string{path.Join(dir, "other.json"), path.Join(dir, "app.json")})
+	assert.EqualError(t, err, path.Join(dir, "app.json")+": conflicting app metrics, already set to weather in "+path.Join(dir, "other.json"))
+	_, err = maestro.MergeConfigFiles([]string{path.Join(dir, "missing.json")})
+	assert.EqualError(t, err, path.Join(dir, "missing.json")+": include nothere.json: no such file")
+	_, err = maestro.MergeConfigFiles([]string{path.Join(dir, "cycle.json")})
+	assert.EqualError(t, err, "config file "+path.Join(dir, "cycle.json")+" included more than once (by command line and "+path.Join(dir, "cycle2.json")+")")
+}
@@ -0,0 +1,139 @@
+package maestro_test
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/crisidev/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+// Fake docker CLI logging every invocation and keeping containers state in files.
+const fakeDocker = `#!/bin/sh
+dir=$(dirname "$0")
+echo "$@" >> "$dir/docker.log"
+cmd=$1; shift
+last=$(eval echo \${$#})
+case $cmd in
+create)
+	while [ $# -gt 0 ]; do
+		case $1 in
+		--name) name=$2; shift ;;
+		--env-file) envfile=$2; shift ;;
+		--label)
+			case $2 in
+			maestro.unit=*) label=${2#maestro.unit=} ;;
+			maestro.hash=*) hash=${2#maestro.hash=} ;;
+			esac
+			shift ;;
+		esac
+		shift
+	done
+	echo "$label" > "$dir/created.$name"
+	echo "$hash" > "$dir/hash.$name"
+	if [ -n "$envfile" ]; then cp "$envfile" "$dir/envfile.$name"; fi ;;
+start) [ -f "$dir/created.$last" ] || exit 1; touch "$dir/running.$last" ;;
+stop) rm -f "$dir/running.$last" ;;
+rm) rm -f "$dir/created.$last" "$dir/running.$last" ;;
+inspect)
+	[ -f "$dir/created.$last" ] || exit 1
+	case "$*" in
+	*State.Running*) [ -f "$dir/running.$last" ] && echo true || echo false ;;
+	*State.Status*) [ -f "$dir/running.$last" ] && echo running || echo exited ;;
+	*Labels*) cat "$dir/hash.$last" ;;
+	esac ;;
+ps) cat "$dir"/created.* 2>/dev/null ;;
+logs) echo "log line" ;;
+esac
+`
+
+// Installs the fake docker CLI as scheduler backend and returns its directory.
+func setupFakeDocker(t *testing.T) string {
+	dir := t.TempDir()
+	docker := path.Join(dir, "docker")
+	assert.Nil(t, ioutil.WriteFile(docker, []byte(fakeDocker), 0755))
+	maestro.RegisterScheduler("local-fake", func() maestro.Scheduler { return maestro.NewLocalScheduler(docker) })
+	maestro.SetupScheduler("local-fake")
+	return dir
+}
+
+func dockerLog(t *testing.T, dir string) []string {
+	data, err := ioutil.ReadFile(path.Join(dir, "docker.log"))
+	assert.Nil(t, err)
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestLocalSchedulerRun(t *testing.T) {
+	setupFakeFleet(t, `{
+  "username": "crisidev",
+  "app": "metrics",
+  "stages": [
+    {
+      "name": "dev",
+      "components": [
+        {
+          "name": "grafana",
+          "src": "hub.maestro.io:5000/crisidev/grafana",
+          "cmd": "grafana-server --config /etc/grafana.ini",
+          "after": "prometheus",
+          "keep_on_exit": true,
+          "env": ["GF_AUTH=off"],
+          "docker_args": "--net=host",
+          "volumes": ["/data"]
+        },
+        {
+          "name": "prometheus",
+          "src": "hub.maestro.io:5000/crisidev/prometheus",
+          "ports": [9090],
+          "scale": 2
+        }
+      ]
+    }
+  ]
+}`)
+	dir := setupFakeDocker(t)
+	defer maestro.SetupScheduler("fleet")
+
+	assert.Equal(t, 0, maestro.MaestroRun(""))
+	var starts []string
+	creates := map[string]string{}
+	for _, line := range dockerLog(t, dir) {
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "create":
+			creates[fields[2]] = line
+		case "start":
+			starts = append(starts, fields[1])
+		}
+	}
+	// prometheus has to be started before grafana, even if it comes later in the config
+	assert.Equal(t, []string{
+		"crisidev_dev_metrics_prometheus1",
+		"crisidev_dev_metrics_prometheus2",
+		"crisidev_dev_metrics_grafana1",
+	}, starts)
+	assert.Equal(t, 3, len(creates))
+	prometheus := creates["crisidev_dev_metrics_prometheus1"]
+	assert.Contains(t, prometheus, "--label maestro.unit=crisidev_dev_metrics_prometheus@1.service --label maestro.hash=")
+	assert.Contains(t, prometheus, " --rm --expose 9090")
+	assert.Contains(t, prometheus, "-e MAESTRO_ID=1 ")
+	assert.Contains(t, creates["crisidev_dev_metrics_prometheus2"], "-e MAESTRO_ID=2 ")
+	grafana := creates["crisidev_dev_metrics_grafana1"]
+	assert.NotContains(t, grafana, "--rm")
+	assert.Contains(t, grafana, "--net=host")
+	assert.Contains(t, grafana, "-v /share/maestro/crisidev/dev/metrics/data:/data")
+	assert.Contains(t, grafana, "-e GF_AUTH=off")
+	assert.True(t, strings.HasSuffix(grafana, "hub.maestro.io:5000/crisidev/grafana grafana-server --config /etc/grafana.ini"))
+
+	units, err := maestro.NewLocalScheduler(path.Join(dir, "docker")).List("crisidev_dev_metrics_prometheus")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"crisidev_dev_metrics_prometheus@1.service", "crisidev_dev_metrics_prometheus@2.service"}, units)
+	assert.Equal(t, 0, maestro.MaestroStatus(""))
+	assert.Equal(t, 0, maestro.MaestroJournal("crisidev_dev_metrics_grafana@1.service", false, false))
+	assert.Equal(t, 0, maestro.MaestroStop(""))
+	assert.Equal(t, 3, maestro.MaestroStatus("crisidev_dev_metrics_grafana@1.service"))
+	assert.Equal(t, 0, maestro.MaestroNuke(""))
+	assert.Equal(t, 1, maestro.MaestroStatus("crisidev_dev_metrics_grafana@1.service"))
+}
@@ -0,0 +1,119 @@
+package maestro_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/crisidev/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+const lockTestConfig = `{
+  "username": "crisidev",
+  "app": "metrics",
+  "stages": [
+    {
+      "name": "prod",
+      "components": [{"name": "grafana", "src": "grafana/grafana"}]
+    },
+    {
+      "name": "staging",
+      "components": [{"name": "grafana", "src": "grafana/grafana"}]
+    }
+  ]
+}`
+
+func TestEtcdClientLock(t *testing.T) {
+	for _, api := range maestro.EtcdAPIs {
+		server := maestro.NewEtcdFakeServer()
+		defer server.Close()
+		client, err := maestro.NewEtcdClient([]string{server.URL}, api, nil)
+		assert.Nil(t, err)
+
+		assert.Nil(t, client.Create("/maestro.io/lock", "a", 60), api)
+		assert.Equal(t, maestro.ErrEtcdKeyExists, client.Create("/maestro.io/lock", "b", 60), api)
+		assert.Equal(t, maestro.ErrEtcdCompareFailed, client.Refresh("/maestro.io/lock", "b", 60), api)
+		assert.Nil(t, client.Refresh("/maestro.io/lock", "a", 30), api)
+		kv, err := client.Get("/maestro.io/lock")
+		assert.Nil(t, err, api)
+		assert.Equal(t, "a", kv.Value, api)
+		assert.True(t, kv.TTL > 0 && kv.TTL <= 30, api)
+		assert.Equal(t, maestro.ErrEtcdCompareFailed, client.CompareAndDelete("/maestro.io/lock", "b"), api)
+		assert.Nil(t, client.CompareAndDelete("/maestro.io/lock", "a"), api)
+		assert.Equal(t, maestro.ErrEtcdKeyNotFound, client.Refresh("/maestro.io/lock", "a", 60), api)
+
+		// expired locks can be taken again
+		assert.Nil(t, client.Create("/maestro.io/lock", "a", 60), api)
+		server.Expire("/maestro.io/lock")
+		assert.Nil(t, client.Create("/maestro.io/lock", "b", 60), api)
+	}
+}
+
+func TestLockApp(t *testing.T) {
+	for _, api := range maestro.EtcdAPIs {
+		_, cfg := setupFakeFleet(t, lockTestConfig)
+		server := setupFakeEtcd(t, api)
+
+		lock, exitCode := maestro.LockApp("deploy")
+		assert.Equal(t, 0, exitCode, api)
+		for _, stage := range []string{"prod", "staging"} {
+			holder, err := maestro.LockHolder(stage)
+			assert.Nil(t, err, api)
+			assert.Equal(t, "deploy", holder.Command, api)
+			assert.True(t, holder.Mine(), api)
+			assert.True(t, holder.TTL > 0, api)
+		}
+		_, exitCode = maestro.LockApp("run")
+		assert.Equal(t, 1, exitCode, api)
+		assert.Equal(t, 0, maestro.MaestroLockStatus(), api)
+		lock.Unlock()
+		holder, err := maestro.LockHolder("prod")
+		assert.Nil(t, err, api)
+		assert.Nil(t, holder, api)
+
+		// a stage locked by someone else fails the whole app, releasing the stages locked
+		data, _ := json.Marshal(&maestro.MaestroLock{User: "bob", Host: "laptop", PID: 42, Command: "run", Time: time.Now()})
+		server.SetTTL(cfg.GetLockKey("staging"), string(data), 60)
+		_, exitCode = maestro.LockApp("deploy")
+		assert.Equal(t, 1, exitCode, api)
+		holder, _ = maestro.LockHolder("prod")
+		assert.Nil(t, holder, api)
+		assert.Equal(t, 1, maestro.MaestroUnlock("", false), api)
+		assert.Equal(t, 1, maestro.MaestroUnlock("dev", true), api)
+		assert.Equal(t, 0, maestro.MaestroUnlock("staging", true), api)
+		holder, _ = maestro.LockHolder("staging")
+		assert.Nil(t, holder, api)
+
+		// own locks are removed without force
+		_, exitCode = maestro.LockApp("deploy")
+		assert.Equal(t, 0, exitCode, api)
+		assert.Equal(t, 0, maestro.MaestroUnlock("", false), api)
+		lock, exitCode = maestro.LockApp("deploy")
+		assert.Equal(t, 0, exitCode, api)
+		lock.Unlock()
+
+		// locks are refreshed while held
+		maestro.SetupLock(3 * time.Second)
+		lock, _ = maestro.LockApp("deploy")
+		time.Sleep(2500 * time.Millisecond)
+		holder, _ = maestro.LockHolder("prod")
+		assert.True(t, holder.TTL > 1, api)
+		lock.Unlock()
+
+		// locks shorter than a second are refreshed every second
+		maestro.SetupLock(time.Nanosecond)
+		lock, exitCode = maestro.LockApp("deploy")
+		assert.Equal(t, 0, exitCode, api)
+		lock.Unlock()
+		maestro.SetupLock(maestro.LockDefaultTTL)
+
+		// a disabled lock is never taken
+		maestro.SetupLock(0)
+		_, exitCode = maestro.LockApp("deploy")
+		assert.Equal(t, 0, exitCode, api)
+		holder, _ = maestro.LockHolder("prod")
+		assert.Nil(t, holder, api)
+		maestro.SetupLock(maestro.LockDefaultTTL)
+	}
+}
@@ -0,0 +1,40 @@
+package maestro_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/crisidev/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlan(t *testing.T) {
+	server, _ := setupFakeFleet(t, fleetTestConfig)
+	plan := planApp(t)
+	assert.Equal(t, 3, len(plan.Create))
+	assert.True(t, plan.HasChanges())
+	assert.Contains(t, plan.Units[0].Diff, "+++ local/crisidev_prod_metrics_grafana@1.service")
+
+	assert.Equal(t, 0, maestro.MaestroRun(""))
+	plan = planApp(t)
+	assert.False(t, plan.HasChanges())
+	assert.Equal(t, 3, len(plan.Unchanged))
+
+	// a unit left over on the cluster and a changed image
+	options := []*maestro.FleetUnitOption{{Section: "Service", Name: "ExecStart", Value: "/bin/true"}}
+	client := maestro.NewFleetClient(server.URL)
+	assert.Nil(t, client.CreateUnit(&maestro.FleetUnit{Name: "crisidev_prod_metrics_old@1.service", Options: options, DesiredState: "launched"}))
+	assert.Nil(t, client.CreateUnit(&maestro.FleetUnit{Name: "someone_prod_other_app@1.service", Options: options, DesiredState: "launched"}))
+	loadConfig(t, strings.Replace(fleetTestConfig, "crisidev/grafana", "crisidev/grafana:v2", 1))
+	plan = planApp(t)
+	assert.Equal(t, []string{"crisidev_prod_metrics_grafana@1.service", "crisidev_prod_metrics_grafana@2.service"}, plan.Replace)
+	assert.Equal(t, []string{"crisidev_prod_metrics_old@1.service"}, plan.Destroy)
+	assert.Equal(t, []string{"crisidev_prod_metrics_prometheus@1.service"}, plan.Unchanged)
+	assert.Contains(t, plan.Units[0].Diff, "+ExecStartPre=-/usr/bin/docker pull hub.maestro.io:5000/crisidev/grafana:v2")
+}
+
+func planApp(t *testing.T) *maestro.Plan {
+	remote, err := maestro.PlanRemoteUnits()
+	assert.Nil(t, err)
+	return maestro.PlanUnits(maestro.PlanLocalUnits(), remote)
+}
@@ -0,0 +1,116 @@
+package maestro_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/crisidev/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+const portTestConfig = `{
+  "username": "crisidev",
+  "app": "web",
+  "stages": [
+    {
+      "name": "prod",
+      "components": [
+        {
+          "name": "nginx",
+          "src": "nginx",
+          "ports": [80, "8080:80", "127.0.0.1:8443:443/tcp", "53/udp"],
+          "scale": 2
+        },
+        {
+          "name": "haproxy",
+          "src": "haproxy",
+          "ports": ["10.0.0.1:8080:80"]
+        },
+        {
+          "name": "redis",
+          "src": "redis",
+          "ports": [6379, "8443:443/udp"]
+        }
+      ]
+    }
+  ]
+}`
+
+func TestParsePort(t *testing.T) {
+	for s, expected := range map[string]maestro.MaestroPort{
+		"80":                  {Port: 80},
+		"53/udp":              {Port: 53, Protocol: "udp"},
+		"8080:80":             {HostPort: 8080, Port: 80},
+		"127.0.0.1:8080:80":   {HostIP: "127.0.0.1", HostPort: 8080, Port: 80},
+		"[::1]:8080:80/sctp":  {HostIP: "::1", HostPort: 8080, Port: 80, Protocol: "sctp"},
+		"0.0.0.0:5353:53/udp": {HostIP: "0.0.0.0", HostPort: 5353, Port: 53, Protocol: "udp"},
+	} {
+		port, err := maestro.ParsePort(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, expected, port, s)
+		assert.Equal(t, s, port.String())
+	}
+	for _, s := range []string{"", "http", "127.0.0.1:80", "1:2:3:4", "[::1]:80", "a:80"} {
+		_, err := maestro.ParsePort(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestPortJSON(t *testing.T) {
+	var ports []maestro.MaestroPort
+	assert.Nil(t, json.Unmarshal([]byte(`[9090, "8080:80/tcp"]`), &ports))
+	assert.Equal(t, []maestro.MaestroPort{{Port: 9090}, {HostPort: 8080, Port: 80, Protocol: "tcp"}}, ports)
+	data, err := json.Marshal(ports)
+	assert.Nil(t, err)
+	assert.Equal(t, `[9090,"8080:80/tcp"]`, string(data))
+	assert.EqualError(t, json.Unmarshal([]byte(`[true]`), &ports), "invalid port true, expected a number or a string")
+}
+
+func TestPortValidate(t *testing.T) {
+	messages := []string{}
+	for _, port := range []maestro.MaestroPort{
+		{Port: 0, HostPort: 70000},
+		{Port: 80, HostIP: "localhost", HostPort: 8080},
+		{Port: 80, HostIP: "127.0.0.1"},
+		{Port: 80, Protocol: "http"},
+	} {
+		for _, err := range port.Validate() {
+			messages = append(messages, err.Error())
+		}
+	}
+	assert.Equal(t, []string{
+		"invalid port 0",
+		"invalid host port 70000",
+		`invalid host ip "localhost"`,
+		"port 80 binds a host ip without a host port",
+		`invalid protocol "http", expected one of tcp, udp, sctp`,
+	}, messages)
+}
+
+func TestPortsUnit(t *testing.T) {
+	server, config := setupFakeFleet(t, portTestConfig)
+	components := config.Stages[0].Components
+	assert.Equal(t, []string{"crisidev_prod_web_nginx@*", "crisidev_prod_web_haproxy@*"}, components[0].Conflicts)
+	assert.Equal(t, []string{"crisidev_prod_web_nginx@*"}, components[1].Conflicts)
+	// udp and tcp ports do not conflict
+	assert.Empty(t, components[2].Conflicts)
+
+	assert.Equal(t, 0, maestro.MaestroRun(""))
+	unit := maestro.SerializeUnitOptions(server.Unit("crisidev_prod_web_nginx@1.service").Options)
+	assert.Contains(t, unit, " --expose 80 -p 8080:80 -p 127.0.0.1:8443:443/tcp --expose 53/udp ")
+	assert.Contains(t, unit, "[X-Fleet]\nConflicts=crisidev_prod_web_nginx@*\nConflicts=crisidev_prod_web_haproxy@*\n")
+	unit = maestro.SerializeUnitOptions(server.Unit("crisidev_prod_web_redis@1.service").Options)
+	assert.NotContains(t, unit, "Conflicts")
+
+	data, err := maestro.EncodeConfig(config, maestro.FormatYAML)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), "\n    ports:\n    - 80\n    - 8080:80\n")
+}
+
+func TestValidateDuplicateHostPorts(t *testing.T) {
+	component := maestro.MaestroComponent{Name: "web", Src: "nginx", Ports: []maestro.MaestroPort{
+		{HostPort: 8080, Port: 80}, {HostIP: "127.0.0.1", HostPort: 8080, Port: 8080}, {HostPort: 8080, Port: 80, Protocol: "udp"}}}
+	errs := component.Validate(map[string]bool{"web": true})
+	assert.Equal(t, 1, len(errs))
+	assert.EqualError(t, errs[0], "host port 8080 is published more than once")
+}
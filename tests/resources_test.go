@@ -0,0 +1,64 @@
+package maestro_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/crisidev/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+const resourcesTestConfig = `{
+  "username": "crisidev",
+  "app": "metrics",
+  "stages": [
+    {
+      "name": "prod",
+      "components": [
+        {
+          "name": "prometheus",
+          "src": "hub.maestro.io:5000/crisidev/prometheus",
+          "memory": "512m",
+          "cpus": 1.5,
+          "restart": "on-failure",
+          "restart_sec": 5,
+          "start_timeout": 120
+        },
+        {
+          "name": "grafana",
+          "src": "hub.maestro.io:5000/crisidev/grafana"
+        }
+      ]
+    }
+  ]
+}`
+
+func TestResourcesUnit(t *testing.T) {
+	server, _ := setupFakeFleet(t, resourcesTestConfig)
+	assert.Equal(t, 0, maestro.MaestroRun(""))
+	unit := maestro.SerializeUnitOptions(server.Unit("crisidev_prod_metrics_prometheus@1.service").Options)
+	assert.Contains(t, unit, "[Service]\nTimeoutStartSec=120\nRestart=on-failure\nRestartSec=5\nExecStartPre=")
+	assert.Contains(t, unit, " --memory 512m --cpus 1.5 -e MAESTRO_NODE=%H")
+	unit = maestro.SerializeUnitOptions(server.Unit("crisidev_prod_metrics_grafana@1.service").Options)
+	assert.Contains(t, unit, "[Service]\nTimeoutStartSec=0\nExecStartPre=")
+	assert.NotContains(t, unit, "--memory")
+	assert.NotContains(t, unit, "--cpus")
+}
+
+func TestLocalSchedulerResources(t *testing.T) {
+	setupFakeFleet(t, resourcesTestConfig)
+	dir := setupFakeDocker(t)
+	defer maestro.SetupScheduler("fleet")
+
+	assert.Equal(t, 0, maestro.MaestroRun(""))
+	creates := map[string]string{}
+	for _, line := range dockerLog(t, dir) {
+		if fields := strings.Fields(line); fields[0] == "create" {
+			creates[fields[2]] = line
+		}
+	}
+	prometheus := creates["crisidev_prod_metrics_prometheus1"]
+	assert.Contains(t, prometheus, " --restart on-failure --memory 512m --cpus 1.5 ")
+	assert.NotContains(t, prometheus, "--rm")
+	assert.Contains(t, creates["crisidev_prod_metrics_grafana1"], " --rm ")
+}
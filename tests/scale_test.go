@@ -0,0 +1,77 @@
+package maestro_test
+
+import (
+	"testing"
+
+	"github.com/crisidev/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScale(t *testing.T) {
+	server, _ := setupFakeFleet(t, fleetTestConfig)
+	assert.Equal(t, 0, maestro.MaestroRun(""))
+
+	assert.Equal(t, 0, maestro.MaestroScale("grafana", 4))
+	assert.Equal(t, []string{
+		"crisidev_prod_metrics_grafana@1.service",
+		"crisidev_prod_metrics_grafana@2.service",
+		"crisidev_prod_metrics_grafana@3.service",
+		"crisidev_prod_metrics_grafana@4.service",
+		"crisidev_prod_metrics_prometheus@1.service",
+	}, server.UnitNames())
+
+	// an orphaned instance left by someone else is removed too
+	options := []*maestro.FleetUnitOption{{Section: "Service", Name: "ExecStart", Value: "/bin/true"}}
+	client := maestro.NewFleetClient(server.URL)
+	assert.Nil(t, client.CreateUnit(&maestro.FleetUnit{Name: "crisidev_prod_metrics_grafana@12.service", Options: options, DesiredState: "launched"}))
+	assert.Equal(t, 0, maestro.MaestroScale("grafana", 1))
+	assert.Equal(t, []string{
+		"crisidev_prod_metrics_grafana@1.service",
+		"crisidev_prod_metrics_prometheus@1.service",
+	}, server.UnitNames())
+	// scaling down to one instance changes its container name
+	assert.Contains(t, maestro.SerializeUnitOptions(server.Unit("crisidev_prod_metrics_grafana@1.service").Options), "--name crisidev_prod_metrics_grafana1 ")
+
+	assert.Equal(t, 1, maestro.MaestroScale("missing", 1))
+	assert.Equal(t, 1, maestro.MaestroScale("grafana", -1))
+}
+
+const scaleDepsTestConfig = `{
+  "username": "crisidev",
+  "app": "metrics",
+  "stages": [
+    {
+      "name": "prod",
+      "components": [
+        {"name": "prometheus", "src": "prom/prometheus", "scale": 3},
+        {"name": "grafana", "src": "grafana/grafana", "scale": 2, "requires": "prometheus"},
+        {"name": "alertmanager", "src": "prom/alertmanager", "scale": 2, "affinity": "prometheus"}
+      ]
+    }
+  ]
+}`
+
+func TestScaleDependency(t *testing.T) {
+	server, _ := setupFakeFleet(t, scaleDepsTestConfig)
+	assert.Equal(t, 0, maestro.MaestroRun(""))
+	unit := maestro.SerializeUnitOptions(server.Unit("crisidev_prod_metrics_grafana@2.service").Options)
+	assert.Contains(t, unit, "Requires=crisidev_prod_metrics_prometheus@%i.service")
+
+	// dependents of the removed instances are replaced
+	assert.Equal(t, 0, maestro.MaestroScale("prometheus", 1))
+	assert.Nil(t, server.Unit("crisidev_prod_metrics_prometheus@2.service"))
+	for _, name := range []string{"crisidev_prod_metrics_grafana@1.service", "crisidev_prod_metrics_grafana@2.service"} {
+		unit = maestro.SerializeUnitOptions(server.Unit(name).Options)
+		assert.Contains(t, unit, "Requires=crisidev_prod_metrics_prometheus@1.service")
+		assert.NotContains(t, unit, "prometheus@%i")
+	}
+	unit = maestro.SerializeUnitOptions(server.Unit("crisidev_prod_metrics_alertmanager@2.service").Options)
+	assert.Contains(t, unit, "MachineOf=crisidev_prod_metrics_prometheus@1.service")
+
+	// instances which are not submitted are not started
+	assert.Equal(t, 0, maestro.MaestroNuke("crisidev_prod_metrics_grafana@2.service"))
+	assert.Equal(t, 0, maestro.MaestroScale("prometheus", 2))
+	assert.Nil(t, server.Unit("crisidev_prod_metrics_grafana@2.service"))
+	unit = maestro.SerializeUnitOptions(server.Unit("crisidev_prod_metrics_grafana@1.service").Options)
+	assert.Contains(t, unit, "Requires=crisidev_prod_metrics_prometheus@%i.service")
+}
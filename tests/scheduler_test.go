@@ -0,0 +1,62 @@
+package maestro_test
+
+import (
+	"path"
+	"testing"
+
+	"github.com/crisidev/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+// Scheduler recording every call it receives.
+type recordingScheduler struct {
+	calls []string
+}
+
+func (r *recordingScheduler) record(cmd, unitPath string) int {
+	r.calls = append(r.calls, cmd+" "+path.Base(unitPath))
+	return 0
+}
+
+func (r *recordingScheduler) Submit(unitPath string) int  { return r.record("submit", unitPath) }
+func (r *recordingScheduler) Start(unitPath string) int   { return r.record("start", unitPath) }
+func (r *recordingScheduler) Stop(unitPath string) int    { return r.record("stop", unitPath) }
+func (r *recordingScheduler) Destroy(unitPath string) int { return r.record("destroy", unitPath) }
+func (r *recordingScheduler) Status(unitPath string) int  { return r.record("status", unitPath) }
+func (r *recordingScheduler) Journal(unitPath string, follow, all bool) int {
+	if follow {
+		return r.record("journalf", unitPath)
+	}
+	return r.record("journal", unitPath)
+}
+func (r *recordingScheduler) List(prefix string) ([]string, error) { return nil, nil }
+func (r *recordingScheduler) IsRunning(unitPath string) bool       { return false }
+func (r *recordingScheduler) Changed(unitPath string) bool         { return false }
+func (r *recordingScheduler) State(unitPath string) string         { return "active" }
+
+func TestSchedulerBackend(t *testing.T) {
+	recorder := &recordingScheduler{}
+	maestro.RegisterScheduler("recorder", func() maestro.Scheduler { return recorder })
+	assert.Contains(t, maestro.SchedulerNames(), "fleet")
+	assert.Contains(t, maestro.SchedulerNames(), "recorder")
+
+	setupFakeFleet(t, fleetTestConfig)
+	maestro.SetupScheduler("recorder")
+	defer maestro.SetupScheduler("fleet")
+
+	assert.Equal(t, 0, maestro.MaestroRun(""))
+	assert.Equal(t, 0, maestro.MaestroStop(""))
+	assert.Equal(t, 0, maestro.MaestroJournal("crisidev_prod_metrics_grafana@2.service", true, false))
+	assert.Equal(t, []string{
+		"submit crisidev_prod_metrics_prometheus@1.service",
+		"start crisidev_prod_metrics_prometheus@1.service",
+		"submit crisidev_prod_metrics_grafana@1.service",
+		"start crisidev_prod_metrics_grafana@1.service",
+		"submit crisidev_prod_metrics_grafana@2.service",
+		"start crisidev_prod_metrics_grafana@2.service",
+		"stop crisidev_prod_metrics_prometheus@1.service",
+		"stop crisidev_prod_metrics_grafana@1.service",
+		"stop crisidev_prod_metrics_grafana@2.service",
+		"journalf crisidev_prod_metrics_grafana@2.service",
+	}, recorder.calls)
+}
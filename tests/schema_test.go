@@ -0,0 +1,72 @@
+package maestro_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/crisidev/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckUnknownFields(t *testing.T) {
+	errs := []string{}
+	for _, err := range maestro.CheckUnknownFields([]byte(`{
+  "app": "metrics",
+  "user": "crisidev",
+  "stages": [
+    {
+      "name": "prod",
+      "components": [
+        {"name": "grafana", "src": "grafana", "keep_on_exti": true, "dockerargs": "--net=host", "unitname": "x"},
+        {"src": "prometheus", "sacle": 2, "whatever": 1}
+      ]
+    },
+    {"components": [], "stage": "dev"}
+  ]
+}`)) {
+		errs = append(errs, err.Error())
+	}
+	assert.Equal(t, []string{
+		`prod/grafana: unknown field "dockerargs", did you mean "docker_args"?`,
+		`prod/grafana: unknown field "keep_on_exti", did you mean "keep_on_exit"?`,
+		`prod/grafana: unknown field "unitname"`,
+		`prod/components[1]: unknown field "sacle", did you mean "scale"?`,
+		`prod/components[1]: unknown field "whatever"`,
+		`stages[1]: unknown field "stage"`,
+		`config: unknown field "user"`,
+	}, errs)
+}
+
+func TestMaestroSchema(t *testing.T) {
+	schema := maestro.MaestroSchema()
+	assert.Equal(t, "http://json-schema.org/draft-07/schema#", schema["$schema"])
+	assert.Equal(t, false, schema["additionalProperties"])
+	assert.Equal(t, []string{"app", "stages"}, schema["required"])
+	stages := schema["properties"].(map[string]interface{})["stages"].(map[string]interface{})
+	components := stages["items"].(map[string]interface{})["properties"].(map[string]interface{})["components"].(map[string]interface{})
+	component := components["items"].(map[string]interface{})
+	properties := component["properties"].(map[string]interface{})
+	assert.Equal(t, []string{"name", "src"}, component["required"])
+	assert.Equal(t, map[string]interface{}{"type": "boolean"}, properties["keep_on_exit"])
+	assert.Equal(t, maestro.MaestroPort{}.JSONSchema(), properties["ports"].(map[string]interface{})["items"])
+	assert.NotContains(t, properties, "unitname")
+	assert.NotContains(t, properties, "container_name")
+
+	// the shipped schema has to be regenerated with `maestro schema` when the config changes
+	shipped, err := ioutil.ReadFile("../config/maestro.schema.json")
+	assert.Nil(t, err)
+	generated, _ := json.MarshalIndent(schema, "", "    ")
+	assert.Equal(t, string(generated)+"\n", string(shipped))
+}
+
+func TestLaxConfigCheck(t *testing.T) {
+	maestro.SetupConfigCheck(true)
+	defer maestro.SetupConfigCheck(false)
+	setupFakeFleet(t, `{
+  "username": "crisidev",
+  "app": "metrics",
+  "stages": [{"name": "prod", "components": [{"name": "grafana", "src": "grafana", "keep_on_exti": true}]}]
+}`)
+	assert.Equal(t, 0, maestro.MaestroValidate())
+}
@@ -0,0 +1,53 @@
+package maestro_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/crisidev/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+// Renders the run unit of a component for every combination of global, single and scale.
+func TestSingleGlobalScaleUnits(t *testing.T) {
+	for _, global := range []bool{false, true} {
+		for _, single := range []bool{false, true} {
+			for _, scale := range []int{1, 3} {
+				name := fmt.Sprintf("global=%v single=%v scale=%d", global, single, scale)
+				cfg := fmt.Sprintf(`{
+  "username": "crisidev",
+  "app": "web",
+  "stages": [{"name": "prod", "components": [
+    {"name": "nginx", "src": "nginx", "global": %v, "single": %v, "scale": %d}
+  ]}]
+}`, global, single, scale)
+				if global && scale > 1 {
+					var config maestro.MaestroConfig
+					assert.Nil(t, json.Unmarshal([]byte(cfg), &config))
+					assert.EqualError(t, config.Validate()[0], "prod/nginx: global components can not be scaled (scale 3)", name)
+					continue
+				}
+				_, config := setupFakeFleet(t, cfg)
+				component := config.Stages[0].Components[0]
+				unit := maestro.RenderUnitTmpl(component, component.UnitName, "run-unit.tmpl")
+				fleet := strings.TrimSpace(unit[strings.Index(unit, "[X-Fleet]"):])
+				assert.NotContains(t, unit, "<no value>", name)
+				switch {
+				case global:
+					assert.Equal(t, "[X-Fleet]\nGlobal=true", fleet, name)
+				case single:
+					assert.Equal(t, "[X-Fleet]\nConflicts=crisidev_prod_web_nginx@*", fleet, name)
+				default:
+					assert.Equal(t, "[X-Fleet]", fleet, name)
+				}
+			}
+		}
+	}
+}
+
+func TestCheckUnitTemplates(t *testing.T) {
+	maestro.Init(t.TempDir(), "maestro.io", "127.0.0.1", "/share/maestro", "", []string{}, false)
+	assert.Empty(t, maestro.CheckUnitTemplates())
+}
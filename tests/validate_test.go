@@ -0,0 +1,66 @@
+package maestro_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/crisidev/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	var config maestro.MaestroConfig
+	assert.Nil(t, json.Unmarshal([]byte(`{
+  "app": "my_app",
+  "stages": [
+    {
+      "name": "prod",
+      "components": [
+        {"name": "redis", "src": "redis", "global": true, "scale": 3, "ports": [6379, 70000]},
+        {"name": "web@1", "after": "cache", "secrets": ["DB-PASSWORD", "KEY", "KEY"],
+         "memory": "1gb", "cpus": -1, "restart": "sometimes", "restart_sec": -5, "start_timeout": -1},
+        {"name": "redis", "src": "redis", "after": "redis"}
+      ]
+    },
+    {"name": "prod"}
+  ]
+}`), &config))
+	errs := []string{}
+	for _, err := range config.Validate() {
+		errs = append(errs, err.Error())
+	}
+	assert.Equal(t, []string{
+		`config: app "my_app" must not contain any of "_@"`,
+		`prod/redis: global components can not be scaled (scale 3)`,
+		`prod/redis: invalid port 70000`,
+		`prod/web@1: component name "web@1" must not contain any of "_@"`,
+		`prod/web@1: src is empty`,
+		`prod/web@1: invalid memory "1gb", expected a number with an optional b, k, m or g unit`,
+		`prod/web@1: cpus -1 must not be negative`,
+		`prod/web@1: invalid restart "sometimes", expected one of no, on-failure, always`,
+		`prod/web@1: restart_sec -5 must not be negative`,
+		`prod/web@1: start_timeout -1 must not be negative`,
+		`prod/web@1: invalid secret name "DB-PASSWORD"`,
+		`prod/web@1: duplicate secret "KEY"`,
+		`prod/web@1: after references unknown component "cache"`,
+		`prod/redis: duplicate component name "redis"`,
+		`prod/redis: after references the component itself`,
+		`prod: duplicate stage name "prod"`,
+	}, errs)
+}
+
+func TestValidateShippedConfigs(t *testing.T) {
+	files, err := filepath.Glob("../config/maestro-*.json")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, files)
+	for _, file := range files {
+		var config maestro.MaestroConfig
+		data, err := ioutil.ReadFile(file)
+		assert.Nil(t, err)
+		assert.Nil(t, json.Unmarshal(data, &config))
+		assert.Empty(t, config.Validate(), file)
+		assert.Empty(t, maestro.CheckUnknownFields(data), file)
+	}
+}
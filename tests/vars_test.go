@@ -0,0 +1,81 @@
+package maestro_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/crisidev/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterpolate(t *testing.T) {
+	vars := map[string]string{"TAG": "1.2", "EMPTY": ""}
+	lookup := func(name string) (string, bool) {
+		value, ok := vars[name]
+		return value, ok
+	}
+	for input, expected := range map[string]string{
+		"busybox:${TAG}":             "busybox:1.2",
+		"busybox:${TAG:-latest}":     "busybox:1.2",
+		"busybox:${MISSING:-latest}": "busybox:latest",
+		"busybox:${EMPTY:-latest}":   "busybox:latest",
+		"[${EMPTY}]":                 "[]",
+		"echo $HOME $$ %i":           "echo $HOME $ %i",
+		"broken ${TAG":               "broken ${TAG",
+	} {
+		output, undefined := maestro.Interpolate(input, lookup)
+		assert.Equal(t, expected, output, input)
+		assert.Empty(t, undefined, input)
+	}
+	_, undefined := maestro.Interpolate("${A}/${TAG}/${B}", lookup)
+	assert.Equal(t, []string{"A", "B"}, undefined)
+}
+
+func TestLoadEnvFile(t *testing.T) {
+	envFile := path.Join(t.TempDir(), ".env")
+	assert.Nil(t, ioutil.WriteFile(envFile, []byte("# registry\nREGISTRY=hub.maestro.io:5000\n\nexport TAG=\"1.0\"\nCMD='ping google.com'\n"), 0644))
+	vars, err := maestro.LoadEnvFile(envFile)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"REGISTRY": "hub.maestro.io:5000", "TAG": "1.0", "CMD": "ping google.com"}, vars)
+
+	assert.Nil(t, ioutil.WriteFile(envFile, []byte("A=1\nbroken\n"), 0644))
+	_, err = maestro.LoadEnvFile(envFile)
+	assert.EqualError(t, err, envFile+":2: expected KEY=value")
+}
+
+func TestInterpolateConfig(t *testing.T) {
+	envFile := path.Join(t.TempDir(), ".env")
+	assert.Nil(t, ioutil.WriteFile(envFile, []byte("REGISTRY=registry.local:5000\nTAG=0.9\nSTAGE=dev\n"), 0644))
+	os.Setenv("MAESTRO_TEST_TAG", "1.0")
+	defer os.Unsetenv("MAESTRO_TEST_TAG")
+	maestro.SetupConfigVars(map[string]string{"STAGE": "prod"}, envFile)
+	defer maestro.SetupConfigVars(nil, "")
+
+	_, config := setupFakeFleet(t, `{
+  "username": "crisidev",
+  "app": "metrics",
+  "stages": [
+    {
+      "name": "${STAGE}",
+      "components": [
+        {
+          "name": "prometheus",
+          "src": "${REGISTRY}/crisidev/prometheus:${MAESTRO_TEST_TAG}",
+          "env": ["RETENTION=${RETENTION:-15d}", "TAG=${TAG}"],
+          "ports": [9090]
+        }
+      ]
+    }
+  ]
+}`)
+	assert.Equal(t, "prod", config.Stages[0].Name)
+	component := config.Stages[0].Components[0]
+	assert.Equal(t, "registry.local:5000/crisidev/prometheus:1.0", component.Src)
+	assert.Equal(t, []string{"RETENTION=15d", "TAG=0.9"}, component.Env)
+	assert.Equal(t, []maestro.MaestroPort{{Port: 9090}}, component.Ports)
+
+	_, err := maestro.InterpolateConfig([]byte(`{"app": "${APP_NAME}", "stages": [{"name": "${STAGE_NAME}-${APP_NAME}"}]}`))
+	assert.EqualError(t, err, "undefined variables in configuration: APP_NAME, STAGE_NAME")
+}
@@ -0,0 +1,193 @@
+package maestro
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Characters breaking unit and container names.
+const invalidNameChars = "_@"
+
+// Restart policies, as understood by systemd.
+var restartPolicies = []string{"no", "on-failure", "always"}
+
+// Memory limits understood by docker, e.g. 512m or 2g.
+var memoryLimit = regexp.MustCompile(`^[0-9]+[bkmgBKMG]?$`)
+
+// Fleet machine ids, as in /etc/machine-id.
+var machineID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// Validates the configuration as written by the user, before defaults are set.
+// It returns all the problems found, prefixed with their stage/component path.
+func (c *MaestroConfig) Validate() (errs []error) {
+	fail := func(path, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+	}
+	if c.App == "" {
+		fail("config", "app is empty")
+	}
+	checkName := func(path, field, name string) {
+		if strings.ContainsAny(name, invalidNameChars) {
+			fail(path, "%s %q must not contain any of %q", field, name, invalidNameChars)
+		}
+	}
+	checkName("config", "app", c.App)
+	checkName("config", "username", c.Username)
+	if len(c.Stages) == 0 {
+		fail("config", "no stages defined")
+	}
+	stages := map[string]bool{}
+	for i, stage := range c.Stages {
+		stagePath := fmt.Sprintf("stages[%d]", i)
+		if stage.Name == "" {
+			fail(stagePath, "stage name is empty")
+		} else {
+			stagePath = stage.Name
+		}
+		checkName(stagePath, "stage name", stage.Name)
+		if stages[stage.Name] {
+			fail(stagePath, "duplicate stage name %q", stage.Name)
+		}
+		stages[stage.Name] = true
+
+		components := map[string]bool{}
+		for _, component := range stage.Components {
+			components[component.Name] = true
+		}
+		seen := map[string]bool{}
+		for k, component := range stage.Components {
+			componentPath := fmt.Sprintf("%s/components[%d]", stagePath, k)
+			if component.Name == "" {
+				fail(componentPath, "component name is empty")
+			} else {
+				componentPath = stagePath + "/" + component.Name
+			}
+			checkName(componentPath, "component name", component.Name)
+			if seen[component.Name] {
+				fail(componentPath, "duplicate component name %q", component.Name)
+			}
+			seen[component.Name] = true
+			for _, err := range component.Validate(components) {
+				fail(componentPath, "%s", err)
+			}
+		}
+		if cycle := DependencyCycle(stage.Components); cycle != nil {
+			fail(stagePath, "dependency cycle %s", formatCycle(cycle))
+		}
+	}
+	return
+}
+
+// Validates a single component. `components` holds the names of the components in the same stage.
+func (m *MaestroComponent) Validate(components map[string]bool) (errs []error) {
+	if m.Src == "" {
+		errs = append(errs, fmt.Errorf("src is empty"))
+	}
+	if m.Scale < 0 {
+		errs = append(errs, fmt.Errorf("scale %d must not be negative", m.Scale))
+	}
+	if m.Global && m.Scale > 1 {
+		errs = append(errs, fmt.Errorf("global components can not be scaled (scale %d)", m.Scale))
+	}
+	for i, port := range m.Ports {
+		errs = append(errs, port.Validate()...)
+		for _, previous := range m.Ports[:i] {
+			if port.Conflicts(previous) {
+				errs = append(errs, fmt.Errorf("host port %d is published more than once", port.HostPort))
+			}
+		}
+	}
+	if m.Memory != "" && !memoryLimit.MatchString(m.Memory) {
+		errs = append(errs, fmt.Errorf("invalid memory %q, expected a number with an optional b, k, m or g unit", m.Memory))
+	}
+	if m.CPUs < 0 {
+		errs = append(errs, fmt.Errorf("cpus %v must not be negative", m.CPUs))
+	}
+	if m.Restart != "" && !stringIn(m.Restart, restartPolicies) {
+		errs = append(errs, fmt.Errorf("invalid restart %q, expected one of %s", m.Restart, strings.Join(restartPolicies, ", ")))
+	}
+	if m.RestartSec < 0 {
+		errs = append(errs, fmt.Errorf("restart_sec %d must not be negative", m.RestartSec))
+	}
+	if m.StartTimeout < 0 {
+		errs = append(errs, fmt.Errorf("start_timeout %d must not be negative", m.StartTimeout))
+	}
+	if m.Healthcheck != nil {
+		errs = append(errs, m.Healthcheck.Validate()...)
+	}
+	secrets := map[string]bool{}
+	for _, name := range m.Secrets {
+		if !validEnvName(name) {
+			errs = append(errs, fmt.Errorf("invalid secret name %q", name))
+		} else if secrets[name] {
+			errs = append(errs, fmt.Errorf("duplicate secret %q", name))
+		}
+		secrets[name] = true
+	}
+	if m.Affinity != "" {
+		if m.Affinity == m.Name {
+			errs = append(errs, fmt.Errorf("affinity references the component itself"))
+		} else if !components[m.Affinity] {
+			errs = append(errs, fmt.Errorf("affinity references unknown component %q", m.Affinity))
+		}
+	}
+	for _, name := range m.AntiAffinity {
+		if !components[name] {
+			errs = append(errs, fmt.Errorf("anti_affinity references unknown component %q", name))
+		} else if name == m.Affinity {
+			errs = append(errs, fmt.Errorf("component %q is both in affinity and anti_affinity", name))
+		}
+	}
+	if m.MachineID != "" && !machineID.MatchString(m.MachineID) {
+		errs = append(errs, fmt.Errorf("invalid machine_id %q", m.MachineID))
+	}
+	for _, metadata := range m.MachineMetadata {
+		if split := strings.SplitN(metadata, "=", 2); len(split) != 2 || split[0] == "" || split[1] == "" {
+			errs = append(errs, fmt.Errorf("invalid machine_metadata %q, expected key=value", metadata))
+		}
+	}
+	if m.Global && (m.Affinity != "" || len(m.AntiAffinity) > 0 || m.MachineID != "") {
+		errs = append(errs, fmt.Errorf("global components can only be constrained with machine_metadata"))
+	}
+	for _, deps := range []struct {
+		field string
+		names MaestroDeps
+	}{{"after", m.After}, {"requires", m.Requires}, {"wants", m.Wants}} {
+		for _, name := range deps.names {
+			if name == m.Name {
+				errs = append(errs, fmt.Errorf("%s references the component itself", deps.field))
+			} else if !components[name] {
+				errs = append(errs, fmt.Errorf("%s references unknown component %q", deps.field, name))
+			}
+		}
+	}
+	return
+}
+
+// Validates the configuration and the unit templates, printing all problems and exiting if
+// any is found, so that broken templates fail every command before units are rendered.
+func (c *MaestroConfig) CheckMaestroConfig() {
+	errs := append(c.Validate(), CheckUnitTemplates()...)
+	if len(errs) == 0 {
+		lg.Debug("configuration is valid")
+		return
+	}
+	for _, err := range errs {
+		lg.Error(err)
+	}
+	lg.Fatal(fmt.Errorf("invalid configuration %s, %d problems found", configFile, len(errs)))
+}
+
+// Prints the result of the configuration validation, checking again that the unit templates
+// render. Invalid configurations never get here, as they are rejected while loading.
+func MaestroValidate() (exitCode int) {
+	if errs := CheckUnitTemplates(); len(errs) > 0 {
+		for _, err := range errs {
+			lg.Error(err)
+		}
+		return 1
+	}
+	lg.Out(lg.b("maestro ") + "configuration " + configFile + " is " + lg.g("valid"))
+	return
+}
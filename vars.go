@@ -0,0 +1,158 @@
+package maestro
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Variables set with --var and read from the --envfile, used to interpolate the configuration.
+var (
+	configVars    map[string]string
+	configEnvFile map[string]string
+)
+
+// Setup the variables available to the configuration. Variables set with `vars` take
+// precedence over the process environment, which takes precedence over `envFile`.
+func SetupConfigVars(vars map[string]string, envFile string) {
+	configVars = vars
+	configEnvFile = map[string]string{}
+	if envFile != "" {
+		var err error
+		configEnvFile, err = LoadEnvFile(envFile)
+		lg.Fatal(err)
+	}
+}
+
+// Parses a dotenv style file: KEY=value lines, optionally prefixed by `export` and
+// with quoted values. Blank lines and lines starting with # are ignored.
+func LoadEnvFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	vars := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		split := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(split[0])
+		if len(split) != 2 || key == "" {
+			return nil, fmt.Errorf("%s:%d: expected KEY=value", path, n)
+		}
+		value := strings.TrimSpace(split[1])
+		if len(value) > 1 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		vars[key] = value
+	}
+	return vars, scanner.Err()
+}
+
+// Looks up a configuration variable.
+func LookupConfigVar(name string) (string, bool) {
+	if value, ok := configVars[name]; ok {
+		return value, true
+	}
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true
+	}
+	value, ok := configEnvFile[name]
+	return value, ok
+}
+
+// Replaces ${VAR} and ${VAR:-default} in `s`, returning the names of the undefined
+// variables. The default is used when the variable is unset or empty, `$$` is a literal `$`.
+func Interpolate(s string, lookup func(string) (string, bool)) (string, []string) {
+	var out strings.Builder
+	undefined := []string{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			out.WriteByte(s[i])
+			continue
+		}
+		switch s[i+1] {
+		case '$':
+			out.WriteByte('$')
+			i++
+			continue
+		case '{':
+		default:
+			out.WriteByte(s[i])
+			continue
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end == -1 {
+			out.WriteString(s[i:])
+			break
+		}
+		expr := s[i+2 : i+end]
+		i += end
+		name, fallback, hasDefault := expr, "", false
+		if split := strings.SplitN(expr, ":-", 2); len(split) == 2 {
+			name, fallback, hasDefault = split[0], split[1], true
+		}
+		value, ok := lookup(name)
+		switch {
+		case ok && (value != "" || !hasDefault):
+			out.WriteString(value)
+		case hasDefault:
+			out.WriteString(fallback)
+		default:
+			undefined = append(undefined, name)
+		}
+	}
+	return out.String(), undefined
+}
+
+// Interpolates all string values of a JSON configuration, failing with the list of
+// undefined variables.
+func InterpolateConfig(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	undefined := map[string]bool{}
+	value = interpolateValue(value, undefined)
+	if len(undefined) > 0 {
+		names := []string{}
+		for name := range undefined {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, errors.New("undefined variables in configuration: " + strings.Join(names, ", "))
+	}
+	return json.Marshal(value)
+}
+
+func interpolateValue(value interface{}, undefined map[string]bool) interface{} {
+	switch v := value.(type) {
+	case string:
+		interpolated, names := Interpolate(v, LookupConfigVar)
+		for _, name := range names {
+			undefined[name] = true
+		}
+		return interpolated
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = interpolateValue(item, undefined)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = interpolateValue(item, undefined)
+		}
+	}
+	return value
+}